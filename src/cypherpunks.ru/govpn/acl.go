@@ -0,0 +1,375 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86DD
+	etherTypeARP  = 0x0806
+
+	ipProtoICMP   = 1
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+
+	// IPv6 extension headers
+	ipProtoHopOpts  = 0
+	ipProtoRouting  = 43
+	ipProtoFragment = 44
+	ipProtoAH       = 51
+	ipProtoDstOpts  = 60
+)
+
+// ICMPv6 messages required for IPv6 to work on the link: multicast
+// listener discovery and neighbour discovery ones.
+var aclICMPv6Link = map[byte]bool{
+	130: true, 131: true, 132: true, 143: true,
+	133: true, 134: true, 135: true, 136: true, 137: true,
+}
+
+var aclProtoNames = map[string]byte{
+	"icmp":   ipProtoICMP,
+	"tcp":    ipProtoTCP,
+	"udp":    ipProtoUDP,
+	"icmpv6": ipProtoICMPv6,
+}
+
+// Access control list as it is written in configuration file.
+type ACLConf struct {
+	// Allowed peer's source MAC and IP addresses/networks
+	Src []string `yaml:"src"`
+	// Allowed destination networks behind the server
+	Dst []string `yaml:"dst"`
+	// Allowed protocols and destination ports: tcp, udp/53,
+	// tcp/8000-8080, icmp, 47
+	Proto []string `yaml:"proto"`
+}
+
+type aclProto struct {
+	proto   byte
+	anyPort bool
+	portMin uint16
+	portMax uint16
+}
+
+// Stateless per-peer access control list. Each configured kind of rule
+// must be satisfied by the frame. Frames from the peer are checked by
+// their source addresses and destination port, frames to the peer by
+// their destination addresses and source port, so replies are passed.
+type ACL struct {
+	srcMACs [][]byte
+	srcNets []*net.IPNet
+	dstNets []*net.IPNet
+	protos  []aclProto
+}
+
+func aclNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.New("Invalid ACL address: " + s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func aclProtoParse(s string) (aclProto, error) {
+	r := aclProto{anyPort: true}
+	cols := strings.SplitN(strings.ToLower(s), "/", 2)
+	if proto, exists := aclProtoNames[cols[0]]; exists {
+		r.proto = proto
+	} else {
+		proto, err := strconv.ParseUint(cols[0], 10, 8)
+		if err != nil {
+			return r, errors.New("Invalid ACL protocol: " + s)
+		}
+		r.proto = byte(proto)
+	}
+	if len(cols) == 1 {
+		return r, nil
+	}
+	if r.proto != ipProtoTCP && r.proto != ipProtoUDP {
+		return r, errors.New("Ports are applicable only to TCP and UDP: " + s)
+	}
+	ports := strings.SplitN(cols[1], "-", 2)
+	portMin, err := strconv.ParseUint(ports[0], 10, 16)
+	if err != nil {
+		return r, errors.New("Invalid ACL port: " + s)
+	}
+	portMax := portMin
+	if len(ports) == 2 {
+		if portMax, err = strconv.ParseUint(ports[1], 10, 16); err != nil || portMax < portMin {
+			return r, errors.New("Invalid ACL ports range: " + s)
+		}
+	}
+	r.anyPort = false
+	r.portMin, r.portMax = uint16(portMin), uint16(portMax)
+	return r, nil
+}
+
+// Parse access control list. Empty list gives nil: everything is
+// allowed.
+func ACLParse(conf ACLConf) (*ACL, error) {
+	if len(conf.Src) == 0 && len(conf.Dst) == 0 && len(conf.Proto) == 0 {
+		return nil, nil
+	}
+	acl := ACL{}
+	for _, s := range conf.Src {
+		if mac, err := net.ParseMAC(s); err == nil && len(mac) == 6 {
+			acl.srcMACs = append(acl.srcMACs, mac)
+			continue
+		}
+		ipNet, err := aclNet(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.srcNets = append(acl.srcNets, ipNet)
+	}
+	for _, s := range conf.Dst {
+		ipNet, err := aclNet(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.dstNets = append(acl.dstNets, ipNet)
+	}
+	for _, s := range conf.Proto {
+		proto, err := aclProtoParse(s)
+		if err != nil {
+			return nil, err
+		}
+		acl.protos = append(acl.protos, proto)
+	}
+	return &acl, nil
+}
+
+func aclNetsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Are there rules requiring frame to be IP packet.
+func (acl *ACL) ipOnly() bool {
+	return len(acl.srcNets) > 0 || len(acl.dstNets) > 0 || len(acl.protos) > 0
+}
+
+// Is frame from the peer allowed.
+func (acl *ACL) In(mode string, data []byte) bool {
+	return acl.check(mode, data, true)
+}
+
+// Is frame to the peer allowed.
+func (acl *ACL) Out(mode string, data []byte) bool {
+	return acl.check(mode, data, false)
+}
+
+func (acl *ACL) check(mode string, data []byte, in bool) bool {
+	if acl == nil {
+		return true
+	}
+	pkt := data
+	if mode != ModeTUN {
+		if len(data) < EtherSize {
+			return false
+		}
+		if len(acl.srcMACs) > 0 {
+			var mac []byte
+			if in {
+				mac = data[6:12]
+			} else {
+				mac = data[0:6]
+			}
+			// Broadcast and multicast frames are sent to everyone
+			if in || mac[0]&1 == 0 {
+				found := false
+				for _, allowed := range acl.srcMACs {
+					if bytes.Equal(mac, allowed) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+		}
+		pkt = data[EtherSize:]
+		switch binary.BigEndian.Uint16(data[12:14]) {
+		case etherTypeIPv4, etherTypeIPv6:
+		case etherTypeARP:
+			return acl.checkARP(pkt, in)
+		default:
+			return !acl.ipOnly()
+		}
+	}
+	return acl.checkIP(pkt, in)
+}
+
+// ARP is required for IP to work, so only sender's address of the peer
+// is checked.
+func (acl *ACL) checkARP(pkt []byte, in bool) bool {
+	if !in || len(acl.srcNets) == 0 {
+		return true
+	}
+	if len(pkt) < 28 {
+		return false
+	}
+	return aclNetsContain(acl.srcNets, net.IP(pkt[14:18]))
+}
+
+func (acl *ACL) checkIP(pkt []byte, in bool) bool {
+	if len(pkt) < IPHeaderMinSize {
+		return false
+	}
+	var src, dst net.IP
+	var proto byte
+	var l4 []byte
+	// Non-first fragment has no transport header: the first one is
+	// checked against the ports instead, so protocol match is enough
+	var fragment bool
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0F) * 4
+		if ihl < IPHeaderMinSize || len(pkt) < ihl {
+			return false
+		}
+		proto = pkt[9]
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		// Only the first fragment contains transport header
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1FFF == 0 {
+			l4 = pkt[ihl:]
+		} else {
+			fragment = true
+		}
+	case 6:
+		if len(pkt) < 40 {
+			return false
+		}
+		var ok bool
+		if proto, l4, ok = ip6UpperLayer(pkt[6], pkt[40:]); !ok {
+			return false
+		}
+		fragment = l4 == nil
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		if proto == ipProtoICMPv6 && icmp6Link(src, dst, l4) {
+			return true
+		}
+	default:
+		return false
+	}
+	peerAddr, remoteAddr := src, dst
+	if !in {
+		peerAddr, remoteAddr = dst, src
+	}
+	if len(acl.srcNets) > 0 {
+		group := !in && (peerAddr.IsMulticast() || peerAddr.Equal(net.IPv4bcast))
+		if !group && !aclNetsContain(acl.srcNets, peerAddr) {
+			return false
+		}
+	}
+	if len(acl.dstNets) > 0 && !aclNetsContain(acl.dstNets, remoteAddr) {
+		return false
+	}
+	if len(acl.protos) == 0 {
+		return true
+	}
+	var port uint16
+	hasPort := (proto == ipProtoTCP || proto == ipProtoUDP) && len(l4) >= 4
+	if hasPort {
+		if in {
+			port = binary.BigEndian.Uint16(l4[2:4])
+		} else {
+			port = binary.BigEndian.Uint16(l4[0:2])
+		}
+	}
+	for _, r := range acl.protos {
+		if r.proto != proto {
+			continue
+		}
+		if r.anyPort || fragment || (hasPort && port >= r.portMin && port <= r.portMax) {
+			return true
+		}
+	}
+	return false
+}
+
+// Skip IPv6 extension headers. Returns upper layer protocol and its
+// data, that is nil if packet is not the first fragment, and false if
+// headers are malformed.
+func ip6UpperLayer(proto byte, pkt []byte) (byte, []byte, bool) {
+	for {
+		var size int
+		switch proto {
+		case ipProtoHopOpts, ipProtoRouting, ipProtoDstOpts:
+			if len(pkt) < 8 {
+				return proto, nil, false
+			}
+			size = (int(pkt[1]) + 1) * 8
+		case ipProtoAH:
+			if len(pkt) < 8 {
+				return proto, nil, false
+			}
+			size = (int(pkt[1]) + 2) * 4
+		case ipProtoFragment:
+			if len(pkt) < 8 {
+				return proto, nil, false
+			}
+			// Only the first fragment contains upper layer header
+			if binary.BigEndian.Uint16(pkt[2:4])&0xFFF8 != 0 {
+				return pkt[0], nil, true
+			}
+			size = 8
+		default:
+			return proto, pkt, true
+		}
+		if len(pkt) < size {
+			return proto, nil, false
+		}
+		proto, pkt = pkt[0], pkt[size:]
+	}
+}
+
+// Is it ICMPv6 message, required for IPv6 to work on the link. It is
+// always allowed: it never leaves the link.
+func icmp6Link(src, dst net.IP, icmp []byte) bool {
+	if len(icmp) < 4 || !aclICMPv6Link[icmp[0]] {
+		return false
+	}
+	if !src.IsLinkLocalUnicast() && !src.IsUnspecified() {
+		return false
+	}
+	return dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast()
+}
@@ -0,0 +1,246 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"net"
+	"testing"
+)
+
+var (
+	aclPeerMAC  = []byte{0x02, 0, 0, 0, 0, 0x01}
+	aclOtherMAC = []byte{0x02, 0, 0, 0, 0, 0x02}
+)
+
+// Build IPv4 packet with TCP/UDP ports.
+func aclIPv4(src, dst string, proto byte, sport, dport uint16) []byte {
+	pkt := make([]byte, IPHeaderMinSize+8)
+	pkt[0] = 0x45
+	pkt[9] = proto
+	copy(pkt[12:16], net.ParseIP(src).To4())
+	copy(pkt[16:20], net.ParseIP(dst).To4())
+	pkt[20], pkt[21] = byte(sport>>8), byte(sport)
+	pkt[22], pkt[23] = byte(dport>>8), byte(dport)
+	return pkt
+}
+
+// Set flags and fragment offset of IPv4 packet.
+func aclIPv4Fragment(pkt []byte, flagsOffset uint16) []byte {
+	pkt[6], pkt[7] = byte(flagsOffset>>8), byte(flagsOffset)
+	return pkt
+}
+
+// Build IPv6 packet with extension headers (next header value and
+// data of each) and upper layer protocol's data.
+func aclIPv6(src, dst string, exts [][]byte, proto byte, l4 []byte) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[6] = proto
+	if len(exts) > 0 {
+		pkt[6] = exts[0][0]
+	}
+	copy(pkt[8:24], net.ParseIP(src))
+	copy(pkt[24:40], net.ParseIP(dst))
+	for i, ext := range exts {
+		hdr := append([]byte{proto}, ext[1:]...)
+		if i+1 < len(exts) {
+			hdr[0] = exts[i+1][0]
+		}
+		pkt = append(pkt, hdr...)
+	}
+	return append(pkt, l4...)
+}
+
+func aclEther(dst, src []byte, etherType uint16, pkt []byte) []byte {
+	frame := make([]byte, EtherSize, EtherSize+len(pkt))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	frame[12], frame[13] = byte(etherType>>8), byte(etherType)
+	return append(frame, pkt...)
+}
+
+func TestACLParse(t *testing.T) {
+	if acl, err := ACLParse(ACLConf{}); acl != nil || err != nil {
+		t.Fatal("empty ACL is not nil")
+	}
+	for _, conf := range []ACLConf{
+		{Src: []string{"foo"}},
+		{Dst: []string{"10.0.0.0/33"}},
+		{Proto: []string{"gre"}},
+		{Proto: []string{"icmp/22"}},
+		{Proto: []string{"tcp/80-22"}},
+		{Proto: []string{"udp/65536"}},
+	} {
+		if _, err := ACLParse(conf); err == nil {
+			t.Fatal("invalid ACL is accepted", conf)
+		}
+	}
+	var acl *ACL
+	if !acl.In(ModeTAP, nil) || !acl.Out(ModeTUN, nil) {
+		t.Fatal("nil ACL denies")
+	}
+}
+
+func TestACLTUN(t *testing.T) {
+	acl, err := ACLParse(ACLConf{
+		Src:   []string{"172.19.0.2"},
+		Dst:   []string{"10.0.0.0/24"},
+		Proto: []string{"tcp/22", "udp/50-60", "icmp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		pkt []byte
+		in  bool
+		out bool
+	}{
+		{aclIPv4("172.19.0.2", "10.0.0.5", ipProtoTCP, 40000, 22), true, false},
+		{aclIPv4("10.0.0.5", "172.19.0.2", ipProtoTCP, 22, 40000), false, true},
+		{aclIPv4("172.19.0.2", "10.0.0.5", ipProtoUDP, 40000, 53), true, false},
+		{aclIPv4("172.19.0.2", "10.0.0.5", ipProtoUDP, 40000, 61), false, false},
+		{aclIPv4("172.19.0.2", "10.0.0.5", ipProtoTCP, 40000, 80), false, false},
+		{aclIPv4("172.19.0.2", "10.0.0.5", ipProtoICMP, 0, 0), true, false},
+		{aclIPv4("172.19.0.3", "10.0.0.5", ipProtoTCP, 40000, 22), false, false},
+		{aclIPv4("172.19.0.2", "10.0.1.5", ipProtoTCP, 40000, 22), false, false},
+		{aclIPv4("10.0.0.5", "224.0.0.1", ipProtoICMP, 0, 0), false, true},
+		{aclIPv4Fragment(aclIPv4("172.19.0.2", "10.0.0.5", ipProtoUDP, 40000, 53), 0x2000), true, false},
+		{aclIPv4Fragment(aclIPv4("172.19.0.2", "10.0.0.5", ipProtoUDP, 0, 0), 0x0010), true, false},
+		{aclIPv4Fragment(aclIPv4("172.19.0.2", "10.0.0.5", ipProtoTCP, 0, 0), 0x2010), true, false},
+		{aclIPv4Fragment(aclIPv4("172.19.0.2", "10.0.0.5", 47, 0, 0), 0x0010), false, false},
+		{aclIPv4Fragment(aclIPv4("172.19.0.3", "10.0.0.5", ipProtoUDP, 0, 0), 0x0010), false, false},
+		{[]byte{0x45}, false, false},
+	} {
+		if acl.In(ModeTUN, c.pkt) != c.in || acl.Out(ModeTUN, c.pkt) != c.out {
+			t.Fatal("unexpected decision", c)
+		}
+	}
+}
+
+func TestACLIPv6(t *testing.T) {
+	acl, err := ACLParse(ACLConf{
+		Src:   []string{"fd00::2"},
+		Dst:   []string{"fd00:1::/64"},
+		Proto: []string{"tcp/22"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssh := []byte{0x9C, 0x40, 0, 22}
+	hopOpts := []byte{ipProtoHopOpts, 0, 0, 0, 0, 0, 0, 0}
+	dstOpts := []byte{ipProtoDstOpts, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	fragFirst := []byte{ipProtoFragment, 0, 0, 1, 0, 0, 0, 1}
+	fragNext := []byte{ipProtoFragment, 0, 0, 0x10, 0, 0, 0, 1}
+	ns := []byte{135, 0, 0, 0, 0, 0, 0, 0}
+	for _, c := range []struct {
+		pkt []byte
+		in  bool
+		out bool
+	}{
+		{aclIPv6("fd00::2", "fd00:1::5", nil, ipProtoTCP, ssh), true, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{hopOpts, dstOpts}, ipProtoTCP, ssh), true, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{fragFirst}, ipProtoTCP, ssh), true, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{fragNext}, ipProtoTCP, ssh), true, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{fragNext}, ipProtoUDP, ssh), false, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{dstOpts}, ipProtoTCP, []byte{0x9C, 0x40, 0, 80}), false, false},
+		{aclIPv6("fd00::2", "fd00:1::5", [][]byte{dstOpts}, ipProtoTCP, nil)[:52], false, false},
+		{aclIPv6("fd00::2", "fd00:2::5", nil, ipProtoTCP, ssh), false, false},
+		{aclIPv6("fe80::2", "ff02::1:ff00:1", nil, ipProtoICMPv6, ns), true, true},
+		{aclIPv6("::", "ff02::1:ff00:2", nil, ipProtoICMPv6, ns), true, true},
+		{aclIPv6("fe80::2", "fe80::1", nil, ipProtoICMPv6, []byte{136, 0, 0, 0}), true, true},
+		{aclIPv6("fe80::2", "ff02::16", [][]byte{hopOpts}, ipProtoICMPv6, []byte{143, 0, 0, 0}), true, true},
+		{aclIPv6("fd00::3", "ff02::1:ff00:1", nil, ipProtoICMPv6, ns), false, false},
+		{aclIPv6("fe80::2", "fd00:1::5", nil, ipProtoICMPv6, ns), false, false},
+		{aclIPv6("fe80::2", "ff02::1", nil, ipProtoICMPv6, []byte{128, 0, 0, 0}), false, false},
+	} {
+		if acl.In(ModeTUN, c.pkt) != c.in || acl.Out(ModeTUN, c.pkt) != c.out {
+			t.Fatal("unexpected decision", c)
+		}
+	}
+}
+
+func TestACLTAP(t *testing.T) {
+	acl, err := ACLParse(ACLConf{
+		Src: []string{"02:00:00:00:00:01", "172.19.0.2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcast := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+	pkt := aclIPv4("172.19.0.2", "10.0.0.5", ipProtoTCP, 40000, 22)
+	if !acl.In(ModeTAP, aclEther(bcast, aclPeerMAC, etherTypeIPv4, pkt)) {
+		t.Fatal("allowed frame is denied")
+	}
+	if acl.In(ModeTAP, aclEther(bcast, aclOtherMAC, etherTypeIPv4, pkt)) {
+		t.Fatal("frame from unknown MAC is allowed")
+	}
+	reply := aclIPv4("10.0.0.5", "172.19.0.2", ipProtoTCP, 22, 40000)
+	if !acl.Out(ModeTAP, aclEther(aclPeerMAC, aclOtherMAC, etherTypeIPv4, reply)) {
+		t.Fatal("reply is denied")
+	}
+	if acl.Out(ModeTAP, aclEther(aclOtherMAC, aclPeerMAC, etherTypeIPv4, reply)) {
+		t.Fatal("frame to unknown MAC is allowed")
+	}
+
+	arp := make([]byte, 28)
+	copy(arp[14:18], net.ParseIP("172.19.0.2").To4())
+	if !acl.In(ModeTAP, aclEther(bcast, aclPeerMAC, etherTypeARP, arp)) {
+		t.Fatal("ARP is denied")
+	}
+	copy(arp[14:18], net.ParseIP("172.19.0.3").To4())
+	if acl.In(ModeTAP, aclEther(bcast, aclPeerMAC, etherTypeARP, arp)) {
+		t.Fatal("ARP spoofing is allowed")
+	}
+	if !acl.Out(ModeTAP, aclEther(bcast, aclOtherMAC, etherTypeARP, arp)) {
+		t.Fatal("ARP to the peer is denied")
+	}
+	if acl.In(ModeTAP, aclEther(bcast, aclPeerMAC, 0x88CC, make([]byte, 64))) {
+		t.Fatal("non-IP frame is allowed")
+	}
+}
+
+func TestACLPeer(t *testing.T) {
+	acl, err := ACLParse(ACLConf{Src: []string{"02:00:00:00:00:01"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ct, written []byte
+	conf := *testConf
+	conf.ACL = acl
+	peerS := newPeer(false, "foo", Dummy{&ct}, &conf, new([SSize]byte))
+	peerC := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	bcast := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+	peerC.EthProcess(aclEther(bcast, aclOtherMAC, 0x88CC, make([]byte, 64)))
+	if !peerS.PktProcess(ct, Dummy{&written}, true) || written != nil {
+		t.Fatal("denied frame is written")
+	}
+	peerC.EthProcess(aclEther(bcast, aclPeerMAC, 0x88CC, make([]byte, 64)))
+	if !peerS.PktProcess(ct, Dummy{&written}, true) || written == nil {
+		t.Fatal("allowed frame is not written")
+	}
+	ct = nil
+	peerS.EthProcess(aclEther(aclOtherMAC, aclPeerMAC, 0x88CC, make([]byte, 64)))
+	if ct != nil {
+		t.Fatal("denied frame is sent")
+	}
+	if peerS.FramesACLIn != 1 || peerS.FramesACLOut != 1 {
+		t.Fatal("drops are not counted")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"errors"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Pool of IPv4 or IPv6 addresses leased to the peers. Network's first
+// host address is reserved for the server side (gateway), next ones are
+// given to the peers. Each peer keeps its address as long as it is
+// in the pool.
+type AddrPool struct {
+	Net     *net.IPNet
+	Gateway net.IP
+	leases  map[PeerId]net.IP
+	used    map[string]PeerId
+	l       sync.Mutex
+}
+
+func NewAddrPool(cidr string) (*AddrPool, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := ipNet.IP.To4(); ip4 != nil {
+		ipNet.IP = ip4
+	}
+	ones, bits := ipNet.Mask.Size()
+	if bits-ones < 2 {
+		return nil, errors.New("Address pool " + cidr + " is too small")
+	}
+	return &AddrPool{
+		Net:     ipNet,
+		Gateway: ipAdd(ipNet.IP, 1),
+		leases:  make(map[PeerId]net.IP),
+		used:    make(map[string]PeerId),
+	}, nil
+}
+
+func ipAdd(ip net.IP, n int64) net.IP {
+	i := new(big.Int).SetBytes(ip)
+	i.Add(i, big.NewInt(n))
+	b := i.Bytes()
+	res := make(net.IP, len(ip))
+	copy(res[len(res)-len(b):], b)
+	return res
+}
+
+// Address with pool's prefix length in CIDR notation.
+func (ap *AddrPool) CIDR(ip net.IP) string {
+	ones, _ := ap.Net.Mask.Size()
+	return ip.String() + "/" + strconv.Itoa(ones)
+}
+
+// Check that address belongs to the pool and can be given to the peer:
+// it is neither network, gateway nor IPv4 broadcast address.
+func (ap *AddrPool) usable(ip net.IP) bool {
+	if !ap.Net.Contains(ip) || ip.Equal(ap.Net.IP) || ip.Equal(ap.Gateway) {
+		return false
+	}
+	if len(ap.Net.IP) == net.IPv4len {
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = ap.Net.IP[i] | ^ap.Net.Mask[i]
+		}
+		return !ip.Equal(broadcast)
+	}
+	return true
+}
+
+// Lease an address for the peer. Already leased address is returned
+// if it exists.
+func (ap *AddrPool) Lease(id PeerId) (net.IP, error) {
+	ap.l.Lock()
+	defer ap.l.Unlock()
+	if ip, exists := ap.leases[id]; exists {
+		return ip, nil
+	}
+	for ip := ipAdd(ap.Gateway, 1); ap.usable(ip); ip = ipAdd(ip, 1) {
+		if _, taken := ap.used[ip.String()]; !taken {
+			ap.leases[id] = ip
+			ap.used[ip.String()] = id
+			return ip, nil
+		}
+	}
+	return nil, errors.New("Address pool " + ap.Net.String() + " is exhausted")
+}
+
+// Restore previously made lease, for example from the state file.
+func (ap *AddrPool) Restore(id PeerId, ip net.IP) error {
+	if ip4 := ip.To4(); ip4 != nil && len(ap.Net.IP) == net.IPv4len {
+		ip = ip4
+	}
+	if !ap.usable(ip) {
+		return errors.New("Address " + ip.String() + " does not belong to pool " + ap.Net.String())
+	}
+	ap.l.Lock()
+	defer ap.l.Unlock()
+	if owner, taken := ap.used[ip.String()]; taken && owner != id {
+		return errors.New("Address " + ip.String() + " is already leased")
+	}
+	if prev, exists := ap.leases[id]; exists {
+		delete(ap.used, prev.String())
+	}
+	ap.leases[id] = ip
+	ap.used[ip.String()] = id
+	return nil
+}
+
+// Copy of all current leases.
+func (ap *AddrPool) Leases() map[PeerId]net.IP {
+	ap.l.Lock()
+	leases := make(map[PeerId]net.IP, len(ap.leases))
+	for id, ip := range ap.leases {
+		leases[id] = ip
+	}
+	ap.l.Unlock()
+	return leases
+}
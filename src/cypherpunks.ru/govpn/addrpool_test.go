@@ -0,0 +1,143 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddrPoolLease(t *testing.T) {
+	pool, err := NewAddrPool("172.19.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pool.Gateway.Equal(net.ParseIP("172.19.0.1")) {
+		t.Fatal("Unexpected gateway", pool.Gateway)
+	}
+	id0 := PeerId{0}
+	id1 := PeerId{1}
+	ip0, err := pool.Lease(id0)
+	if err != nil || !ip0.Equal(net.ParseIP("172.19.0.2")) {
+		t.Fatal("Unexpected lease", ip0, err)
+	}
+	if ip, _ := pool.Lease(id0); !ip.Equal(ip0) {
+		t.Fatal("Lease is not stable")
+	}
+	if _, err = pool.Lease(id1); err == nil {
+		t.Fatal("Broadcast address is leased")
+	}
+	if pool.CIDR(ip0) != "172.19.0.2/30" {
+		t.Fatal("Unexpected CIDR", pool.CIDR(ip0))
+	}
+}
+
+func TestAddrPoolRestore(t *testing.T) {
+	pool, err := NewAddrPool("fc00::/120")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id0 := PeerId{0}
+	id1 := PeerId{1}
+	if err = pool.Restore(id0, net.ParseIP("fc00::10")); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Restore(id1, net.ParseIP("fc00::10")) == nil {
+		t.Fatal("Address leased twice")
+	}
+	if pool.Restore(id1, net.ParseIP("fc00::1")) == nil {
+		t.Fatal("Gateway address leased")
+	}
+	if pool.Restore(id1, net.ParseIP("fc01::10")) == nil {
+		t.Fatal("Foreign address leased")
+	}
+	if ip, _ := pool.Lease(id0); !ip.Equal(net.ParseIP("fc00::10")) {
+		t.Fatal("Restored lease is lost")
+	}
+	if ip, _ := pool.Lease(id1); !ip.Equal(net.ParseIP("fc00::2")) {
+		t.Fatal("Unexpected lease", ip)
+	}
+}
+
+func TestCtrlEnvSymmetric(t *testing.T) {
+	env := map[string]string{ENV_IP4_ADDRESS: "172.19.0.2/24", "FOO": "a=b"}
+	data, err := CtrlEnvEncode(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := CtrlEnvDecode(data)
+	if err != nil || len(decoded) != len(env) {
+		t.Fatal(decoded, err)
+	}
+	for k, v := range env {
+		if decoded[k] != v {
+			t.Fatal("Value mismatch", k)
+		}
+	}
+	if _, err = CtrlEnvEncode(map[string]string{"A=B": "C"}); err == nil {
+		t.Fatal("Invalid key accepted")
+	}
+}
+
+func TestEnvPushable(t *testing.T) {
+	for k, pushable := range map[string]bool{
+		ENV_IP4_ADDRESS:  true,
+		ENV_IP6_GATEWAY:  true,
+		ENV_MTU:          true,
+		ENV_TIMEOUT:      true,
+		"GOVPN_PUSH_DNS": true,
+		ENV_PUSH_PREFIX:  false,
+		ENV_EVENT:        false,
+		ENV_IFACE:        false,
+		"PATH":           false,
+		"LD_PRELOAD":     false,
+		"govpn_push_DNS": false,
+		"DNS":            false,
+	} {
+		if EnvPushable(k) != pushable {
+			t.Fatal("Unexpected pushability", k)
+		}
+	}
+}
+
+func TestParamsApply(t *testing.T) {
+	server := PeerConf{MTU: 1400, Noise: true, CPR: 64, TimeSync: 30, Timeout: 30 * time.Second}
+	client := PeerConf{MTU: MTUDefault, Timeout: 60 * time.Second}
+	changed, err := ParamsApply(&client, ParamsEnv(&server))
+	if err != nil || !changed {
+		t.Fatal("Parameters are not applied", err)
+	}
+	if client.MTU != 1400 || !client.Noise || client.CPR != 64 ||
+		client.Encless || client.TimeSync != 0 || client.Timeout != 30*time.Second {
+		t.Fatal("Parameters mismatch", client)
+	}
+	changed, err = ParamsApply(&client, ParamsEnv(&server))
+	if err != nil || changed {
+		t.Fatal("Same parameters are treated as changed")
+	}
+	if _, err = ParamsApply(&client, map[string]string{
+		ENV_CPR: "0", ENV_MTU: "1000000",
+	}); err == nil || client.CPR != 64 {
+		t.Fatal("Invalid MTU accepted")
+	}
+	if _, err = ParamsApply(&client, map[string]string{ENV_NOISE: "maybe"}); err == nil {
+		t.Fatal("Invalid boolean accepted")
+	}
+}
@@ -0,0 +1,304 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Argon2id memory-hard password hashing function, version 1.3
+// (RFC 9106).
+//
+// It is the hybrid of data-dependent Argon2d and data-independent
+// Argon2i: the first half of the first pass uses Argon2i addressing,
+// so it is resistant to side-channel attacks on shared hosts, and the
+// rest uses Argon2d one for the better tradeoff attacks resistance.
+package argon2id
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dchest/blake2b"
+)
+
+const (
+	version    = 0x13
+	argon2Type = 2
+
+	blockSize  = 1024 / 8
+	syncPoints = 4
+
+	MinMemory = 2 * syncPoints
+	MaxPar    = 1<<24 - 1
+	MinSalt   = 8
+)
+
+type block [blockSize]uint64
+
+// Derive the key from the password and salt with t passes over m KiBs
+// of memory using p lanes.
+func Key(password, salt []byte, t, p int, m int64, keyLen int) ([]byte, error) {
+	if len(salt) < MinSalt {
+		return nil, errors.New("argon2id: salt too short")
+	}
+	if t < 1 || int64(t) > 1<<32-1 {
+		return nil, errors.New("argon2id: invalid number of passes")
+	}
+	if p < 1 || p > MaxPar {
+		return nil, errors.New("argon2id: invalid parallelism")
+	}
+	if m < MinMemory*int64(p) || m > 1<<32-1 {
+		return nil, errors.New("argon2id: invalid memory size")
+	}
+	if keyLen < 4 {
+		return nil, errors.New("argon2id: key too short")
+	}
+	return argon2(password, salt, nil, nil, uint32(t), uint32(p), uint32(m), uint32(keyLen)), nil
+}
+
+func argon2(password, salt, secret, data []byte, t, p, m, keyLen uint32) []byte {
+	h0 := initHash(password, salt, secret, data, t, p, m, keyLen)
+	m = m / (syncPoints * p) * (syncPoints * p)
+	if m < 2*syncPoints*p {
+		m = 2 * syncPoints * p
+	}
+	b := initBlocks(h0, m, p)
+	processBlocks(b, t, p, m)
+	return finalize(b, m/p, p, keyLen)
+}
+
+func initHash(password, salt, secret, data []byte, t, p, m, keyLen uint32) []byte {
+	h := blake2b.New512()
+	var params [24]byte
+	binary.LittleEndian.PutUint32(params[0:4], p)
+	binary.LittleEndian.PutUint32(params[4:8], keyLen)
+	binary.LittleEndian.PutUint32(params[8:12], m)
+	binary.LittleEndian.PutUint32(params[12:16], t)
+	binary.LittleEndian.PutUint32(params[16:20], version)
+	binary.LittleEndian.PutUint32(params[20:24], argon2Type)
+	h.Write(params[:])
+	for _, input := range [][]byte{password, salt, secret, data} {
+		binary.LittleEndian.PutUint32(params[:4], uint32(len(input)))
+		h.Write(params[:4])
+		h.Write(input)
+	}
+	return h.Sum(nil)
+}
+
+// Variable-length hash function H'.
+func hashLong(out, in []byte) {
+	var outLen [4]byte
+	binary.LittleEndian.PutUint32(outLen[:], uint32(len(out)))
+	if len(out) <= blake2b.Size {
+		h, err := blake2b.New(&blake2b.Config{Size: uint8(len(out))})
+		if err != nil {
+			panic(err)
+		}
+		h.Write(outLen[:])
+		h.Write(in)
+		h.Sum(out[:0])
+		return
+	}
+	h := blake2b.New512()
+	h.Write(outLen[:])
+	h.Write(in)
+	v := h.Sum(nil)
+	for len(out) > blake2b.Size {
+		copy(out, v[:blake2b.Size/2])
+		out = out[blake2b.Size/2:]
+		if len(out) > blake2b.Size {
+			h.Reset()
+			h.Write(v)
+			v = h.Sum(v[:0])
+		}
+	}
+	last, err := blake2b.New(&blake2b.Config{Size: uint8(len(out))})
+	if err != nil {
+		panic(err)
+	}
+	last.Write(v)
+	last.Sum(out[:0])
+}
+
+func initBlocks(h0 []byte, m, p uint32) []block {
+	b := make([]block, m)
+	in := make([]byte, len(h0)+8)
+	copy(in, h0)
+	var buf [blockSize * 8]byte
+	for lane := uint32(0); lane < p; lane++ {
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(in[len(h0):], i)
+			binary.LittleEndian.PutUint32(in[len(h0)+4:], lane)
+			hashLong(buf[:], in)
+			j := lane*(m/p) + i
+			for k := range b[j] {
+				b[j][k] = binary.LittleEndian.Uint64(buf[k*8:])
+			}
+		}
+	}
+	return b
+}
+
+func processBlocks(b []block, t, p, m uint32) {
+	laneLen := m / p
+	segLen := laneLen / syncPoints
+	var addresses, in, zero block
+	for pass := uint32(0); pass < t; pass++ {
+		for slice := uint32(0); slice < syncPoints; slice++ {
+			for lane := uint32(0); lane < p; lane++ {
+				independent := pass == 0 && slice < syncPoints/2
+				if independent {
+					in = block{}
+					in[0], in[1], in[2] = uint64(pass), uint64(lane), uint64(slice)
+					in[3], in[4], in[5] = uint64(m), uint64(t), argon2Type
+				}
+				index := uint32(0)
+				if pass == 0 && slice == 0 {
+					index = 2
+					if independent {
+						nextAddresses(&addresses, &in, &zero)
+					}
+				}
+				offset := lane*laneLen + slice*segLen + index
+				for ; index < segLen; index, offset = index+1, offset+1 {
+					prev := offset - 1
+					if index == 0 && slice == 0 {
+						prev += laneLen
+					}
+					rand := b[prev][0]
+					if independent {
+						if index%blockSize == 0 {
+							nextAddresses(&addresses, &in, &zero)
+						}
+						rand = addresses[index%blockSize]
+					}
+					ref := refIndex(rand, laneLen, segLen, p, pass, slice, lane, index)
+					compress(&b[offset], &b[prev], &b[ref], pass > 0)
+				}
+			}
+		}
+	}
+}
+
+func nextAddresses(addresses, in, zero *block) {
+	in[6]++
+	compress(addresses, zero, in, false)
+	compress(addresses, zero, addresses, false)
+}
+
+// Index of the reference block.
+func refIndex(rand uint64, laneLen, segLen, p, pass, slice, lane, index uint32) uint32 {
+	refLane := uint32(rand>>32) % p
+	if pass == 0 && slice == 0 {
+		refLane = lane
+	}
+	area, start := 3*segLen, ((slice+1)%syncPoints)*segLen
+	if lane == refLane {
+		area += index
+	}
+	if pass == 0 {
+		area, start = slice*segLen, 0
+		if slice == 0 || lane == refLane {
+			area += index
+		}
+	}
+	if index == 0 || lane == refLane {
+		area--
+	}
+	x := rand & 0xFFFFFFFF
+	x = x * x >> 32
+	x = uint64(area) * x >> 32
+	return refLane*laneLen + uint32((uint64(start)+uint64(area)-1-x)%uint64(laneLen))
+}
+
+func finalize(b []block, laneLen, p, keyLen uint32) []byte {
+	c := b[laneLen-1]
+	for lane := uint32(1); lane < p; lane++ {
+		for i, v := range b[lane*laneLen+laneLen-1] {
+			c[i] ^= v
+		}
+	}
+	var buf [blockSize * 8]byte
+	for i, v := range c {
+		binary.LittleEndian.PutUint64(buf[i*8:], v)
+	}
+	out := make([]byte, keyLen)
+	hashLong(out, buf[:])
+	return out
+}
+
+// Compression function G: out = (xor ? out : 0) ^ R ^ P(R), R = x ^ y.
+func compress(out, x, y *block, xor bool) {
+	var r, q block
+	for i := range r {
+		r[i] = x[i] ^ y[i]
+	}
+	q = r
+	for i := 0; i < blockSize; i += 16 {
+		blamka(
+			&q[i], &q[i+1], &q[i+2], &q[i+3],
+			&q[i+4], &q[i+5], &q[i+6], &q[i+7],
+			&q[i+8], &q[i+9], &q[i+10], &q[i+11],
+			&q[i+12], &q[i+13], &q[i+14], &q[i+15],
+		)
+	}
+	for i := 0; i < blockSize/8; i += 2 {
+		blamka(
+			&q[i], &q[i+1], &q[16+i], &q[16+i+1],
+			&q[32+i], &q[32+i+1], &q[48+i], &q[48+i+1],
+			&q[64+i], &q[64+i+1], &q[80+i], &q[80+i+1],
+			&q[96+i], &q[96+i+1], &q[112+i], &q[112+i+1],
+		)
+	}
+	if xor {
+		for i := range q {
+			out[i] ^= r[i] ^ q[i]
+		}
+	} else {
+		for i := range q {
+			out[i] = r[i] ^ q[i]
+		}
+	}
+}
+
+// BLAKE2b round with multiplications over 16 words.
+func blamka(v0, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10, v11, v12, v13, v14, v15 *uint64) {
+	gb(v0, v4, v8, v12)
+	gb(v1, v5, v9, v13)
+	gb(v2, v6, v10, v14)
+	gb(v3, v7, v11, v15)
+	gb(v0, v5, v10, v15)
+	gb(v1, v6, v11, v12)
+	gb(v2, v7, v8, v13)
+	gb(v3, v4, v9, v14)
+}
+
+func fBlaMka(x, y uint64) uint64 {
+	return x + y + 2*uint64(uint32(x))*uint64(uint32(y))
+}
+
+func gb(a, b, c, d *uint64) {
+	*a = fBlaMka(*a, *b)
+	*d ^= *a
+	*d = *d>>32 | *d<<32
+	*c = fBlaMka(*c, *d)
+	*b ^= *c
+	*b = *b>>24 | *b<<40
+	*a = fBlaMka(*a, *b)
+	*d ^= *a
+	*d = *d>>16 | *d<<48
+	*c = fBlaMka(*c, *d)
+	*b ^= *c
+	*b = *b>>63 | *b<<1
+}
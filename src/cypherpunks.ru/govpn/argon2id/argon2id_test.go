@@ -0,0 +1,57 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package argon2id
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestVector(t *testing.T) {
+	// RFC 9106 section 5.3
+	got := argon2(
+		bytes.Repeat([]byte{0x01}, 32),
+		bytes.Repeat([]byte{0x02}, 16),
+		bytes.Repeat([]byte{0x03}, 8),
+		bytes.Repeat([]byte{0x04}, 12),
+		3, 4, 32, 32,
+	)
+	expected := "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"
+	if hex.EncodeToString(got) != expected {
+		t.Fatal("tag mismatch", hex.EncodeToString(got))
+	}
+}
+
+func TestKey(t *testing.T) {
+	k1, err := Key([]byte("password"), []byte("somesalt"), 2, 1, 64, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, _ := Key([]byte("password"), []byte("othersalt"), 2, 1, 64, 32)
+	if len(k1) != 32 || bytes.Equal(k1, k2) {
+		t.Fatal("salt is ignored")
+	}
+	if _, err = Key([]byte("password"), []byte("salt"), 2, 1, 64, 32); err == nil {
+		t.Fatal("short salt is accepted")
+	}
+	if _, err = Key([]byte("password"), []byte("somesalt"), 2, 4, 16, 32); err == nil {
+		t.Fatal("too little memory is accepted")
+	}
+}
@@ -0,0 +1,124 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// Configuration file keys that can be specified in client's profile,
+// with corresponding command line options. Peer related ones are the
+// same as in server's configuration.
+var confKeys = map[string]string{
+	"iface":         "iface",
+	"mode":          "mode",
+	"mtu":           "mtu",
+	"up":            "up",
+	"down":          "down",
+	"timeout":       "timeout",
+	"rekey":         "rekey",
+	"noise":         "noise",
+	"cpr":           "cpr",
+	"encless":       "encless",
+	"timesync":      "timesync",
+	"verifier":      "verifier",
+	"keyfile":       "keyfile",
+	"server-pub":    "server-pub",
+	"key":           "key",
+	"remote":        "remote",
+	"remote-random": "remote-random",
+	"proto":         "proto",
+	"proxy":         "proxy",
+	"proxy-auth":    "proxy-auth",
+	"transport":     "transport",
+	"tls-pin":       "tls-pin",
+	"tls-sni":       "tls-sni",
+	"stats":         "stats",
+	"egd":           "egd",
+	"retries":       "retries",
+	"backoff-min":   "backoff-min",
+	"backoff-max":   "backoff-max",
+	"log-level":     "log-level",
+	"log-format":    "log-format",
+	"log":           "log",
+}
+
+// Read configuration file and apply chosen profile's values to command
+// line options, that were not explicitly specified.
+func confApply(path, profile string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	profiles := make(map[string]map[string]interface{})
+	if err = yaml.Unmarshal(data, &profiles); err != nil {
+		return err
+	}
+	if profile == "" {
+		if len(profiles) != 1 {
+			names := make([]string, 0, len(profiles))
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return errors.New("Choose one of profiles: " + strings.Join(names, ", "))
+		}
+		for name := range profiles {
+			profile = name
+		}
+	}
+	values, exists := profiles[profile]
+	if !exists {
+		return errors.New("Unknown profile: " + profile)
+	}
+	specified := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { specified[f.Name] = true })
+	for key, value := range values {
+		flagName, known := confKeys[key]
+		if !known {
+			return errors.New("Unknown configuration key: " + key)
+		}
+		if specified[flagName] {
+			continue
+		}
+		var valueStr string
+		switch v := value.(type) {
+		case []interface{}:
+			// Remote servers can be specified as a list
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			valueStr = strings.Join(items, ",")
+		default:
+			valueStr = fmt.Sprint(v)
+		}
+		if err = flag.Set(flagName, valueStr); err != nil {
+			return errors.New("Invalid " + key + " value: " + err.Error())
+		}
+	}
+	return nil
+}
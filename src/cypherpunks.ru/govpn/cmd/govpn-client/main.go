@@ -22,41 +22,72 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"time"
 
 	"cypherpunks.ru/govpn"
+	"github.com/agl/ed25519"
 )
 
 var (
-	remoteAddr  = flag.String("remote", "", "Remote server address")
-	proto       = flag.String("proto", "udp", "Protocol to use: udp or tcp")
-	ifaceName   = flag.String("iface", "tap0", "TAP network interface")
-	verifierRaw = flag.String("verifier", "", "Verifier")
-	keyPath     = flag.String("key", "", "Path to passphrase file")
-	upPath      = flag.String("up", "", "Path to up-script")
-	downPath    = flag.String("down", "", "Path to down-script")
-	stats       = flag.String("stats", "", "Enable stats retrieving on host:port")
-	proxyAddr   = flag.String("proxy", "", "Use HTTP proxy on host:port")
-	proxyAuth   = flag.String("proxy-auth", "", "user:password Basic proxy auth")
-	mtu         = flag.Int("mtu", govpn.MTUDefault, "MTU of TAP interface")
-	timeoutP    = flag.Int("timeout", 60, "Timeout seconds")
-	timeSync    = flag.Int("timesync", 0, "Time synchronization requirement")
-	noisy       = flag.Bool("noise", false, "Enable noise appending")
-	encless     = flag.Bool("encless", false, "Encryptionless mode")
-	cpr         = flag.Int("cpr", 0, "Enable constant KiB/sec out traffic rate")
-	egdPath     = flag.String("egd", "", "Optional path to EGD socket")
-	warranty    = flag.Bool("warranty", false, "Print warranty information")
-
-	conf        *govpn.PeerConf
-	tap         *govpn.TAP
-	timeout     int
-	firstUpCall bool = true
-	knownPeers  govpn.KnownPeers
-	idsCache    *govpn.CipherCache
+	remoteAddr   = flag.String("remote", "", "Comma-separated remote servers [proto://]host:port[/path][?proxy=host:port]")
+	remoteRandom = flag.Bool("remote-random", false, "Try remote servers in random order")
+	proto        = flag.String("proto", "udp", "Protocol to use by default: udp, tcp, ws or tls")
+	ifaceName    = flag.String("iface", "tap0", "TAP network interface")
+	mode         = flag.String("mode", govpn.ModeTAP, "Interface mode: tap or tun")
+	verifierRaw  = flag.String("verifier", "", "Verifier")
+	keyPath      = flag.String("key", "", "Path to passphrase file")
+	keyFile      = flag.String("keyfile", "", "Path to Ed25519 private key file")
+	serverPub    = flag.String("server-pub", "", "Optional pinned server's identity public key")
+	upPath       = flag.String("up", "", "Path to up-script")
+	downPath     = flag.String("down", "", "Path to down-script")
+	transport    = flag.String("transport", govpn.TransportPlain, "Transport to use by default: "+strings.Join(govpn.TransportNames(), ", "))
+	transportKey = flag.String("transport-key", "", "Path to shared secret file of xor transport")
+	tlsPin       = flag.String("tls-pin", "", "Optional comma-separated SPKI hashes of server's TLS certificate")
+	tlsSNI       = flag.String("tls-sni", "", "Optional TLS server name, remote's host by default")
+	stats        = flag.String("stats", "", "Enable stats retrieving on host:port")
+	proxyAddr    = flag.String("proxy", "", "Use HTTP proxy on host:port")
+	proxyAuth    = flag.String("proxy-auth", "", "user:password Basic proxy auth")
+	mtu          = flag.Int("mtu", govpn.MTUDefault, "MTU of TAP interface (TUN's default is smaller)")
+	timeoutP     = flag.Int("timeout", 60, "Timeout seconds")
+	timeSync     = flag.Int("timesync", 0, "Time synchronization requirement")
+	noisy        = flag.Bool("noise", false, "Enable noise appending")
+	encless      = flag.Bool("encless", false, "Encryptionless mode")
+	cpr          = flag.Int("cpr", 0, "Enable constant KiB/sec out traffic rate")
+	rekey        = flag.Int("rekey", 0, "Session rekeying interval seconds, 0 for default, -1 to disable")
+	egdPath      = flag.String("egd", "", "Optional path to EGD socket")
+	retries      = flag.Int("retries", 0, "Reconnection attempts after connection loss, -1 for unlimited")
+	backoffMin   = flag.Duration("backoff-min", time.Second, "Initial delay between reconnection attempts")
+	backoffMax   = flag.Duration("backoff-max", time.Minute, "Maximal delay between reconnection attempts")
+	confPath     = flag.String("conf", "", "Optional path to configuration YAML")
+	profile      = flag.String("profile", "", "Configuration profile to use")
+	logLevel     = flag.String("log-level", "info", "Logging level: debug, info, warn or error")
+	logFormat    = flag.String("log-format", govpn.LogFormatText, "Logging format: text or json")
+	logTarget    = flag.String("log", "", "Optional logging target: syslog[:path] or journald[:path]")
+	warranty     = flag.Bool("warranty", false, "Print warranty information")
+
+	conf       *govpn.PeerConf
+	tap        *govpn.TAP
+	timeout    int
+	upEvent    string = govpn.EventUp
+	pushedEnv  map[string]string
+	knownPeers govpn.KnownPeers
+	idsCache   *govpn.CipherCache
+	// Failed connection attempts in a row
+	attempts int
+	// Was the connection with the current remote established
+	established bool
+	// Server pushed parameters different from ours, applied before
+	// the rehandshake
+	paramsPushed *govpn.PeerConf
+	// Guards pushedEnv and paramsPushed, set by the control messages
+	// handler
+	pushedLock sync.Mutex
 )
 
 func main() {
@@ -65,63 +96,116 @@ func main() {
 		fmt.Println(govpn.Warranty)
 		return
 	}
+	rand.Seed(time.Now().UnixNano())
+	if *confPath != "" {
+		if err := confApply(*confPath, *profile); err != nil {
+			govpn.LogEvent("conf_invalid").Err(err).Fatal("Unable to apply configuration")
+		}
+	}
+	if err := govpn.LogSetup(*logLevel, *logFormat, *logTarget); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	timeout = *timeoutP
 	var err error
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
 
+	if !govpn.ModeValid(*mode) {
+		govpn.LogEvent("conf_invalid").Field("mode", *mode).Fatal("Unknown interface mode specified")
+	}
+	mtuSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "mtu" {
+			mtuSet = true
+		}
+	})
+	if !mtuSet {
+		*mtu = govpn.MTUDefaultFor(*mode)
+	}
 	if *mtu > govpn.MTUMax {
-		log.Fatalln("Maximum allowable MTU is", govpn.MTUMax)
+		govpn.LogEvent("conf_invalid").Field("mtu", govpn.MTUMax).Fatal("Maximum allowable MTU exceeded")
 	}
 	if *egdPath != "" {
-		log.Println("Using", *egdPath, "EGD")
+		govpn.LogEvent("egd").Addr(*egdPath).Info("Using EGD")
 		govpn.EGDInit(*egdPath)
 	}
 
 	if *verifierRaw == "" {
-		log.Fatalln("No verifier specified")
+		govpn.LogEvent("conf_invalid").Fatal("No verifier specified")
 	}
 	verifier, err := govpn.VerifierFromString(*verifierRaw)
 	if err != nil {
-		log.Fatalln(err)
+		govpn.LogEvent("conf_invalid").Err(err).Fatal("Invalid verifier")
+	}
+	var priv *[ed25519.PrivateKeySize]byte
+	if verifier.Alg == govpn.VerifierEd25519 {
+		if *keyFile == "" {
+			govpn.LogEvent("conf_invalid").Fatal("No key file specified")
+		}
+		priv, err = govpn.KeyFileRead(*keyFile, *keyPath)
+		if err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key file")
+		}
+		verifier.KeyApply(priv)
+	} else {
+		key, err := govpn.KeyRead(*keyPath)
+		if err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key")
+		}
+		priv = verifier.PasswordApply(key)
+	}
+	var serverPubKey *[ed25519.PublicKeySize]byte
+	if *serverPub != "" {
+		serverPubKey, err = govpn.KeyPubFromString(*serverPub)
+		if err != nil {
+			govpn.LogEvent("conf_invalid").Err(err).Fatal("Invalid server's public key")
+		}
+	}
+	if *transportKey != "" {
+		secret, err := govpn.KeyRead(*transportKey)
+		if err != nil {
+			govpn.LogEvent("transport_key_failed").Err(err).Fatal("Unable to read transport key")
+		}
+		govpn.TransportXORKey(secret)
 	}
-	key, err := govpn.KeyRead(*keyPath)
+	remotes, err = remotesParse(*remoteAddr, *proto, *proxyAddr, *transport)
 	if err != nil {
-		log.Fatalln("Unable to read the key", err)
+		govpn.LogEvent("conf_invalid").Err(err).Fatal("Invalid remotes")
 	}
-	priv := verifier.PasswordApply(key)
 	if *encless {
-		if *proto != "tcp" {
-			log.Fatalln("Currently encryptionless mode works only with TCP")
-		}
 		*noisy = true
 	}
 	conf = &govpn.PeerConf{
 		Id:       verifier.Id,
 		Iface:    *ifaceName,
+		Mode:     *mode,
 		MTU:      *mtu,
 		Timeout:  time.Second * time.Duration(timeout),
+		Rekey:    time.Second * time.Duration(*rekey),
 		TimeSync: *timeSync,
 		Noise:    *noisy,
 		CPR:      *cpr,
 		Encless:  *encless,
 		Verifier: verifier,
 		DSAPriv:  priv,
+
+		ServerPub: serverPubKey,
 	}
 	idsCache = govpn.NewCipherCache()
 	confs := map[govpn.PeerId]*govpn.PeerConf{*verifier.Id: conf}
 	idsCache.Update(&confs)
-	log.Println(govpn.VersionGet())
+	govpn.LogEvent("started").PeerId(verifier.Id).Field("version", govpn.VersionGet()).Info("GoVPN client")
 
-	tap, err = govpn.TAPListen(*ifaceName, *mtu)
+	// Server can push bigger MTU later
+	tap, err = govpn.TAPListen(*ifaceName, *mode, govpn.MTUMax)
 	if err != nil {
-		log.Fatalln("Can not listen on TAP interface:", err)
+		govpn.LogEvent("tap_failed").Err(err).Fatal("Can not listen on TAP interface")
 	}
 
 	if *stats != "" {
-		log.Println("Stats are going to listen on", *stats)
+		govpn.LogEvent("stats_listening").Addr(*stats).Info("Stats are going to listen")
 		statsPort, err := net.Listen("tcp", *stats)
 		if err != nil {
-			log.Fatalln("Can not listen on stats port:", err)
+			govpn.LogEvent("stats_failed").Err(err).Fatal("Can not listen on stats port")
 		}
 		go govpn.StatsProcessor(statsPort, &knownPeers)
 	}
@@ -129,38 +213,168 @@ func main() {
 	termSignal := make(chan os.Signal, 1)
 	signal.Notify(termSignal, os.Interrupt, os.Kill)
 
+	remotesRound()
 MainCycle:
 	for {
+		established = false
 		timeouted := make(chan struct{})
 		rehandshaking := make(chan struct{})
 		termination := make(chan struct{})
-		if *proxyAddr != "" {
-			*proto = "tcp"
-		}
-		switch *proto {
+		switch current.Proto {
 		case "udp":
 			go startUDP(timeouted, rehandshaking, termination)
 		case "tcp":
-			if *proxyAddr != "" {
+			if current.Proxy != "" {
 				go proxyTCP(timeouted, rehandshaking, termination)
 			} else {
 				go startTCP(timeouted, rehandshaking, termination)
 			}
-		default:
-			log.Fatalln("Unknown protocol specified")
+		case "ws":
+			go startWS(timeouted, rehandshaking, termination)
+		case "tls":
+			go startTLS(timeouted, rehandshaking, termination)
 		}
 		select {
 		case <-termSignal:
-			log.Fatalln("Finishing")
+			govpn.LogEvent("terminating").Fatal("Finishing")
 			termination <- struct{}{}
 			break MainCycle
 		case <-timeouted:
-			break MainCycle
+			lost := current.Addr
+			failover := !established && remoteNext()
+			if !failover && *retries >= 0 && attempts >= *retries {
+				break MainCycle
+			}
+			if upEvent == "" {
+				go govpn.ScriptCallEnv(*downPath, *ifaceName, lost, scriptEnv(govpn.EventReconnecting))
+				upEvent = govpn.EventReconnected
+			}
+			if failover {
+				logRemote("remote_failover").Field("remote", current).Info("Failing over")
+				break
+			}
+			remotesRound()
+			delay := backoffDelay(attempts)
+			attempts++
+			logRemote("reconnecting").Field("delay", delay).Field("attempt", attempts).Info("Reconnecting")
+			select {
+			case <-termSignal:
+				govpn.LogEvent("terminating").Info("Finishing")
+				break MainCycle
+			case <-time.After(delay):
+			}
 		case <-rehandshaking:
+			paramsApply()
 		}
 		close(timeouted)
 		close(rehandshaking)
 		close(termination)
 	}
-	govpn.ScriptCall(*downPath, *ifaceName, *remoteAddr)
+	govpn.ScriptCallEnv(*downPath, *ifaceName, current.Addr, scriptEnv(govpn.EventDown))
+}
+
+// Whether server pushed parameters different from ours.
+func paramsPending() bool {
+	pushedLock.Lock()
+	defer pushedLock.Unlock()
+	return paramsPushed != nil
+}
+
+// Replace our parameters with the pushed ones, if any. It is done
+// between the connections, so nobody else uses them meanwhile.
+func paramsApply() {
+	pushedLock.Lock()
+	defer pushedLock.Unlock()
+	if paramsPushed == nil {
+		return
+	}
+	*conf = *paramsPushed
+	paramsPushed = nil
+	*mtu = conf.MTU
+	timeout = int(conf.Timeout / time.Second)
+	idsCache.Update(&map[govpn.PeerId]*govpn.PeerConf{*conf.Id: conf})
+}
+
+// Start the record of the event related to the current remote server.
+func logRemote(event string) *govpn.LogEntry {
+	return govpn.LogEvent(event).PeerId(conf.Id).Addr(current.Addr).Field("proto", current.Proto)
+}
+
+// Exponentially growing delay before the next reconnection attempt.
+// Half of it is randomized, to prevent simultaneous reconnections of
+// many clients.
+func backoffDelay(attempt int) time.Duration {
+	delay := *backoffMax
+	if attempt < 32 && *backoffMin<<uint(attempt) < *backoffMax {
+		delay = *backoffMin << uint(attempt)
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Environment for up/down-scripts: pushed by server one with the event.
+func scriptEnv(event string) map[string]string {
+	env := make(map[string]string)
+	pushedLock.Lock()
+	for k, v := range pushedEnv {
+		env[k] = v
+	}
+	pushedLock.Unlock()
+	env[govpn.ENV_EVENT] = event
+	return env
+}
+
+// Handle control messages from the server and run up-script after the
+// first handshake or reconnection. Script is called as soon as server pushes the
+// environment to us, or after heartbeat period if it does not.
+func peerUp(peer *govpn.Peer) {
+	envReady := make(chan map[string]string, 1)
+	peer.CtrlHandler = func(typ byte, data []byte) {
+		if typ != govpn.CtrlEnv {
+			govpn.LogEvent("ctrl_unknown").Peer(peer).Field("type", typ).Warn("Unknown control message type")
+			return
+		}
+		env, err := govpn.CtrlEnvDecode(data)
+		if err != nil {
+			govpn.LogEvent("env_invalid").Peer(peer).Err(err).Warn("Invalid environment pushed")
+			return
+		}
+		for k := range env {
+			if !govpn.EnvPushable(k) {
+				govpn.LogEvent("env_forbidden").Peer(peer).Field("name", k).Warn("Forbidden environment variable pushed")
+				delete(env, k)
+			}
+		}
+		pushedLock.Lock()
+		pushedEnv = env
+		pushed := *conf
+		changed, err := govpn.ParamsApply(&pushed, env)
+		if err != nil {
+			govpn.LogEvent("params_invalid").Peer(peer).Err(err).Warn("Invalid parameters pushed")
+		} else if changed {
+			paramsPushed = &pushed
+		}
+		pushedLock.Unlock()
+		select {
+		case envReady <- env:
+		default:
+		}
+	}
+	attempts = 0
+	established = true
+	if upEvent == "" {
+		return
+	}
+	event := upEvent
+	upEvent = ""
+	wait := time.Duration(timeout) * time.Second / govpn.TimeoutHeartbeat
+	go func() {
+		select {
+		case env := <-envReady:
+			govpn.LogEvent("env_pushed").Peer(peer).Field("env", env).Info("Environment pushed")
+		case <-time.After(wait):
+			govpn.LogEvent("env_missing").Peer(peer).Info("No environment pushed by server")
+		}
+		govpn.ScriptCallEnv(*upPath, *ifaceName, current.Addr, scriptEnv(event))
+	}()
 }
@@ -21,22 +21,34 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
-	"log"
 	"net"
 	"net/http"
 )
 
 func proxyTCP(timeouted, rehandshaking, termination chan struct{}) {
-	proxyAddr, err := net.ResolveTCPAddr("tcp", *proxyAddr)
+	conn := proxyConnect()
+	if conn == nil {
+		timeouted <- struct{}{}
+		return
+	}
+	go handleTCP(conn, timeouted, rehandshaking, termination)
+}
+
+// Connect to the current remote through HTTP proxy using CONNECT
+// method. Returns nil if failed.
+func proxyConnect() net.Conn {
+	proxyAddr, err := net.ResolveTCPAddr("tcp", current.Proxy)
 	if err != nil {
-		log.Fatalln("Can not resolve proxy address:", err)
+		logRemote("proxy_failed").Field("proxy", current.Proxy).Err(err).Error("Can not resolve proxy address")
+		return nil
 	}
 	conn, err := net.DialTCP("tcp", nil, proxyAddr)
 	if err != nil {
-		log.Fatalln("Can not connect to proxy:", err)
+		logRemote("proxy_failed").Field("proxy", current.Proxy).Err(err).Error("Can not connect to proxy")
+		return nil
 	}
-	req := "CONNECT " + *remoteAddr + " HTTP/1.1\n"
-	req += "Host: " + *remoteAddr + "\n"
+	req := "CONNECT " + current.Addr + " HTTP/1.1\n"
+	req += "Host: " + current.Addr + "\n"
 	if *proxyAuth != "" {
 		req += "Proxy-Authorization: Basic "
 		req += base64.StdEncoding.EncodeToString([]byte(*proxyAuth)) + "\n"
@@ -48,8 +60,10 @@ func proxyTCP(timeouted, rehandshaking, termination chan struct{}) {
 		&http.Request{Method: "CONNECT"},
 	)
 	if err != nil || resp.StatusCode != http.StatusOK {
-		log.Fatalln("Unexpected response from proxy")
+		logRemote("proxy_failed").Field("proxy", current.Proxy).Err(err).Error("Unexpected response from proxy")
+		conn.Close()
+		return nil
 	}
-	log.Println("Connected to proxy:", *proxyAddr)
-	go handleTCP(conn, timeouted, rehandshaking, termination)
+	logRemote("proxy_connected").Field("proxy", current.Proxy).Info("Connected to proxy")
+	return conn
 }
@@ -0,0 +1,133 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"net/url"
+	"strings"
+
+	"cypherpunks.ru/govpn"
+)
+
+// Remote server's endpoint.
+type Remote struct {
+	Addr      string
+	Path      string
+	Proto     string
+	Proxy     string
+	Transport string
+}
+
+func (r *Remote) String() string {
+	s := r.Proto + "://" + r.Addr + r.Path
+	if r.Transport != govpn.TransportPlain {
+		s += " over " + r.Transport
+	}
+	if r.Proxy != "" {
+		s += " via " + r.Proxy
+	}
+	return s
+}
+
+var (
+	remotes []*Remote
+	// Currently used remote
+	current *Remote
+	// Remotes left to try in the current round
+	remotesLeft []*Remote
+)
+
+// Parse comma-separated list of remotes in
+// [proto://]host:port[/path][?proxy=host:port&transport=name] format.
+// Path is used only by WebSocket remotes.
+// Protocol, proxy and transport default to the specified ones.
+func remotesParse(raw, protoDefault, proxyDefault, transportDefault string) ([]*Remote, error) {
+	var result []*Remote
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "://") {
+			entry = protoDefault + "://" + entry
+		}
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, err
+		}
+		r := Remote{
+			Addr:      u.Host,
+			Path:      u.Path,
+			Proto:     u.Scheme,
+			Proxy:     proxyDefault,
+			Transport: transportDefault,
+		}
+		if proxy := u.Query().Get("proxy"); proxy != "" {
+			r.Proxy = proxy
+		}
+		if transport := u.Query().Get("transport"); transport != "" {
+			r.Transport = transport
+		}
+		if _, err = govpn.TransportGet(r.Transport); err != nil {
+			return nil, err
+		}
+		if _, _, err := net.SplitHostPort(r.Addr); err != nil {
+			return nil, errors.New("Invalid remote address " + entry + ": " + err.Error())
+		}
+		if r.Proxy != "" && r.Proto == "udp" {
+			r.Proto = "tcp"
+		}
+		if r.Proto != "udp" && r.Proto != "tcp" && r.Proto != "ws" && r.Proto != "tls" {
+			return nil, errors.New("Unknown protocol of remote " + entry)
+		}
+		result = append(result, &r)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("No remote specified")
+	}
+	return result, nil
+}
+
+// Start the new round of remotes trying: either in specified or random
+// order.
+func remotesRound() {
+	remotesLeft = make([]*Remote, len(remotes))
+	if *remoteRandom {
+		for i, j := range rand.Perm(len(remotes)) {
+			remotesLeft[i] = remotes[j]
+		}
+	} else {
+		copy(remotesLeft, remotes)
+	}
+	remoteNext()
+}
+
+// Switch to the next remote in the current round. Returns false if
+// round is over.
+func remoteNext() bool {
+	if len(remotesLeft) == 0 {
+		return false
+	}
+	current = remotesLeft[0]
+	remotesLeft = remotesLeft[1:]
+	return true
+}
@@ -20,29 +20,52 @@ package main
 
 import (
 	"bytes"
-	"log"
 	"net"
-	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
 func startTCP(timeouted, rehandshaking, termination chan struct{}) {
-	remote, err := net.ResolveTCPAddr("tcp", *remoteAddr)
+	remote, err := net.ResolveTCPAddr("tcp", current.Addr)
 	if err != nil {
-		log.Fatalln("Can not resolve remote address:", err)
+		logRemote("connect_failed").Err(err).Error("Can not resolve remote address")
+		timeouted <- struct{}{}
+		return
 	}
 	conn, err := net.DialTCP("tcp", nil, remote)
 	if err != nil {
-		log.Fatalln("Can not connect to address:", err)
+		logRemote("connect_failed").Err(err).Error("Can not connect to address")
+		timeouted <- struct{}{}
+		return
 	}
-	log.Println("Connected to TCP:" + *remoteAddr)
+	logRemote("connected").Info("Connected to TCP")
 	handleTCP(conn, timeouted, rehandshaking, termination)
 }
 
-func handleTCP(conn *net.TCPConn, timeouted, rehandshaking, termination chan struct{}) {
-	hs := govpn.HandshakeStart(*remoteAddr, conn, conf)
+// Connect to the current remote either directly, or through HTTP
+// proxy if it is specified. Returns nil if failed.
+func tcpConnect() net.Conn {
+	if current.Proxy != "" {
+		return proxyConnect()
+	}
+	remote, err := net.ResolveTCPAddr("tcp", current.Addr)
+	if err != nil {
+		logRemote("connect_failed").Err(err).Error("Can not resolve remote address")
+		return nil
+	}
+	conn, err := net.DialTCP("tcp", nil, remote)
+	if err != nil {
+		logRemote("connect_failed").Err(err).Error("Can not connect to address")
+		return nil
+	}
+	return conn
+}
+
+func handleTCP(conn net.Conn, timeouted, rehandshaking, termination chan struct{}) {
+	t, _ := govpn.TransportGet(current.Transport)
+	conn = govpn.TransportWrap(t, conn, false)
+	hs := govpn.HandshakeStart(current.Addr, conn, conf)
 	buf := make([]byte, 2*(govpn.EnclessEnlargeSize+*mtu)+*mtu)
 	var n int
 	var err error
@@ -57,7 +80,7 @@ HandshakeCycle:
 		default:
 		}
 		if prev == len(buf) {
-			log.Println("Timeouted waiting for the packet")
+			logRemote("timeout").Warn("Timeouted waiting for the packet")
 			timeouted <- struct{}{}
 			break HandshakeCycle
 		}
@@ -65,7 +88,7 @@ HandshakeCycle:
 		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 		n, err = conn.Read(buf[prev:])
 		if err != nil {
-			log.Println("Connection timeouted")
+			logRemote("timeout").Err(err).Warn("Connection timeouted")
 			timeouted <- struct{}{}
 			break HandshakeCycle
 		}
@@ -75,17 +98,18 @@ HandshakeCycle:
 		if peerId == nil {
 			continue
 		}
-		peer = hs.Client(buf[:prev])
+		peer, err = hs.Client(buf[:prev])
 		prev = 0
+		if err != nil {
+			timeouted <- struct{}{}
+			break HandshakeCycle
+		}
 		if peer == nil {
 			continue
 		}
-		log.Println("Handshake completed")
-		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{*remoteAddr: &peer})
-		if firstUpCall {
-			go govpn.ScriptCall(*upPath, *ifaceName, *remoteAddr)
-			firstUpCall = false
-		}
+		govpn.LogEvent("handshake_finished").Peer(peer).Info("Handshake completed")
+		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{current.Addr: &peer})
+		peerUp(peer)
 		hs.Zero()
 		terminator = make(chan struct{})
 		go func() {
@@ -111,6 +135,7 @@ HandshakeCycle:
 		hs.Zero()
 	}
 	if peer == nil {
+		conn.Close()
 		return
 	}
 
@@ -126,14 +151,14 @@ TransportCycle:
 		default:
 		}
 		if prev == len(buf) {
-			log.Println("Timeouted waiting for the packet")
+			logRemote("timeout").Warn("Timeouted waiting for the packet")
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
 		conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
 		n, err = conn.Read(buf[prev:])
 		if err != nil {
-			log.Println("Connection timeouted")
+			logRemote("timeout").Err(err).Warn("Connection timeouted")
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
@@ -147,12 +172,17 @@ TransportCycle:
 			continue
 		}
 		if !peer.PktProcess(buf[:i+govpn.NonceSize], tap, false) {
-			log.Println("Unauthenticated packet, dropping connection")
+			govpn.LogEvent("peer_unauthenticated").Peer(peer).Warn("Unauthenticated packet, dropping connection")
 			timeouted <- struct{}{}
 			break TransportCycle
 		}
-		if atomic.LoadUint64(&peer.BytesIn)+atomic.LoadUint64(&peer.BytesOut) > govpn.MaxBytesPerKey {
-			log.Println("Need rehandshake")
+		if paramsPending() {
+			govpn.LogEvent("rehandshaking").Peer(peer).Info("Rehandshaking with parameters pushed by server")
+			rehandshaking <- struct{}{}
+			break TransportCycle
+		}
+		if peer.KeyBytes() > govpn.MaxBytesPerKey {
+			govpn.LogEvent("rehandshaking").Peer(peer).Info("Need rehandshake")
 			rehandshaking <- struct{}{}
 			break TransportCycle
 		}
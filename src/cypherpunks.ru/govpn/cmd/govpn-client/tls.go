@@ -0,0 +1,50 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+func startTLS(timeouted, rehandshaking, termination chan struct{}) {
+	conn := tcpConnect()
+	if conn == nil {
+		timeouted <- struct{}{}
+		return
+	}
+	host, _, _ := net.SplitHostPort(current.Addr)
+	if *tlsSNI != "" {
+		host = *tlsSNI
+	}
+	tlsConn := tls.Client(conn, govpn.TLSClientConfig(host, *tlsPin))
+	tlsConn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		logRemote("connect_failed").Err(err).Error("TLS handshake failed")
+		conn.Close()
+		timeouted <- struct{}{}
+		return
+	}
+	tlsConn.SetDeadline(time.Time{})
+	logRemote("connected").Info("Connected to TLS")
+	handleTCP(tlsConn, timeouted, rehandshaking, termination)
+}
@@ -19,27 +19,32 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"log"
 	"net"
-	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
 )
 
 func startUDP(timeouted, rehandshaking, termination chan struct{}) {
-	remote, err := net.ResolveUDPAddr("udp", *remoteAddr)
+	remote, err := net.ResolveUDPAddr("udp", current.Addr)
 	if err != nil {
-		log.Fatalln("Can not resolve remote address:", err)
+		logRemote("connect_failed").Err(err).Error("Can not resolve remote address")
+		timeouted <- struct{}{}
+		return
 	}
-	conn, err := net.DialUDP("udp", nil, remote)
+	connUDP, err := net.DialUDP("udp", nil, remote)
 	if err != nil {
-		log.Fatalln("Can not listen on UDP:", err)
+		logRemote("connect_failed").Err(err).Error("Can not listen on UDP")
+		timeouted <- struct{}{}
+		return
 	}
-	log.Println("Connected to UDP:" + *remoteAddr)
+	logRemote("connected").Info("Connected to UDP")
+	t, _ := govpn.TransportGet(current.Transport)
+	conn := govpn.TransportWrap(t, connUDP, false)
 
-	hs := govpn.HandshakeStart(*remoteAddr, conn, conf)
-	buf := make([]byte, *mtu*2)
+	hs := govpn.HandshakeStart(current.Addr, conn, conf)
+	// Enough for the biggest encryptionless handshake message
+	buf := make([]byte, 2*(govpn.EnclessEnlargeSize+*mtu))
 	var n int
 	var timeouts int
 	var peer *govpn.Peer
@@ -55,7 +60,7 @@ MainCycle:
 		conn.SetReadDeadline(time.Now().Add(time.Second))
 		n, err = conn.Read(buf)
 		if timeouts == timeout {
-			log.Println("Timeouted")
+			logRemote("timeout").Warn("Timeouted")
 			timeouted <- struct{}{}
 			break
 		}
@@ -67,31 +72,33 @@ MainCycle:
 			if peer.PktProcess(buf[:n], tap, true) {
 				timeouts = 0
 			} else {
-				log.Println("Unauthenticated packet")
+				govpn.LogEvent("peer_unauthenticated").Peer(peer).Warn("Unauthenticated packet")
 				timeouts++
 			}
-			if atomic.LoadUint64(&peer.BytesIn)+atomic.LoadUint64(&peer.BytesOut) > govpn.MaxBytesPerKey {
-				log.Println("Need rehandshake")
+			if paramsPending() {
+				govpn.LogEvent("rehandshaking").Peer(peer).Info("Rehandshaking with parameters pushed by server")
+				rehandshaking <- struct{}{}
+				break MainCycle
+			}
+			if peer.KeyBytes() > govpn.MaxBytesPerKey {
+				govpn.LogEvent("rehandshaking").Peer(peer).Info("Need rehandshake")
 				rehandshaking <- struct{}{}
 				break MainCycle
 			}
 			continue
 		}
-		if idsCache.Find(buf[:n]) == nil {
-			log.Println("Invalid identity in handshake packet")
+		if _, err = idsCache.Lookup(buf[:n]); err != nil {
+			logRemote("handshake_failed").Field("reason", err.(*govpn.HandshakeError).Reason).Warn(err.Error())
 			continue
 		}
 		timeouts = 0
-		peer = hs.Client(buf[:n])
+		peer, _ = hs.Client(buf[:n])
 		if peer == nil {
 			continue
 		}
-		log.Println("Handshake completed")
-		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{*remoteAddr: &peer})
-		if firstUpCall {
-			go govpn.ScriptCall(*upPath, *ifaceName, *remoteAddr)
-			firstUpCall = false
-		}
+		govpn.LogEvent("handshake_finished").Peer(peer).Info("Handshake completed")
+		knownPeers = govpn.KnownPeers(map[string]**govpn.Peer{current.Addr: &peer})
+		peerUp(peer)
 		hs.Zero()
 		terminator = make(chan struct{})
 		go func() {
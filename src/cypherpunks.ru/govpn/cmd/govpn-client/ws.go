@@ -0,0 +1,40 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"cypherpunks.ru/govpn"
+)
+
+func startWS(timeouted, rehandshaking, termination chan struct{}) {
+	conn := tcpConnect()
+	if conn == nil {
+		timeouted <- struct{}{}
+		return
+	}
+	ws, err := govpn.WSDial(conn, current.Addr, current.Path)
+	if err != nil {
+		logRemote("connect_failed").Err(err).Error("WebSocket handshake failed")
+		conn.Close()
+		timeouted <- struct{}{}
+		return
+	}
+	logRemote("connected").Field("path", current.Path).Info("Connected to WebSocket")
+	handleTCP(ws, timeouted, rehandshaking, termination)
+}
@@ -0,0 +1,107 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Runtime control utility for GoVPN server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	ctlPath  = flag.String("ctl", "", "Path to server's control UNIX socket")
+	warranty = flag.Bool("warranty", false, "Print warranty information")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s -ctl PATH COMMAND [ARGS]
+
+Commands:
+  list                 List established peers, handshakes and bans
+  kick PEERID          Disconnect the peer immediately
+  reload               Reread peers configuration
+  ban PEERID DURATION  Disconnect the peer and ban it for DURATION (1h30m)
+  unban PEERID         Remove the ban
+  rekey PEERID         Renegotiate peer's session key
+
+Options:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *warranty {
+		fmt.Println(govpn.Warranty)
+		return
+	}
+	if *ctlPath == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(1)
+	}
+	req := govpn.CtlRequest{Cmd: flag.Arg(0)}
+	switch req.Cmd {
+	case govpn.CtlKick, govpn.CtlUnban, govpn.CtlRekey:
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(1)
+		}
+		req.PeerId = flag.Arg(1)
+	case govpn.CtlBan:
+		if flag.NArg() != 3 {
+			usage()
+			os.Exit(1)
+		}
+		req.PeerId = flag.Arg(1)
+		duration, err := time.ParseDuration(flag.Arg(2))
+		if err != nil || duration < time.Second {
+			govpn.LogEvent("ctl_invalid").Field("duration", flag.Arg(2)).Fatal("Invalid ban duration")
+		}
+		req.Duration = int(duration / time.Second)
+	}
+	resp, err := govpn.CtlCall(*ctlPath, &req)
+	if err != nil {
+		govpn.LogEvent("ctl_failed").Err(err).Fatal("Control socket call failed")
+	}
+	if resp.Error != "" {
+		govpn.LogEvent("ctl_failed").Field(govpn.LogFieldError, resp.Error).Fatal("Control command failed")
+	}
+	if req.Cmd != govpn.CtlList {
+		return
+	}
+	for _, peer := range resp.Peers {
+		fmt.Printf(
+			"peer %s %s %s established %s in %d out %d\n",
+			peer.Id, peer.Name, peer.Addr,
+			peer.Established.Format(time.RFC3339),
+			peer.BytesIn, peer.BytesOut,
+		)
+	}
+	for _, addr := range resp.Handshakes {
+		fmt.Println("handshake", addr)
+	}
+	for _, ban := range resp.Banned {
+		fmt.Println("banned", ban.Id, "until", ban.Until.Format(time.RFC3339))
+	}
+}
@@ -20,8 +20,8 @@ package main
 
 import (
 	"bytes"
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cypherpunks.ru/govpn"
@@ -31,6 +31,9 @@ type PeerState struct {
 	peer       *govpn.Peer
 	terminator chan struct{}
 	tap        *govpn.TAP
+	port       *govpn.SwitchPort
+	// Transport used by UDP peer, nil for plain one
+	transport govpn.Transport
 }
 
 var (
@@ -45,8 +48,84 @@ var (
 
 	knownPeers govpn.KnownPeers
 	kpLock     sync.RWMutex
+
+	// Switches, indexed by TAP interface name
+	switches     map[string]*govpn.Switch = make(map[string]*govpn.Switch)
+	switchesLock sync.Mutex
+
+	// Failed handshakes counters, indexed by the reason
+	hsFailures map[string]*uint64 = make(map[string]*uint64)
 )
 
+func init() {
+	for _, reason := range govpn.HandshakeErrors {
+		hsFailures[reason.Reason] = new(uint64)
+	}
+}
+
+// Count the handshake failure.
+func hsFailed(err error) {
+	if reason, ok := err.(*govpn.HandshakeError); ok {
+		atomic.AddUint64(hsFailures[reason.Reason], 1)
+	}
+}
+
+// Count and log the failure of peer's identification, when there is
+// no handshake state yet. Identity is known in case of time
+// synchronization mismatch.
+func hsLookupFailed(addr string, peerId *govpn.PeerId, err error) {
+	hsFailed(err)
+	e := govpn.LogEvent("handshake_failed")
+	if peerId != nil {
+		e = logPeerId("handshake_failed", peerId)
+	}
+	if reason, ok := err.(*govpn.HandshakeError); ok {
+		e.Field("reason", reason.Reason)
+	}
+	e.Addr(addr).Warn(err.Error())
+}
+
+// Find out which transport the client uses by the framing of the
+// handshake message: the first of peers' non-plain transports, that
+// decodes it, is taken, plain one otherwise. datagram tells that data
+// is exactly single message. Then the known identity is looked for,
+// only once, and peer must be configured to use that transport.
+// Returns decoded message and how many bytes of data it took. If the
+// peer is not found, then the reason is returned, together with the
+// identity in case of time synchronization mismatch.
+func transportDetect(data []byte, datagram bool) (govpn.Transport, []byte, int, *govpn.PeerId, error) {
+	name := govpn.TransportPlain
+	t, _ := govpn.TransportGet(name)
+	msg, consumed := data, len(data)
+	for _, candidate := range confsTransports {
+		ct, err := govpn.TransportGet(candidate)
+		if err != nil {
+			continue
+		}
+		r := bytes.NewReader(data)
+		decoded, err := ct.Decode(r)
+		if err != nil || (datagram && r.Len() > 0) {
+			continue
+		}
+		name, t, msg, consumed = candidate, ct, decoded, len(data)-r.Len()
+		break
+	}
+	peerId, err := idsCache.Lookup(msg)
+	if err != nil {
+		return nil, nil, 0, peerId, err
+	}
+	conf := confs[*peerId]
+	if conf == nil {
+		logPeerId("conf_missing", peerId).Error("Unable to get peer configuration")
+		return nil, nil, 0, nil, nil
+	}
+	if conf.Transport != name {
+		logPeerId("transport_unexpected", peerId).Field("transport", name).Warn("Peer uses unexpected transport")
+		return nil, nil, 0, nil, nil
+	}
+	return t, msg, consumed, peerId, nil
+}
+
 func peerReady(ps PeerState) {
 	var data []byte
 	heartbeat := time.NewTicker(ps.peer.Timeout)
@@ -57,7 +136,7 @@ Processor:
 			ps.peer.EthProcess(nil)
 		case <-ps.terminator:
 			break Processor
-		case data = <-ps.tap.Sink:
+		case data = <-ps.port.Sink:
 			ps.peer.EthProcess(data)
 		}
 	}
@@ -66,12 +145,83 @@ Processor:
 	heartbeat.Stop()
 }
 
-func callUp(peerId *govpn.PeerId, remoteAddr string) (string, error) {
+// Delete the peer: stop its processing and call down-script.
+// peersLock, peersByIdLock and kpLock must be held.
+func peerDelete(addr string, ps *PeerState) {
+	delete(peers, addr)
+	delete(knownPeers, addr)
+	delete(peersById, *ps.peer.Id)
+	quotaPeerGone(ps.peer)
+	if conf, exists := confs[*ps.peer.Id]; exists {
+		go govpn.ScriptCall(conf.Down, ps.tap.Name, ps.peer.Addr)
+	}
+	ps.terminator <- struct{}{}
+	switchPortDel(ps)
+}
+
+// Start the record of the event related to the peer, adding its name
+// from the configuration.
+func logPeerId(event string, peerId *govpn.PeerId) *govpn.LogEntry {
+	e := govpn.LogEvent(event).PeerId(peerId)
+	if conf := confs[*peerId]; conf != nil {
+		e.PeerName(conf.Name)
+	}
+	return e
+}
+
+// Server-wide metrics for the stats server.
+func serverMetrics() []govpn.StatsMetric {
+	// Handshakes of stream protocols are not in handshakes map, but
+	// all of them are counted by the limiter
+	hsPending.Lock()
+	handshakesCount := hsCount
+	hsPending.Unlock()
+	metrics := []govpn.StatsMetric{{
+		Name:  "govpn_handshakes",
+		Help:  "Number of active handshakes",
+		Type:  "gauge",
+		Value: float64(handshakesCount),
+	}}
+	for _, reason := range govpn.HandshakeErrors {
+		metrics = append(metrics, govpn.StatsMetric{
+			Name:   "govpn_handshake_failures_total",
+			Help:   "Failed handshakes",
+			Type:   "counter",
+			Labels: map[string]string{"reason": reason.Reason},
+			Value:  float64(atomic.LoadUint64(hsFailures[reason.Reason])),
+		})
+	}
+	metrics = append(metrics, hsLimitsMetrics()...)
+	metrics = append(metrics, lockoutsMetrics()...)
+	return append(metrics, quotasMetrics()...)
+}
+
+// Attach new port to the TAP interface's switch, creating it if
+// necessary.
+func switchPortAdd(tap *govpn.TAP) *govpn.SwitchPort {
+	switchesLock.Lock()
+	sw, exists := switches[tap.Name]
+	if !exists {
+		sw = govpn.NewSwitch(tap, *p2p)
+		switches[tap.Name] = sw
+	}
+	switchesLock.Unlock()
+	return sw.PortAdd()
+}
+
+func switchPortDel(ps *PeerState) {
+	switchesLock.Lock()
+	sw := switches[ps.tap.Name]
+	switchesLock.Unlock()
+	sw.PortDel(ps.port)
+}
+
+func callUp(peerId *govpn.PeerId, remoteAddr string, env map[string]string) (string, error) {
 	ifaceName := confs[*peerId].Iface
 	if confs[*peerId].Up != "" {
-		result, err := govpn.ScriptCall(confs[*peerId].Up, ifaceName, remoteAddr)
+		result, err := govpn.ScriptCallEnv(confs[*peerId].Up, ifaceName, remoteAddr, env)
 		if err != nil {
-			log.Println("Script", confs[*peerId].Up, "call failed", err)
+			logPeerId("script_failed", peerId).Addr(remoteAddr).Err(err).Error("Up-script call failed")
 			return "", err
 		}
 		if ifaceName == "" {
@@ -83,7 +233,7 @@ func callUp(peerId *govpn.PeerId, remoteAddr string) (string, error) {
 		}
 	}
 	if ifaceName == "" {
-		log.Println("Can not obtain interface name for", *peerId)
+		logPeerId("iface_unknown", peerId).Addr(remoteAddr).Error("Can not obtain interface name")
 	}
 	return ifaceName, nil
 }
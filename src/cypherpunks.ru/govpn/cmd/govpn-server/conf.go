@@ -21,9 +21,11 @@ package main
 import (
 	"errors"
 	"io/ioutil"
-	"log"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/agl/ed25519"
 	"github.com/go-yaml/yaml"
 
 	"cypherpunks.ru/govpn"
@@ -36,6 +38,12 @@ const (
 var (
 	confs    map[govpn.PeerId]*govpn.PeerConf
 	idsCache *govpn.CipherCache
+	// Non-plain transports used by the peers
+	confsTransports []string
+	// Serializes periodic and on demand configuration refreshes
+	refreshLock sync.Mutex
+	// Server's identity key, signing handshakes
+	identity *[ed25519.PrivateKeySize]byte
 )
 
 func confRead() (*map[govpn.PeerId]*govpn.PeerConf, error) {
@@ -50,6 +58,7 @@ func confRead() (*map[govpn.PeerId]*govpn.PeerConf, error) {
 	}
 
 	confs := make(map[govpn.PeerId]*govpn.PeerConf, len(*confsRaw))
+	ifacePools := make(map[string]string)
 	for name, pc := range *confsRaw {
 		verifier, err := govpn.VerifierFromString(pc.VerifierRaw)
 		if err != nil {
@@ -58,50 +67,158 @@ func confRead() (*map[govpn.PeerId]*govpn.PeerConf, error) {
 		if pc.Encless {
 			pc.Noise = true
 		}
+		if !govpn.ModeValid(pc.Mode) {
+			return nil, errors.New("Unknown interface mode: " + pc.Mode)
+		}
+		if pc.Mode == "" {
+			pc.Mode = govpn.ModeTAP
+		}
 		if pc.MTU == 0 {
-			pc.MTU = govpn.MTUDefault
+			pc.MTU = govpn.MTUDefaultFor(pc.Mode)
+		}
+		if pc.Transport == "" {
+			pc.Transport = govpn.TransportPlain
+		}
+		if _, err = govpn.TransportGet(pc.Transport); err != nil {
+			return nil, err
 		}
 		if pc.MTU > govpn.MTUMax {
-			log.Println("MTU value", pc.MTU, "is too high, overriding to", govpn.MTUMax)
+			govpn.LogEvent("conf_mtu_overridden").PeerName(name).Field("mtu", pc.MTU).Warn("MTU value is too high, overriding to maximal")
 			pc.MTU = govpn.MTUMax
 		}
+		if err = poolCheck(pc.IP4Pool, true); err != nil {
+			return nil, err
+		}
+		if err = poolCheck(pc.IP6Pool, false); err != nil {
+			return nil, err
+		}
+		if (pc.IP4Pool != "" || pc.IP6Pool != "") && pc.Iface != "" {
+			pools := pc.IP4Pool + " " + pc.IP6Pool
+			if prev, exists := ifacePools[pc.Iface]; exists && prev != pools {
+				return nil, errors.New("Different address pools for " + pc.Iface)
+			}
+			ifacePools[pc.Iface] = pools
+		}
+		if _, err = govpn.CtrlEnvEncode(pc.Env); err != nil {
+			return nil, err
+		}
+		for k := range pc.Env {
+			if !govpn.EnvPushable(k) {
+				return nil, errors.New("Environment variable of " + name + " must be prefixed with " + govpn.ENV_PUSH_PREFIX + ": " + k)
+			}
+		}
+		switch pc.Quota.Action {
+		case "":
+			pc.Quota.Action = govpn.QuotaDisconnect
+		case govpn.QuotaDisconnect, govpn.QuotaThrottle:
+		default:
+			return nil, errors.New("Unknown quota action of " + name + ": " + pc.Quota.Action)
+		}
+		if pc.Rate.In < 0 || pc.Rate.Out < 0 || pc.Quota.Rate < 0 ||
+			pc.Quota.Daily < 0 || pc.Quota.Monthly < 0 {
+			return nil, errors.New("Negative rate or quota of " + name)
+		}
+		acl, err := govpn.ACLParse(pc.ACLRaw)
+		if err != nil {
+			return nil, errors.New("Invalid ACL of " + name + ": " + err.Error())
+		}
 		conf := govpn.PeerConf{
-			Verifier: verifier,
-			Id:       verifier.Id,
-			Name:     name,
-			Iface:    pc.Iface,
-			MTU:      pc.MTU,
-			Up:       pc.Up,
-			Down:     pc.Down,
-			Noise:    pc.Noise,
-			CPR:      pc.CPR,
-			Encless:  pc.Encless,
-			TimeSync: pc.TimeSync,
+			Verifier:  verifier,
+			Id:        verifier.Id,
+			Name:      name,
+			Iface:     pc.Iface,
+			Mode:      pc.Mode,
+			MTU:       pc.MTU,
+			Up:        pc.Up,
+			Down:      pc.Down,
+			Noise:     pc.Noise,
+			CPR:       pc.CPR,
+			Encless:   pc.Encless,
+			TimeSync:  pc.TimeSync,
+			IP4Pool:   pc.IP4Pool,
+			IP6Pool:   pc.IP6Pool,
+			Env:       pc.Env,
+			Transport: pc.Transport,
+
+			ServerPriv: identity,
+			ACL:        acl,
+			Rate:       pc.Rate,
+			Quota:      pc.Quota,
 		}
 		if pc.TimeoutInt <= 0 {
 			pc.TimeoutInt = govpn.TimeoutDefault
 		}
 		conf.Timeout = time.Second * time.Duration(pc.TimeoutInt)
+		conf.Rekey = time.Second * time.Duration(pc.RekeyInt)
 		confs[*verifier.Id] = &conf
+		if pc.VerifierOld != "" {
+			verifierOld, err := govpn.VerifierFromString(pc.VerifierOld)
+			if err != nil {
+				return nil, errors.New("Unable to decode old verifier: " + err.Error())
+			}
+			if *verifierOld.Id == *verifier.Id {
+				return nil, errors.New("Old verifier of " + name + " has the same identity")
+			}
+			confOld := conf
+			confOld.Verifier = verifierOld
+			confOld.Id = verifierOld.Id
+			confs[*verifierOld.Id] = &confOld
+		}
 	}
 	return &confs, nil
 }
 
+// Check that pool is either empty, or valid network of required family.
+func poolCheck(cidr string, ip4 bool) error {
+	if cidr == "" {
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.New("Invalid address pool: " + err.Error())
+	}
+	if (ipNet.IP.To4() != nil) != ip4 {
+		return errors.New("Address pool of wrong family: " + cidr)
+	}
+	return nil
+}
+
 func confRefresh() error {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
 	newConfs, err := confRead()
 	if err != nil {
-		log.Println("Unable to parse peers configuration:", err)
+		govpn.LogEvent("conf_invalid").Err(err).Error("Unable to parse peers configuration")
 		return err
 	}
-	confs = *newConfs
+	used := make(map[string]bool)
+	for _, conf := range *newConfs {
+		used[conf.Transport] = true
+	}
+	transports := make([]string, 0, len(used))
+	for _, name := range govpn.TransportNames() {
+		if name != govpn.TransportPlain && used[name] {
+			transports = append(transports, name)
+		}
+	}
+	confs, confsTransports = *newConfs, transports
 	idsCache.Update(newConfs)
+	poolsUpdate(newConfs)
 	return nil
 }
 
 func confInit() {
-	idsCache = govpn.NewCipherCache()
+	if *identityPath != "" {
+		var err error
+		identity, err = govpn.KeyFileRead(*identityPath, *identityPass)
+		if err != nil {
+			govpn.LogEvent("identity_failed").Err(err).Fatal("Unable to read identity key file")
+		}
+		govpn.LogEvent("identity_loaded").Field("pub", govpn.KeyPubString(identity)).Info("Server identity public key")
+	}
+	idsCache = govpn.NewServerCipherCache()
 	if err := confRefresh(); err != nil {
-		log.Fatalln(err)
+		govpn.LogEvent("conf_invalid").Err(err).Fatal("Unable to read peers configuration")
 	}
 	go func() {
 		for {
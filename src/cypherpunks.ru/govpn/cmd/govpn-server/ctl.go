@@ -0,0 +1,207 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	bans     map[govpn.PeerId]time.Time = make(map[govpn.PeerId]time.Time)
+	bansLock sync.RWMutex
+)
+
+// Is the peer currently banned through the control socket.
+func banned(peerId *govpn.PeerId) bool {
+	bansLock.RLock()
+	until, exists := bans[*peerId]
+	bansLock.RUnlock()
+	return exists && time.Now().Before(until)
+}
+
+func ctlStart() {
+	if err := os.Remove(*ctlPath); err != nil && !os.IsNotExist(err) {
+		govpn.LogEvent("ctl_failed").Err(err).Fatal("Can not remove stale control socket")
+	}
+	listener, err := net.Listen("unix", *ctlPath)
+	if err != nil {
+		govpn.LogEvent("ctl_failed").Err(err).Fatal("Can not listen on control socket")
+	}
+	if err = os.Chmod(*ctlPath, os.FileMode(0600)); err != nil {
+		govpn.LogEvent("ctl_failed").Err(err).Fatal("Can not change control socket permissions")
+	}
+	govpn.LogEvent("ctl_listening").Addr(*ctlPath).Info("Control socket listening")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				govpn.LogEvent("ctl_failed").Err(err).Error("Error accepting control connection")
+				continue
+			}
+			go ctlHandle(conn)
+		}
+	}()
+}
+
+func ctlHandle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(govpn.RWTimeout))
+	var req govpn.CtlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		govpn.LogEvent("ctl_invalid").Err(err).Warn("Invalid control request")
+		return
+	}
+	resp := ctlProcess(&req)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+func ctlProcess(req *govpn.CtlRequest) *govpn.CtlResponse {
+	resp := new(govpn.CtlResponse)
+	var peerId *govpn.PeerId
+	var err error
+	switch req.Cmd {
+	case govpn.CtlKick, govpn.CtlBan, govpn.CtlUnban, govpn.CtlRekey:
+		peerId, err = govpn.PeerIdFromString(req.PeerId)
+		if err != nil {
+			resp.Error = "Invalid peer identity: " + err.Error()
+			return resp
+		}
+	}
+	switch req.Cmd {
+	case govpn.CtlList:
+		ctlList(resp)
+	case govpn.CtlKick:
+		if !peerKick(peerId) {
+			resp.Error = "Peer is not connected"
+		}
+	case govpn.CtlRekey:
+		if !peerRekey(peerId) {
+			resp.Error = "Peer is not connected"
+		}
+	case govpn.CtlReload:
+		if err = confRefresh(); err != nil {
+			resp.Error = err.Error()
+		}
+	case govpn.CtlBan:
+		if req.Duration <= 0 {
+			resp.Error = "Invalid ban duration"
+			break
+		}
+		bansLock.Lock()
+		bans[*peerId] = time.Now().Add(time.Duration(req.Duration) * time.Second)
+		bansLock.Unlock()
+		logPeerId("peer_banned", peerId).Field("duration", req.Duration).Info("Peer banned")
+		peerKick(peerId)
+	case govpn.CtlUnban:
+		bansLock.Lock()
+		delete(bans, *peerId)
+		bansLock.Unlock()
+		logPeerId("peer_unbanned", peerId).Info("Peer unbanned")
+	default:
+		resp.Error = "Unknown command"
+	}
+	return resp
+}
+
+func ctlList(resp *govpn.CtlResponse) {
+	hsLock.RLock()
+	for addr := range handshakes {
+		resp.Handshakes = append(resp.Handshakes, addr)
+	}
+	hsLock.RUnlock()
+	peersLock.RLock()
+	for _, ps := range peers {
+		resp.Peers = append(resp.Peers, govpn.CtlPeer{
+			Id:          ps.peer.Id.String(),
+			Name:        ps.peer.Name,
+			Addr:        ps.peer.Addr,
+			Established: ps.peer.Established,
+			BytesIn:     atomic.LoadUint64(&ps.peer.BytesIn),
+			BytesOut:    atomic.LoadUint64(&ps.peer.BytesOut),
+		})
+	}
+	peersLock.RUnlock()
+	now := time.Now()
+	bansLock.Lock()
+	for peerId, until := range bans {
+		if until.Before(now) {
+			delete(bans, peerId)
+			continue
+		}
+		resp.Banned = append(resp.Banned, govpn.CtlBanned{
+			Id:    peerId.String(),
+			Until: until,
+		})
+	}
+	bansLock.Unlock()
+}
+
+// Renegotiate session key with the peer. Returns false if it is
+// unknown.
+func peerRekey(peerId *govpn.PeerId) bool {
+	peersLock.RLock()
+	peersByIdLock.RLock()
+	addr, exists := peersById[*peerId]
+	var ps *PeerState
+	if exists {
+		ps, exists = peers[addr]
+	}
+	peersLock.RUnlock()
+	peersByIdLock.RUnlock()
+	if !exists {
+		return false
+	}
+	govpn.LogEvent("peer_rekeying").Peer(ps.peer).Info("Rekeying peer")
+	ps.peer.Rekey()
+	return true
+}
+
+// Disconnect the peer immediately. Returns false if it is unknown.
+func peerKick(peerId *govpn.PeerId) bool {
+	peersLock.Lock()
+	peersByIdLock.Lock()
+	kpLock.Lock()
+	defer func() {
+		peersLock.Unlock()
+		peersByIdLock.Unlock()
+		kpLock.Unlock()
+	}()
+	addr, exists := peersById[*peerId]
+	if !exists {
+		return false
+	}
+	ps, exists := peers[addr]
+	if !exists {
+		return false
+	}
+	govpn.LogEvent("peer_kicked").Peer(ps.peer).Info("Kicking peer")
+	peerDelete(addr, ps)
+	if closer, ok := ps.peer.Conn.(io.Closer); ok {
+		closer.Close()
+	}
+	return true
+}
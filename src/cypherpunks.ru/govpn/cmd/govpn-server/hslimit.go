@@ -0,0 +1,171 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	HsCookieAuto   = "auto"
+	HsCookieAlways = "always"
+	HsCookieOff    = "off"
+
+	// Source prefix lengths, sharing the per prefix handshakes limit
+	HsPrefixIPv4 = 24
+	HsPrefixIPv6 = 64
+)
+
+var (
+	// Concurrent handshakes, in total and per source prefix
+	hsCount    int
+	hsPrefixes map[string]int = make(map[string]int)
+	hsPending  sync.Mutex
+
+	hsCookies = govpn.NewCookieJar()
+
+	// Handshakes refused because of the limits, indexed by limit
+	hsLimited map[string]*uint64 = map[string]*uint64{
+		"global": new(uint64),
+		"prefix": new(uint64),
+	}
+	// Cookie challenges sent
+	hsChallenged uint64
+)
+
+// Source network of the address, sharing the handshakes limit.
+func addrPrefix(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(HsPrefixIPv4, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(HsPrefixIPv6, 128)).String()
+}
+
+// Take the slot of the concurrent handshake from addr. Returns false
+// if either global or source prefix limit is reached.
+func hsAcquire(addr string) bool {
+	prefix := addrPrefix(addr)
+	var limit string
+	hsPending.Lock()
+	if *hsMax > 0 && hsCount >= *hsMax {
+		limit = "global"
+	} else if *hsMaxPrefix > 0 && hsPrefixes[prefix] >= *hsMaxPrefix {
+		limit = "prefix"
+	} else {
+		hsCount++
+		hsPrefixes[prefix]++
+	}
+	hsPending.Unlock()
+	if limit == "" {
+		return true
+	}
+	atomic.AddUint64(hsLimited[limit], 1)
+	govpn.LogEvent("handshake_limited").Addr(addr).Field("limit", limit).Debug(
+		"Too many concurrent handshakes",
+	)
+	return false
+}
+
+// Free the slot taken by hsAcquire.
+func hsRelease(addr string) {
+	prefix := addrPrefix(addr)
+	hsPending.Lock()
+	hsCount--
+	if hsPrefixes[prefix] <= 1 {
+		delete(hsPrefixes, prefix)
+	} else {
+		hsPrefixes[prefix]--
+	}
+	hsPending.Unlock()
+}
+
+// Whether first handshake messages must carry the cookie.
+func hsCookieNeeded() bool {
+	switch *hsCookie {
+	case HsCookieAlways:
+		return true
+	case HsCookieAuto:
+		hsPending.Lock()
+		loaded := hsCount >= *hsCookieLoad
+		hsPending.Unlock()
+		return loaded
+	}
+	return false
+}
+
+// Check the cookie of the first handshake message from addr. Valid
+// cookie is removed from the message. If cookie is required, but
+// missing, then the challenge is sent and nil is returned.
+func hsCookieCheck(addr string, conn io.Writer, conf *govpn.PeerConf, data []byte) []byte {
+	if msg, ok := hsCookies.Check(addr, data); ok {
+		return msg
+	}
+	if !hsCookieNeeded() {
+		return data
+	}
+	atomic.AddUint64(&hsChallenged, 1)
+	govpn.LogEvent("handshake_challenged").PeerName(conf.Name).PeerId(conf.Id).Addr(addr).Debug("Cookie challenge")
+	govpn.HandshakeChallenge(conn, conf, hsCookies.Cookie(addr, data), data)
+	return nil
+}
+
+// Metrics of the handshakes limits.
+func hsLimitsMetrics() []govpn.StatsMetric {
+	var cookies float64
+	if hsCookieNeeded() {
+		cookies = 1
+	}
+	metrics := []govpn.StatsMetric{
+		{
+			Name:  "govpn_handshake_cookies_required",
+			Help:  "Whether handshakes require the cookie",
+			Type:  "gauge",
+			Value: cookies,
+		},
+		{
+			Name:  "govpn_handshake_challenges_total",
+			Help:  "Cookie challenges sent",
+			Type:  "counter",
+			Value: float64(atomic.LoadUint64(&hsChallenged)),
+		},
+	}
+	for _, limit := range []string{"global", "prefix"} {
+		metrics = append(metrics, govpn.StatsMetric{
+			Name:   "govpn_handshake_limited_total",
+			Help:   "Handshakes refused because of concurrency limits",
+			Type:   "counter",
+			Labels: map[string]string{"limit": limit},
+			Value:  float64(atomic.LoadUint64(hsLimited[limit])),
+		})
+	}
+	return metrics
+}
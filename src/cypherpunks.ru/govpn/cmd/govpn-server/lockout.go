@@ -0,0 +1,198 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-yaml/yaml"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	LockoutCheckRate = time.Minute
+)
+
+var (
+	lockouts     *govpn.Lockouts
+	lockoutsLock sync.Mutex
+
+	// Lockouts happened, indexed by kind: peer or source
+	lockoutsTotal map[string]*uint64 = map[string]*uint64{
+		"peer":   new(uint64),
+		"source": new(uint64),
+	}
+)
+
+// Source address without the port.
+func addrHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func lockoutsLoad() {
+	var err error
+	lockouts, err = govpn.NewLockouts(*lockoutAttempts, *lockoutPeriod, *lockoutMax)
+	if err != nil {
+		govpn.LogEvent("lockout_invalid").Err(err).Fatal("Invalid lockout parameters")
+	}
+	if *lockoutsPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*lockoutsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			govpn.LogEvent("lockouts_failed").Err(err).Error("Unable to read lockouts")
+		}
+		return
+	}
+	var state govpn.LockoutsState
+	if err = yaml.Unmarshal(data, &state); err != nil {
+		govpn.LogEvent("lockouts_failed").Err(err).Error("Unable to parse lockouts")
+		return
+	}
+	lockoutsLock.Lock()
+	if err = lockouts.Restore(&state); err != nil {
+		govpn.LogEvent("lockouts_failed").Err(err).Warn("Invalid lockout")
+	}
+	lockoutsLock.Unlock()
+}
+
+// Atomically save all lockouts to the state file. lockoutsLock must be
+// held.
+func lockoutsSave() {
+	if *lockoutsPath == "" {
+		return
+	}
+	data, err := yaml.Marshal(lockouts.State())
+	if err != nil {
+		govpn.LogEvent("lockouts_failed").Err(err).Error("Unable to serialize lockouts")
+		return
+	}
+	tmpPath := *lockoutsPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		govpn.LogEvent("lockouts_failed").Err(err).Error("Unable to write lockouts")
+		return
+	}
+	if err = os.Rename(tmpPath, *lockoutsPath); err != nil {
+		govpn.LogEvent("lockouts_failed").Err(err).Error("Unable to write lockouts")
+	}
+}
+
+// Is either the peer or the source address locked out.
+func lockedOut(addr string, peerId *govpn.PeerId) bool {
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+	return lockouts.Locked(peerId, addrHost(addr), time.Now())
+}
+
+// Account the handshake failure of the peer from addr, if it looks
+// like the password guessing, locking them out if necessary.
+func lockoutFailed(addr string, peerId *govpn.PeerId, err error) {
+	host := addrHost(addr)
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+	peerDuration, sourceDuration := lockouts.Fail(peerId, host, err, time.Now())
+	if peerDuration > 0 {
+		atomic.AddUint64(lockoutsTotal["peer"], 1)
+		logPeerId("peer_locked_out", peerId).Addr(addr).Field("duration", peerDuration.String()).Warn(
+			"Too many failed handshakes, locking out peer",
+		)
+	}
+	if sourceDuration > 0 {
+		atomic.AddUint64(lockoutsTotal["source"], 1)
+		govpn.LogEvent("source_locked_out").Addr(host).Field("duration", sourceDuration.String()).Warn(
+			"Too many failed handshakes, locking out source address",
+		)
+	}
+	if peerDuration > 0 || sourceDuration > 0 {
+		lockoutsSave()
+	}
+}
+
+// Forget failures of the successfully handshaked peer. Failures of its
+// source address are kept.
+func lockoutReset(peerId *govpn.PeerId) {
+	lockoutsLock.Lock()
+	if lockouts.Reset(peerId, time.Now()) {
+		lockoutsSave()
+	}
+	lockoutsLock.Unlock()
+}
+
+// Periodically forget old failures.
+func lockoutsExpire() {
+	for {
+		time.Sleep(LockoutCheckRate)
+		lockoutsLock.Lock()
+		if lockouts.Expire(time.Now()) {
+			lockoutsSave()
+		}
+		lockoutsLock.Unlock()
+	}
+}
+
+// Lockouts happened and active ones for the stats server.
+func lockoutsMetrics() []govpn.StatsMetric {
+	var metrics []govpn.StatsMetric
+	lockoutsLock.Lock()
+	activePeers, activeSources := lockouts.Active(time.Now())
+	lockoutsLock.Unlock()
+	for peerId, left := range activePeers {
+		labels := map[string]string{"peer_id": peerId.String()}
+		if conf := confs[peerId]; conf != nil {
+			labels["name"] = conf.Name
+		}
+		metrics = append(metrics, govpn.StatsMetric{
+			Name:   "govpn_peer_lockout_seconds",
+			Help:   "Time left until the peer's lockout ends",
+			Type:   "gauge",
+			Labels: labels,
+			Value:  left.Seconds(),
+		})
+	}
+	active := map[string]int{"peer": len(activePeers), "source": activeSources}
+	for _, kind := range []string{"peer", "source"} {
+		metrics = append(metrics, govpn.StatsMetric{
+			Name:   "govpn_lockouts_total",
+			Help:   "Lockouts after too many failed handshakes",
+			Type:   "counter",
+			Labels: map[string]string{"kind": kind},
+			Value:  float64(atomic.LoadUint64(lockoutsTotal[kind])),
+		})
+	}
+	for _, kind := range []string{"peer", "source"} {
+		metrics = append(metrics, govpn.StatsMetric{
+			Name:   "govpn_lockouts_active",
+			Help:   "Currently locked out peers and source addresses",
+			Type:   "gauge",
+			Labels: map[string]string{"kind": kind},
+			Value:  float64(active[kind]),
+		})
+	}
+	return metrics
+}
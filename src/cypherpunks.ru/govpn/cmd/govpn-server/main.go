@@ -22,7 +22,6 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
 	"net"
 	"os"
 	"os/signal"
@@ -32,13 +31,36 @@ import (
 )
 
 var (
-	bindAddr = flag.String("bind", "[::]:1194", "Bind to address")
-	proto    = flag.String("proto", "udp", "Protocol to use: udp, tcp or all")
-	confPath = flag.String("conf", "peers.yaml", "Path to configuration YAML")
-	stats    = flag.String("stats", "", "Enable stats retrieving on host:port")
-	proxy    = flag.String("proxy", "", "Enable HTTP proxy on host:port")
-	egdPath  = flag.String("egd", "", "Optional path to EGD socket")
-	warranty = flag.Bool("warranty", false, "Print warranty information")
+	bindAddr        = flag.String("bind", "[::]:1194", "Bind to address")
+	proto           = flag.String("proto", "udp", "Protocol to use: udp, tcp, tls or all")
+	confPath        = flag.String("conf", "peers.yaml", "Path to configuration YAML")
+	stats           = flag.String("stats", "", "Enable stats retrieving on host:port")
+	proxy           = flag.String("proxy", "", "Enable HTTP proxy on host:port")
+	wsAddr          = flag.String("ws", "", "Enable WebSocket over HTTP on host:port")
+	wsPath          = flag.String("ws-path", "/", "HTTP path of WebSocket endpoint")
+	wsDecoy         = flag.String("ws-decoy", "", "Optional path to directory with decoy site")
+	tlsCert         = flag.String("tls-cert", "", "Path to TLS certificate PEM file")
+	tlsKey          = flag.String("tls-key", "", "Path to TLS private key PEM file")
+	identityPath    = flag.String("identity", "", "Optional path to server's Ed25519 identity key file")
+	identityPass    = flag.String("identity-pass", "", "Path to passphrase file of encrypted identity key file")
+	transportKey    = flag.String("transport-key", "", "Path to shared secret file of xor transport")
+	ctlPath         = flag.String("ctl", "", "Optional path to control UNIX socket")
+	p2p             = flag.Bool("p2p", false, "Forward frames between peers without the kernel")
+	egdPath         = flag.String("egd", "", "Optional path to EGD socket")
+	leasesPath      = flag.String("leases", "", "Optional path to address leases state file")
+	quotasPath      = flag.String("quotas", "", "Optional path to traffic quotas state file")
+	hsMax           = flag.Int("hs-max", 1024, "Maximal number of concurrent handshakes, 0 for unlimited")
+	hsMaxPrefix     = flag.Int("hs-max-prefix", 16, "Maximal number of concurrent handshakes from the source /24 or /64 network, 0 for unlimited")
+	hsCookie        = flag.String("hs-cookie", HsCookieAuto, "Require cookie challenge for UDP handshakes: auto, always or off")
+	hsCookieLoad    = flag.Int("hs-cookie-load", 64, "Number of concurrent handshakes, turning on cookie challenge in auto mode")
+	lockoutsPath    = flag.String("lockouts", "", "Optional path to handshake lockouts state file")
+	lockoutAttempts = flag.Int("lockout-attempts", 5, "Failed handshakes before the lockout, 0 to disable")
+	lockoutPeriod   = flag.Duration("lockout-period", time.Minute, "Initial lockout duration")
+	lockoutMax      = flag.Duration("lockout-max", 24*time.Hour, "Maximal lockout duration")
+	logLevel        = flag.String("log-level", "info", "Logging level: debug, info, warn or error")
+	logFormat       = flag.String("log-format", govpn.LogFormatText, "Logging format: text or json")
+	logTarget       = flag.String("log", "", "Optional logging target: syslog[:path] or journald[:path]")
+	warranty        = flag.Bool("warranty", false, "Print warranty information")
 )
 
 func main() {
@@ -48,14 +70,33 @@ func main() {
 		return
 	}
 	timeout := time.Second * time.Duration(govpn.TimeoutDefault)
-	log.SetFlags(log.Ldate | log.Lmicroseconds | log.Lshortfile)
-	log.Println(govpn.VersionGet())
+	if err := govpn.LogSetup(*logLevel, *logFormat, *logTarget); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	switch *hsCookie {
+	case HsCookieAuto, HsCookieAlways, HsCookieOff:
+	default:
+		govpn.LogEvent("cookie_mode_unknown").Field("mode", *hsCookie).Fatal("Unknown cookie challenge mode")
+	}
+	if *transportKey != "" {
+		secret, err := govpn.KeyRead(*transportKey)
+		if err != nil {
+			govpn.LogEvent("transport_key_failed").Err(err).Fatal("Unable to read transport key")
+		}
+		govpn.TransportXORKey(secret)
+	}
+	govpn.LogEvent("started").Field("version", govpn.VersionGet()).Info("GoVPN server")
 
 	confInit()
+	quotasLoad()
+	go quotasCheck()
+	lockoutsLoad()
+	go lockoutsExpire()
 	knownPeers = govpn.KnownPeers(make(map[string]**govpn.Peer))
 
 	if *egdPath != "" {
-		log.Println("Using", *egdPath, "EGD")
+		govpn.LogEvent("egd").Addr(*egdPath).Info("Using EGD")
 		govpn.EGDInit(*egdPath)
 	}
 
@@ -64,11 +105,13 @@ func main() {
 		startUDP()
 	case "tcp":
 		startTCP()
+	case "tls":
+		startTLS()
 	case "all":
 		startUDP()
 		startTCP()
 	default:
-		log.Fatalln("Unknown protocol specified")
+		govpn.LogEvent("proto_unknown").Field("proto", *proto).Fatal("Unknown protocol specified")
 	}
 
 	termSignal := make(chan os.Signal, 1)
@@ -78,24 +121,35 @@ func main() {
 	go func() { <-hsHeartbeat }()
 
 	if *stats != "" {
-		log.Println("Stats are going to listen on", *stats)
+		govpn.LogEvent("stats_listening").Addr(*stats).Info("Stats are going to listen")
 		statsPort, err := net.Listen("tcp", *stats)
 		if err != nil {
-			log.Fatalln("Can not listen on stats port:", err)
+			govpn.LogEvent("stats_failed").Err(err).Fatal("Can not listen on stats port")
 		}
-		go govpn.StatsProcessor(statsPort, &knownPeers)
+		go govpn.StatsServe(statsPort, &govpn.Stats{
+			Peers:     &knownPeers,
+			PeersLock: &kpLock,
+			Metrics:   serverMetrics,
+		})
 	}
 	if *proxy != "" {
 		go proxyStart()
 	}
-	log.Println("Server started")
+	if *wsAddr != "" {
+		go wsStart()
+	}
+	if *ctlPath != "" {
+		ctlStart()
+	}
+	govpn.LogEvent("ready").Info("Server started")
 
 	var needsDeletion bool
 MainCycle:
 	for {
 		select {
 		case <-termSignal:
-			log.Println("Terminating")
+			govpn.LogEvent("terminating").Info("Terminating")
+			quotasAccount()
 			for _, ps := range peers {
 				govpn.ScriptCall(
 					confs[*ps.peer.Id].Down,
@@ -109,9 +163,10 @@ MainCycle:
 			hsLock.Lock()
 			for addr, hs := range handshakes {
 				if hs.LastPing.Add(timeout).Before(now) {
-					log.Println("Deleting handshake state", addr)
+					hsFailed(hs.Expire())
 					hs.Zero()
 					delete(handshakes, addr)
+					hsRelease(addr)
 				}
 			}
 			peersLock.Lock()
@@ -122,16 +177,8 @@ MainCycle:
 				needsDeletion = ps.peer.LastPing.Add(timeout).Before(now)
 				ps.peer.BusyR.Unlock()
 				if needsDeletion {
-					log.Println("Deleting peer", ps.peer)
-					delete(peers, addr)
-					delete(knownPeers, addr)
-					delete(peersById, *ps.peer.Id)
-					go govpn.ScriptCall(
-						confs[*ps.peer.Id].Down,
-						ps.tap.Name,
-						ps.peer.Addr,
-					)
-					ps.terminator <- struct{}{}
+					govpn.LogEvent("peer_expired").Peer(ps.peer).Info("Deleting peer")
+					peerDelete(addr, ps)
 				}
 			}
 			hsLock.Unlock()
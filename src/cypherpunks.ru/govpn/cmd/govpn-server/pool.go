@@ -0,0 +1,175 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/go-yaml/yaml"
+
+	"cypherpunks.ru/govpn"
+)
+
+var (
+	// Address pools, indexed by their CIDR
+	pools     map[string]*govpn.AddrPool = make(map[string]*govpn.AddrPool)
+	poolsLock sync.Mutex
+)
+
+// Leases state file structure: pool's CIDR -> PeerId -> address.
+type leasesState map[string]map[string]string
+
+func leasesLoad() leasesState {
+	state := make(leasesState)
+	if *leasesPath == "" {
+		return state
+	}
+	data, err := ioutil.ReadFile(*leasesPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			govpn.LogEvent("leases_failed").Err(err).Error("Unable to read leases")
+		}
+		return state
+	}
+	if err = yaml.Unmarshal(data, &state); err != nil {
+		govpn.LogEvent("leases_failed").Err(err).Error("Unable to parse leases")
+	}
+	return state
+}
+
+// Atomically save all pools leases to the state file. poolsLock must
+// be held.
+func leasesSave() {
+	if *leasesPath == "" {
+		return
+	}
+	state := make(leasesState, len(pools))
+	for cidr, pool := range pools {
+		leases := make(map[string]string)
+		for id, ip := range pool.Leases() {
+			leases[id.String()] = ip.String()
+		}
+		state[cidr] = leases
+	}
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		govpn.LogEvent("leases_failed").Err(err).Error("Unable to serialize leases")
+		return
+	}
+	tmpPath := *leasesPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		govpn.LogEvent("leases_failed").Err(err).Error("Unable to write leases")
+		return
+	}
+	if err = os.Rename(tmpPath, *leasesPath); err != nil {
+		govpn.LogEvent("leases_failed").Err(err).Error("Unable to write leases")
+	}
+}
+
+// Create pools that appeared in the configuration, restoring their
+// leases from the state file. Already existing pools are kept intact.
+func poolsUpdate(confs *map[govpn.PeerId]*govpn.PeerConf) {
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	var state leasesState
+	for _, pc := range *confs {
+		for _, cidr := range []string{pc.IP4Pool, pc.IP6Pool} {
+			if cidr == "" {
+				continue
+			}
+			if _, exists := pools[cidr]; exists {
+				continue
+			}
+			pool, err := govpn.NewAddrPool(cidr)
+			if err != nil {
+				govpn.LogEvent("pool_failed").Err(err).Error("Unable to create address pool")
+				continue
+			}
+			if state == nil {
+				state = leasesLoad()
+			}
+			for idRaw, ipRaw := range state[cidr] {
+				pid, err := govpn.PeerIdFromString(idRaw)
+				ip := net.ParseIP(ipRaw)
+				if err != nil || ip == nil {
+					govpn.LogEvent("leases_failed").Field("pool", cidr).Field("lease", idRaw).Warn("Invalid lease")
+					continue
+				}
+				if err = pool.Restore(*pid, ip); err != nil {
+					govpn.LogEvent("leases_failed").Err(err).Warn("Unable to restore lease")
+				}
+			}
+			govpn.LogEvent("pool_created").Field("pool", cidr).Info("Address pool created")
+			pools[cidr] = pool
+		}
+	}
+}
+
+// Environment both for up-script and the client: configured one, peer's
+// authoritative parameters and addresses leased from its pools.
+func peerEnv(conf *govpn.PeerConf) map[string]string {
+	env := make(map[string]string)
+	for k, v := range conf.Env {
+		env[k] = v
+	}
+	for k, v := range govpn.ParamsEnv(conf) {
+		env[k] = v
+	}
+	poolsLock.Lock()
+	defer poolsLock.Unlock()
+	leased := false
+	for _, p := range []struct {
+		cidr    string
+		addrKey string
+		gwKey   string
+	}{
+		{conf.IP4Pool, govpn.ENV_IP4_ADDRESS, govpn.ENV_IP4_GATEWAY},
+		{conf.IP6Pool, govpn.ENV_IP6_ADDRESS, govpn.ENV_IP6_GATEWAY},
+	} {
+		pool, exists := pools[p.cidr]
+		if !exists {
+			continue
+		}
+		ip, err := pool.Lease(*conf.Id)
+		if err != nil {
+			govpn.LogEvent("lease_failed").PeerName(conf.Name).PeerId(conf.Id).Err(err).Error("Unable to lease address")
+			continue
+		}
+		env[p.addrKey] = pool.CIDR(ip)
+		env[p.gwKey] = pool.Gateway.String()
+		leased = true
+	}
+	if leased {
+		leasesSave()
+	}
+	return env
+}
+
+// Push environment to the peer through authenticated control message.
+func envPush(peer *govpn.Peer, env map[string]string) {
+	data, err := govpn.CtrlEnvEncode(env)
+	if err != nil {
+		govpn.LogEvent("env_failed").Peer(peer).Err(err).Error("Unable to encode environment")
+		return
+	}
+	peer.CtrlProcess(govpn.CtrlEnv, data)
+}
@@ -19,8 +19,9 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"log"
 	"net/http"
+
+	"cypherpunks.ru/govpn"
 )
 
 type proxyHandler struct{}
@@ -28,7 +29,7 @@ type proxyHandler struct{}
 func (p proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	conn, _, err := w.(http.Hijacker).Hijack()
 	if err != nil {
-		log.Println("Hijacking failed:", err.Error())
+		govpn.LogEvent("proxy_failed").Addr(r.RemoteAddr).Err(err).Warn("Hijacking failed")
 		return
 	}
 	conn.Write([]byte("HTTP/1.0 200 OK\n\n"))
@@ -36,10 +37,10 @@ func (p proxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func proxyStart() {
-	log.Println("HTTP proxy listening on:" + *proxy)
+	govpn.LogEvent("proxy_listening").Addr(*proxy).Info("HTTP proxy listening")
 	s := &http.Server{
 		Addr:    *proxy,
 		Handler: proxyHandler{},
 	}
-	log.Println("HTTP proxy result:", s.ListenAndServe())
+	govpn.LogEvent("proxy_stopped").Err(s.ListenAndServe()).Error("HTTP proxy stopped")
 }
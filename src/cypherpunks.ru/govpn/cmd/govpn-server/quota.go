@@ -0,0 +1,272 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-yaml/yaml"
+
+	"cypherpunks.ru/govpn"
+)
+
+const (
+	QuotaCheckRate = 10 * time.Second
+)
+
+// Traffic used by the peer during current day and month.
+type quotaUsage struct {
+	Day        string `yaml:"day"`
+	DayBytes   uint64 `yaml:"day_bytes"`
+	Month      string `yaml:"month"`
+	MonthBytes uint64 `yaml:"month_bytes"`
+	throttled  bool
+}
+
+// Quotas state file structure: PeerId -> usage.
+type quotasState map[string]*quotaUsage
+
+var (
+	quotas map[govpn.PeerId]*quotaUsage = make(map[govpn.PeerId]*quotaUsage)
+	// Peer's traffic already taken into account
+	quotasSeen map[*govpn.Peer]uint64 = make(map[*govpn.Peer]uint64)
+	quotasLock sync.Mutex
+)
+
+// Add n bytes to the usage, starting new day and month if necessary.
+func (u *quotaUsage) add(now time.Time, n uint64) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day = day
+		u.DayBytes = 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month = month
+		u.MonthBytes = 0
+	}
+	u.DayBytes += n
+	u.MonthBytes += n
+}
+
+// Is any of the peer's quotas exhausted.
+func (u *quotaUsage) exhausted(conf *govpn.PeerConf) bool {
+	return (conf.Quota.Daily > 0 && u.DayBytes >= uint64(conf.Quota.Daily)<<20) ||
+		(conf.Quota.Monthly > 0 && u.MonthBytes >= uint64(conf.Quota.Monthly)<<20)
+}
+
+// Peer's usage, created if missing. quotasLock must be held.
+func quotaUsageGet(peerId *govpn.PeerId, now time.Time) *quotaUsage {
+	usage, exists := quotas[*peerId]
+	if !exists {
+		usage = new(quotaUsage)
+		quotas[*peerId] = usage
+	}
+	usage.add(now, 0)
+	return usage
+}
+
+func quotasLoad() {
+	if *quotasPath == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(*quotasPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			govpn.LogEvent("quotas_failed").Err(err).Error("Unable to read quotas")
+		}
+		return
+	}
+	state := make(quotasState)
+	if err = yaml.Unmarshal(data, &state); err != nil {
+		govpn.LogEvent("quotas_failed").Err(err).Error("Unable to parse quotas")
+		return
+	}
+	quotasLock.Lock()
+	for idRaw, usage := range state {
+		peerId, err := govpn.PeerIdFromString(idRaw)
+		if err != nil || usage == nil {
+			govpn.LogEvent("quotas_failed").Field("usage", idRaw).Warn("Invalid quota usage")
+			continue
+		}
+		quotas[*peerId] = usage
+	}
+	quotasLock.Unlock()
+}
+
+// Atomically save all peers usage to the state file. quotasLock must
+// be held.
+func quotasSave() {
+	if *quotasPath == "" {
+		return
+	}
+	state := make(quotasState, len(quotas))
+	for peerId, usage := range quotas {
+		state[peerId.String()] = usage
+	}
+	data, err := yaml.Marshal(state)
+	if err != nil {
+		govpn.LogEvent("quotas_failed").Err(err).Error("Unable to serialize quotas")
+		return
+	}
+	tmpPath := *quotasPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, os.FileMode(0600)); err != nil {
+		govpn.LogEvent("quotas_failed").Err(err).Error("Unable to write quotas")
+		return
+	}
+	if err = os.Rename(tmpPath, *quotasPath); err != nil {
+		govpn.LogEvent("quotas_failed").Err(err).Error("Unable to write quotas")
+	}
+}
+
+// Take traffic passed since the previous call into account. quotasLock
+// must be held.
+func quotaAccount(peer *govpn.Peer, now time.Time) {
+	total := atomic.LoadUint64(&peer.BytesIn) + atomic.LoadUint64(&peer.BytesOut)
+	quotaUsageGet(peer.Id, now).add(now, total-quotasSeen[peer])
+	quotasSeen[peer] = total
+}
+
+// Account traffic of all peers and save the state.
+func quotasAccount() {
+	now := time.Now()
+	peersLock.RLock()
+	quotasLock.Lock()
+	for _, ps := range peers {
+		quotaAccount(ps.peer, now)
+	}
+	peersLock.RUnlock()
+	quotasSave()
+	quotasLock.Unlock()
+}
+
+// Account the rest of traffic of the peer, that is deleted or replaced
+// by rehandshake, and forget it.
+func quotaPeerGone(peer *govpn.Peer) {
+	quotasLock.Lock()
+	quotaAccount(peer, time.Now())
+	delete(quotasSeen, peer)
+	quotasLock.Unlock()
+}
+
+// Rate limit of the throttled peer: the lowest of the configured and
+// quota's ones.
+func quotaRate(conf *govpn.PeerConf, rate int) int {
+	throttle := conf.Quota.Rate
+	if throttle == 0 {
+		throttle = govpn.QuotaRateDefault
+	}
+	if rate == 0 || rate > throttle {
+		return throttle
+	}
+	return rate
+}
+
+// Apply peer's rate limits, throttling it if its quota is exhausted.
+// Returns false if the peer has to be disconnected instead.
+func quotaEnforce(peer *govpn.Peer) bool {
+	conf := confs[*peer.Id]
+	if conf == nil {
+		return true
+	}
+	quotasLock.Lock()
+	usage := quotaUsageGet(peer.Id, time.Now())
+	exhausted := usage.exhausted(conf)
+	throttled := usage.throttled
+	usage.throttled = exhausted && conf.Quota.Action == govpn.QuotaThrottle
+	quotasLock.Unlock()
+	if !exhausted {
+		if throttled {
+			govpn.LogEvent("quota_unthrottled").Peer(peer).Info("Peer is not throttled anymore")
+		}
+		peer.RateLimit(conf.Rate.In, conf.Rate.Out)
+		return true
+	}
+	if conf.Quota.Action != govpn.QuotaThrottle {
+		return false
+	}
+	if !throttled {
+		govpn.LogEvent("quota_throttled").Peer(peer).Info("Quota exceeded, throttling peer")
+	}
+	peer.RateLimit(quotaRate(conf, conf.Rate.In), quotaRate(conf, conf.Rate.Out))
+	return true
+}
+
+// Is the peer's quota exhausted and it has to be disconnected.
+func quotaExceeded(peerId *govpn.PeerId) bool {
+	conf := confs[*peerId]
+	if conf == nil || conf.Quota.Action == govpn.QuotaThrottle {
+		return false
+	}
+	quotasLock.Lock()
+	defer quotasLock.Unlock()
+	return quotaUsageGet(peerId, time.Now()).exhausted(conf)
+}
+
+// Periodically account peers traffic and enforce their quotas.
+func quotasCheck() {
+	for {
+		time.Sleep(QuotaCheckRate)
+		quotasAccount()
+		var kick []*govpn.PeerId
+		peersLock.RLock()
+		for _, ps := range peers {
+			if !quotaEnforce(ps.peer) {
+				kick = append(kick, ps.peer.Id)
+			}
+		}
+		peersLock.RUnlock()
+		for _, peerId := range kick {
+			logPeerId("quota_exceeded", peerId).Info("Quota exceeded, disconnecting peer")
+			peerKick(peerId)
+		}
+	}
+}
+
+// Current usage for the stats server.
+func quotasMetrics() []govpn.StatsMetric {
+	now := time.Now()
+	var daily, monthly []govpn.StatsMetric
+	quotasLock.Lock()
+	for peerId, usage := range quotas {
+		usage.add(now, 0)
+		labels := map[string]string{"peer_id": peerId.String()}
+		if conf := confs[peerId]; conf != nil {
+			labels["name"] = conf.Name
+		}
+		daily = append(daily, govpn.StatsMetric{
+			Name:   "govpn_peer_quota_daily_bytes",
+			Help:   "Traffic used by the peer during current day",
+			Type:   "gauge",
+			Labels: labels,
+			Value:  float64(usage.DayBytes),
+		})
+		monthly = append(monthly, govpn.StatsMetric{
+			Name:   "govpn_peer_quota_monthly_bytes",
+			Help:   "Traffic used by the peer during current month",
+			Type:   "gauge",
+			Labels: labels,
+			Value:  float64(usage.MonthBytes),
+		})
+	}
+	quotasLock.Unlock()
+	return append(daily, monthly...)
+}
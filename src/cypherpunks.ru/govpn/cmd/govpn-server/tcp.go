@@ -20,7 +20,7 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"io"
 	"net"
 	"time"
 
@@ -30,18 +30,18 @@ import (
 func startTCP() {
 	bind, err := net.ResolveTCPAddr("tcp", *bindAddr)
 	if err != nil {
-		log.Fatalln("Can not resolve bind address:", err)
+		govpn.LogEvent("bind_failed").Err(err).Fatal("Can not resolve bind address")
 	}
 	listener, err := net.ListenTCP("tcp", bind)
 	if err != nil {
-		log.Fatalln("Can not listen on TCP:", err)
+		govpn.LogEvent("bind_failed").Err(err).Fatal("Can not listen on TCP")
 	}
-	log.Println("Listening on TCP:" + *bindAddr)
+	govpn.LogEvent("listening").Addr(*bindAddr).Field("proto", "tcp").Info("Listening on TCP")
 	go func() {
 		for {
 			conn, err := listener.AcceptTCP()
 			if err != nil {
-				log.Println("Error accepting TCP:", err)
+				govpn.LogEvent("accept_failed").Err(err).Error("Error accepting TCP")
 				continue
 			}
 			go handleTCP(conn)
@@ -49,6 +49,16 @@ func startTCP() {
 	}()
 }
 
+// Connection, that returns already read data first.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func handleTCP(conn net.Conn) {
 	addr := conn.RemoteAddr().String()
 	buf := make([]byte, govpn.EnclessEnlargeSize+2*govpn.MTUMax)
@@ -59,7 +69,11 @@ func handleTCP(conn net.Conn) {
 	var ps *PeerState
 	var peer *govpn.Peer
 	var tap *govpn.TAP
+	var port *govpn.SwitchPort
 	var conf *govpn.PeerConf
+	// Why the peer is not identified yet
+	var lookupErr error
+	var lookupPeerId *govpn.PeerId
 	for {
 		if prev == len(buf) {
 			break
@@ -71,35 +85,89 @@ func handleTCP(conn net.Conn) {
 			break
 		}
 		prev += n
-		peerId := idsCache.Find(buf[:prev])
-		if peerId == nil {
-			continue
+		var peerId *govpn.PeerId
+		if hs == nil {
+			var t govpn.Transport
+			var msg []byte
+			var consumed int
+			t, msg, consumed, peerId, lookupErr = transportDetect(buf[:prev], false)
+			if lookupErr != nil {
+				lookupPeerId = peerId
+				continue
+			}
+			if peerId == nil {
+				continue
+			}
+			// Further data goes through the transport
+			if consumed < prev {
+				rest := make([]byte, prev-consumed)
+				copy(rest, buf[consumed:prev])
+				conn = &prefixConn{conn, io.MultiReader(bytes.NewReader(rest), conn)}
+			}
+			conn = govpn.TransportWrap(t, conn, true)
+			copy(buf, msg)
+			prev = len(msg)
+		} else {
+			peerId = idsCache.Find(buf[:prev])
+			if peerId == nil {
+				continue
+			}
+		}
+		if banned(peerId) {
+			logPeerId("handshake_banned", peerId).Addr(addr).Warn("Banned peer handshake")
+			break
+		}
+		if quotaExceeded(peerId) {
+			logPeerId("handshake_quota_exceeded", peerId).Addr(addr).Warn("Quota exceeded peer handshake")
+			break
+		}
+		if lockedOut(addr, peerId) {
+			logPeerId("handshake_locked_out", peerId).Addr(addr).Warn("Locked out peer handshake")
+			break
 		}
 		if hs == nil {
 			conf = confs[*peerId]
 			if conf == nil {
-				log.Println("Can not get peer configuration:", peerId.String())
+				logPeerId("conf_missing", peerId).Addr(addr).Error("Can not get peer configuration")
+				break
+			}
+			if !hsAcquire(addr) {
 				break
 			}
 			hs = govpn.NewHandshake(addr, conn, conf)
 		}
-		peer = hs.Server(buf[:prev])
+		peer, err = hs.Server(buf[:prev])
 		prev = 0
+		if err != nil {
+			hsFailed(err)
+			lockoutFailed(addr, hs.Conf.Id, err)
+			break
+		}
 		if peer == nil {
 			continue
 		}
 		hs.Zero()
-		log.Println("Peer handshake finished:", addr, peer.Id.String())
+		govpn.LogEvent("handshake_finished").Peer(peer).Info("Peer handshake finished")
+		lockoutReset(peer.Id)
+		if !quotaEnforce(peer) {
+			govpn.LogEvent("handshake_quota_exceeded").Peer(peer).Warn("Quota exceeded peer handshake")
+			peer.Zero()
+			peer = nil
+			break
+		}
 		peersByIdLock.RLock()
 		addrPrev, exists := peersById[*peer.Id]
 		peersByIdLock.RUnlock()
 		if exists {
 			peersLock.Lock()
+			quotaPeerGone(peers[addrPrev].peer)
 			peers[addrPrev].terminator <- struct{}{}
 			tap = peers[addrPrev].tap
+			port = peers[addrPrev].port
 			ps = &PeerState{
 				peer:       peer,
 				tap:        tap,
+				port:       port,
 				terminator: make(chan struct{}),
 			}
 			go peerReady(*ps)
@@ -113,22 +181,26 @@ func handleTCP(conn net.Conn) {
 			peersLock.Unlock()
 			peersByIdLock.Unlock()
 			kpLock.Unlock()
-			log.Println("Rehandshake processed:", peer.Id.String())
+			envPush(peer, peerEnv(confs[*peer.Id]))
+			govpn.LogEvent("peer_rehandshaked").Peer(peer).Info("Rehandshake processed")
 		} else {
-			ifaceName, err := callUp(peer.Id, peer.Addr)
+			env := peerEnv(confs[*peer.Id])
+			ifaceName, err := callUp(peer.Id, peer.Addr, env)
 			if err != nil {
 				peer = nil
 				break
 			}
-			tap, err = govpn.TAPListen(ifaceName, peer.MTU)
+			tap, err = govpn.TAPListen(ifaceName, peer.Mode, peer.MTU)
 			if err != nil {
-				log.Println("Unable to create TAP:", err)
+				govpn.LogEvent("tap_failed").Peer(peer).Err(err).Error("Unable to create TAP")
 				peer = nil
 				break
 			}
+			port = switchPortAdd(tap)
 			ps = &PeerState{
 				peer:       peer,
 				tap:        tap,
+				port:       port,
 				terminator: make(chan struct{}, 1),
 			}
 			go peerReady(*ps)
@@ -141,12 +213,20 @@ func handleTCP(conn net.Conn) {
 			peersLock.Unlock()
 			peersByIdLock.Unlock()
 			kpLock.Unlock()
-			log.Println("Peer created:", peer.Id.String())
+			envPush(peer, env)
+			govpn.LogEvent("peer_created").Peer(peer).Info("Peer created")
 		}
 		break
 	}
+	if hs == nil && lookupErr != nil {
+		hsLookupFailed(addr, lookupPeerId, lookupErr)
+	}
 	if hs != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && peer == nil {
+			hsFailed(hs.Expire())
+		}
 		hs.Zero()
+		hsRelease(addr)
 	}
 	if peer == nil {
 		return
@@ -175,10 +255,9 @@ func handleTCP(conn net.Conn) {
 		if i == -1 {
 			continue
 		}
-		if !peer.PktProcess(buf[:i+govpn.NonceSize], tap, false) {
-			log.Println(
+		if !peer.PktProcess(buf[:i+govpn.NonceSize], port, false) {
+			govpn.LogEvent("peer_unauthenticated").Peer(peer).Warn(
 				"Unauthenticated packet, dropping connection",
-				addr, peer.Id.String(),
 			)
 			break
 		}
@@ -0,0 +1,55 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"cypherpunks.ru/govpn"
+)
+
+func startTLS() {
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		govpn.LogEvent("tls_failed").Err(err).Fatal("Can not load TLS certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		govpn.LogEvent("tls_failed").Err(err).Fatal("Can not parse TLS certificate")
+	}
+	listener, err := tls.Listen("tcp", *bindAddr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		govpn.LogEvent("bind_failed").Err(err).Fatal("Can not listen on TLS")
+	}
+	govpn.LogEvent("listening").Addr(*bindAddr).Field("proto", "tls").Info("Listening on TLS")
+	govpn.LogEvent("tls_spki").Field("spki", govpn.SPKIHash(leaf)).Info("TLS certificate SPKI hash")
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				govpn.LogEvent("accept_failed").Err(err).Error("Error accepting TLS")
+				continue
+			}
+			go handleTCP(conn)
+		}
+	}()
+}
@@ -19,21 +19,58 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"log"
+	"bytes"
 	"net"
 
 	"cypherpunks.ru/govpn"
 )
 
 type UDPSender struct {
-	conn *net.UDPConn
-	addr *net.UDPAddr
+	conn      *net.UDPConn
+	addr      *net.UDPAddr
+	transport govpn.Transport
 }
 
 func (c UDPSender) Write(data []byte) (int, error) {
+	if c.transport != nil {
+		msg, err := c.transport.Encode(data, true)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = c.conn.WriteToUDP(msg, c.addr); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
 	return c.conn.WriteToUDP(data, c.addr)
 }
 
+// Decode datagram with the transport, if it is not plain one.
+func udpDecode(t govpn.Transport, data []byte) []byte {
+	if t == nil {
+		return data
+	}
+	msg, err := t.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// Plain transport is represented as nil, for avoiding needless copying.
+func udpTransport(t govpn.Transport) govpn.Transport {
+	if plain, _ := govpn.TransportGet(govpn.TransportPlain); t == plain {
+		return nil
+	}
+	return t
+}
+
+const (
+	// Enough for encryptionless packets of maximal MTU, with the
+	// handshake cookie and transport's framing
+	udpBufSize = govpn.EnclessEnlargeSize + govpn.MTUMax + govpn.CookieSize + govpn.TransportOverheadMax
+)
+
 var (
 	// Buffers for UDP parallel processing
 	udpBufs chan []byte = make(chan []byte, 1<<8)
@@ -42,15 +79,15 @@ var (
 func startUDP() {
 	bind, err := net.ResolveUDPAddr("udp", *bindAddr)
 	if err != nil {
-		log.Fatalln("Can not resolve bind address:", err)
+		govpn.LogEvent("bind_failed").Err(err).Fatal("Can not resolve bind address")
 	}
 	conn, err := net.ListenUDP("udp", bind)
 	if err != nil {
-		log.Fatalln("Can not listen on UDP:", err)
+		govpn.LogEvent("bind_failed").Err(err).Fatal("Can not listen on UDP")
 	}
-	log.Println("Listening on UDP:" + *bindAddr)
+	govpn.LogEvent("listening").Addr(*bindAddr).Field("proto", "udp").Info("Listening on UDP")
 
-	udpBufs <- make([]byte, govpn.MTUMax)
+	udpBufs <- make([]byte, udpBufSize)
 	go func() {
 		var buf []byte
 		var raddr *net.UDPAddr
@@ -64,11 +101,14 @@ func startUDP() {
 		var peerId *govpn.PeerId
 		var peer *govpn.Peer
 		var conf *govpn.PeerConf
+		var transport govpn.Transport
+		var data []byte
+		var sender UDPSender
 		for {
 			buf = <-udpBufs
 			n, raddr, err = conn.ReadFromUDP(buf)
 			if err != nil {
-				log.Println("Unexpected error when receiving", err)
+				govpn.LogEvent("receive_failed").Err(err).Error("Unexpected error when receiving")
 				break
 			}
 			addr = raddr.String()
@@ -79,10 +119,12 @@ func startUDP() {
 			if !exists {
 				goto CheckHandshake
 			}
-			go func(ps *govpn.Peer, tap *govpn.TAP, buf []byte, n int) {
-				peer.PktProcess(buf[:n], tap, true)
+			go func(ps *PeerState, buf []byte, n int) {
+				if data := udpDecode(ps.transport, buf[:n]); data != nil {
+					ps.peer.PktProcess(data, ps.port, true)
+				}
 				udpBufs <- buf
-			}(ps.peer, ps.tap, buf, n)
+			}(ps, buf, n)
 			continue
 		CheckHandshake:
 			hsLock.RLock()
@@ -91,31 +133,49 @@ func startUDP() {
 			if !exists {
 				goto CheckID
 			}
-			peer = hs.Server(buf[:n])
+			transport, _ = govpn.TransportGet(hs.Conf.Transport)
+			transport = udpTransport(transport)
+			data = udpDecode(transport, buf[:n])
+			if data == nil {
+				goto Finished
+			}
+			peer, err = hs.Server(data)
 			if peer == nil {
+				hsFailed(err)
+				lockoutFailed(addr, hs.Conf.Id, err)
 				goto Finished
 			}
 
-			log.Println("Peer handshake finished:", addr, peer.Id.String())
+			govpn.LogEvent("handshake_finished").Peer(peer).Info("Peer handshake finished")
+			lockoutReset(peer.Id)
 			hs.Zero()
 			hsLock.Lock()
 			delete(handshakes, addr)
 			hsLock.Unlock()
+			hsRelease(addr)
+			if !quotaEnforce(peer) {
+				govpn.LogEvent("handshake_quota_exceeded").Peer(peer).Warn("Quota exceeded peer handshake")
+				peer.Zero()
+				goto Finished
+			}
 
 			go func() {
-				udpBufs <- make([]byte, govpn.MTUMax)
-				udpBufs <- make([]byte, govpn.MTUMax)
+				udpBufs <- make([]byte, udpBufSize)
+				udpBufs <- make([]byte, udpBufSize)
 			}()
 			peersByIdLock.RLock()
 			addrPrev, exists = peersById[*peer.Id]
 			peersByIdLock.RUnlock()
 			if exists {
 				peersLock.Lock()
+				quotaPeerGone(peers[addrPrev].peer)
 				peers[addrPrev].terminator <- struct{}{}
 				ps = &PeerState{
 					peer:       peer,
 					tap:        peers[addrPrev].tap,
+					port:       peers[addrPrev].port,
 					terminator: make(chan struct{}),
+					transport:  transport,
 				}
 				go func(ps PeerState) {
 					peerReady(ps)
@@ -132,22 +192,26 @@ func startUDP() {
 				peersLock.Unlock()
 				peersByIdLock.Unlock()
 				kpLock.Unlock()
-				log.Println("Rehandshake processed:", peer.Id.String())
+				envPush(peer, peerEnv(confs[*peer.Id]))
+				govpn.LogEvent("peer_rehandshaked").Peer(peer).Info("Rehandshake processed")
 			} else {
-				go func(addr string, peer *govpn.Peer) {
-					ifaceName, err := callUp(peer.Id, peer.Addr)
+				go func(addr string, peer *govpn.Peer, transport govpn.Transport) {
+					env := peerEnv(confs[*peer.Id])
+					ifaceName, err := callUp(peer.Id, peer.Addr, env)
 					if err != nil {
 						return
 					}
-					tap, err := govpn.TAPListen(ifaceName, peer.MTU)
+					tap, err := govpn.TAPListen(ifaceName, peer.Mode, peer.MTU)
 					if err != nil {
-						log.Println("Unable to create TAP:", err)
+						govpn.LogEvent("tap_failed").Peer(peer).Err(err).Error("Unable to create TAP")
 						return
 					}
 					ps = &PeerState{
 						peer:       peer,
 						tap:        tap,
+						port:       switchPortAdd(tap),
 						terminator: make(chan struct{}),
+						transport:  transport,
 					}
 					go func(ps PeerState) {
 						peerReady(ps)
@@ -163,27 +227,52 @@ func startUDP() {
 					peersLock.Unlock()
 					peersByIdLock.Unlock()
 					kpLock.Unlock()
-					log.Println("Peer created:", peer.Id.String())
-				}(addr, peer)
+					envPush(peer, env)
+					govpn.LogEvent("peer_created").Peer(peer).Info("Peer created")
+				}(addr, peer, transport)
 			}
 			goto Finished
 		CheckID:
-			peerId = idsCache.Find(buf[:n])
+			transport, data, _, peerId, err = transportDetect(buf[:n], true)
+			if err != nil {
+				hsLookupFailed(addr, peerId, err)
+				goto Finished
+			}
 			if peerId == nil {
-				log.Println("Unknown identity from:", addr)
+				goto Finished
+			}
+			transport = udpTransport(transport)
+			if banned(peerId) {
+				logPeerId("handshake_banned", peerId).Addr(addr).Warn("Banned peer handshake")
+				goto Finished
+			}
+			if quotaExceeded(peerId) {
+				logPeerId("handshake_quota_exceeded", peerId).Addr(addr).Warn("Quota exceeded peer handshake")
+				goto Finished
+			}
+			if lockedOut(addr, peerId) {
+				logPeerId("handshake_locked_out", peerId).Addr(addr).Warn("Locked out peer handshake")
 				goto Finished
 			}
 			conf = confs[*peerId]
 			if conf == nil {
-				log.Println("Unable to get peer configuration:", peerId.String())
+				logPeerId("conf_missing", peerId).Addr(addr).Error("Unable to get peer configuration")
+				goto Finished
+			}
+			sender = UDPSender{conn: conn, addr: raddr, transport: transport}
+			if data = hsCookieCheck(addr, sender, conf, data); data == nil {
+				goto Finished
+			}
+			if !hsAcquire(addr) {
+				goto Finished
+			}
+			hs = govpn.NewHandshake(addr, sender, conf)
+			if _, err = hs.Server(data); err != nil {
+				hsRelease(addr)
+				hsFailed(err)
+				lockoutFailed(addr, conf.Id, err)
 				goto Finished
 			}
-			hs = govpn.NewHandshake(
-				addr,
-				UDPSender{conn: conn, addr: raddr},
-				conf,
-			)
-			hs.Server(buf[:n])
 			hsLock.Lock()
 			handshakes[addr] = hs
 			hsLock.Unlock()
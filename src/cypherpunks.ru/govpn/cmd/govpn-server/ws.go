@@ -0,0 +1,72 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"io"
+	"net/http"
+
+	"cypherpunks.ru/govpn"
+)
+
+// Page served to everyone, except for GoVPN clients, if no decoy
+// directory is specified.
+const wsDecoyPage = `<!DOCTYPE html>
+<html><head><title>Welcome</title></head>
+<body><h1>It works!</h1></body></html>
+`
+
+type wsHandler struct {
+	decoy http.Handler
+}
+
+func (h wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != *wsPath || !govpn.WSIsUpgrade(r) {
+		h.decoy.ServeHTTP(w, r)
+		return
+	}
+	conn, err := govpn.WSUpgrade(w, r)
+	if err != nil {
+		govpn.LogEvent("ws_failed").Addr(r.RemoteAddr).Err(err).Warn("WebSocket upgrade failed")
+		return
+	}
+	go handleTCP(conn)
+}
+
+func wsStart() {
+	h := wsHandler{}
+	if *wsDecoy == "" {
+		h.decoy = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, wsDecoyPage)
+		})
+	} else {
+		h.decoy = http.FileServer(http.Dir(*wsDecoy))
+	}
+	govpn.LogEvent("ws_listening").Addr(*wsAddr).Info("WebSocket listening")
+	s := &http.Server{
+		Addr:    *wsAddr,
+		Handler: h,
+	}
+	govpn.LogEvent("ws_stopped").Err(s.ListenAndServe()).Error("WebSocket stopped")
+}
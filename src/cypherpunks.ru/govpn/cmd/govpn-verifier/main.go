@@ -23,7 +23,8 @@ import (
 	"bytes"
 	"flag"
 	"fmt"
-	"log"
+	"os"
+	"time"
 
 	"cypherpunks.ru/govpn"
 )
@@ -31,13 +32,100 @@ import (
 var (
 	keyPath  = flag.String("key", "", "Path to passphrase file")
 	verifier = flag.String("verifier", "", "Optional verifier")
-	mOpt     = flag.Int("m", govpn.DefaultM, "Argon2d memory parameter (KiBs)")
-	tOpt     = flag.Int("t", govpn.DefaultT, "Argon2d iteration parameter")
-	pOpt     = flag.Int("p", govpn.DefaultP, "Argon2d parallelizm parameter")
+	alg      = flag.String("alg", govpn.VerifierAlgDefault, "Password hashing algorithm: argon2id or argon2d")
+	mOpt     = flag.Int("m", govpn.DefaultM, "Password hashing memory parameter (KiBs)")
+	tOpt     = flag.Int("t", govpn.DefaultT, "Password hashing iteration parameter")
+	pOpt     = flag.Int("p", govpn.DefaultP, "Password hashing parallelizm parameter")
+	upgrade  = flag.Bool("upgrade", false, "Derive new verifier from the passphrase of the specified one")
+	calib    = flag.Bool("calibrate", false, "Find password hashing parameters for the target time")
+	calibT   = flag.Duration("calibrate-time", time.Second, "Target password hashing time")
+	calibM   = flag.Int("calibrate-mem", 1<<16, "Password hashing memory budget (KiBs)")
+	calibS   = flag.Float64("calibrate-slower", 10, "How many times the slowest client is slower than this machine")
+	apply    = flag.Bool("apply", false, "Generate or upgrade verifier with calibrated parameters")
+	keyGen   = flag.Bool("ed25519", false, "Generate random Ed25519 keypair instead of passphrase-derived one")
+	keyFile  = flag.String("keyfile", "", "Path to Ed25519 private key file")
+	encrypt  = flag.Bool("encrypt", false, "Encrypt generated private key file with passphrase")
+	identity = flag.Bool("identity", false, "Generate server's identity key file and print its public key")
 	egdPath  = flag.String("egd", "", "Optional path to EGD socket")
 	warranty = flag.Bool("warranty", false, "Print warranty information")
 )
 
+func keyFileGen(pid *govpn.PeerId) {
+	if *keyFile == "" {
+		govpn.LogEvent("conf_invalid").Fatal("No key file specified")
+	}
+	var passphrase string
+	var err error
+	if *encrypt {
+		if passphrase, err = govpn.KeyRead(*keyPath); err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key")
+		}
+	}
+	v, prv, err := govpn.VerifierNewEd25519(pid)
+	if err != nil {
+		govpn.LogEvent("key_failed").Err(err).Fatal("Unable to generate Ed25519 keypair")
+	}
+	defer govpn.SliceZero(prv[:])
+	data, err := govpn.KeyFileEncode(prv, passphrase)
+	if err != nil {
+		govpn.LogEvent("key_failed").Err(err).Fatal("Unable to encode the key file")
+	}
+	fd, err := os.OpenFile(*keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		govpn.LogEvent("key_failed").Err(err).Fatal("Unable to create the key file")
+	}
+	if _, err = fd.Write([]byte(data + "\n")); err != nil {
+		govpn.LogEvent("key_failed").Err(err).Fatal("Unable to write the key file")
+	}
+	if err = fd.Close(); err != nil {
+		govpn.LogEvent("key_failed").Err(err).Fatal("Unable to write the key file")
+	}
+	if *identity {
+		fmt.Println(govpn.KeyPubString(prv))
+		return
+	}
+	fmt.Println(v.LongForm())
+	fmt.Println(v.ShortForm())
+}
+
+// Generate new random peer identity.
+func peerIdGen() *govpn.PeerId {
+	id := new([govpn.IDSize]byte)
+	if _, err := govpn.Rand.Read(id[:]); err != nil {
+		govpn.LogEvent("random_failed").Err(err).Fatal("Error reading random for identity")
+	}
+	pid := govpn.PeerId(*id)
+	return &pid
+}
+
+// Generate password based verifier for the new identity.
+func passwordVerifierGen(key string) {
+	v := govpn.VerifierNewAlg(*alg, *mOpt, *tOpt, *pOpt, peerIdGen())
+	v.PasswordApply(key)
+	fmt.Println(v.LongForm())
+	fmt.Println(v.ShortForm())
+}
+
+// Calibrate password hashing parameters on the current machine and
+// report them. They are used for verifier generation afterwards.
+func calibrate() {
+	v, took, err := govpn.VerifierCalibrate(*alg, *calibT, *calibM, *pOpt)
+	if err != nil {
+		govpn.LogEvent("calibrate_failed").Err(err).Fatal("Unable to calibrate")
+	}
+	*mOpt, *tOpt = v.M, v.T
+	fmt.Fprintf(
+		os.Stderr, "%s with m=%d KiB, t=%d, p=%d takes %s here, about %s on %g times slower client\n",
+		v.Alg, v.M, v.T, v.P,
+		took.Round(time.Millisecond),
+		time.Duration(float64(took)**calibS).Round(time.Millisecond),
+		*calibS,
+	)
+	if !*apply {
+		fmt.Printf("-alg %s -m %d -t %d -p %d\n", v.Alg, v.M, v.T, v.P)
+	}
+}
+
 func main() {
 	flag.Parse()
 	if *warranty {
@@ -47,30 +135,60 @@ func main() {
 	if *egdPath != "" {
 		govpn.EGDInit(*egdPath)
 	}
-	key, err := govpn.KeyRead(*keyPath)
-	if err != nil {
-		log.Fatalln("Unable to read the key", err)
+	if !govpn.VerifierPasswordBased(*alg) {
+		govpn.LogEvent("conf_invalid").Field("alg", *alg).Fatal("Unknown password hashing algorithm")
+	}
+	if *calib {
+		if *apply && *verifier != "" && !*upgrade {
+			govpn.LogEvent("conf_invalid").Fatal("Calibrated parameters can be applied only to new or upgraded verifier")
+		}
+		calibrate()
+		if !*apply {
+			return
+		}
 	}
 	if *verifier == "" {
-		id := new([govpn.IDSize]byte)
-		if _, err := govpn.Rand.Read(id[:]); err != nil {
-			log.Fatalln(err)
+		if *keyGen || *identity {
+			keyFileGen(peerIdGen())
+			return
 		}
-		pid := govpn.PeerId(*id)
-		v := govpn.VerifierNew(*mOpt, *tOpt, *pOpt, &pid)
-		v.PasswordApply(key)
-		fmt.Println(v.LongForm())
-		fmt.Println(v.ShortForm())
+		key, err := govpn.KeyRead(*keyPath)
+		if err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key")
+		}
+		passwordVerifierGen(key)
 		return
 	}
 	v, err := govpn.VerifierFromString(*verifier)
 	if err != nil {
-		log.Fatalln("Can not decode verifier", err)
+		govpn.LogEvent("conf_invalid").Err(err).Fatal("Can not decode verifier")
 	}
 	if v.Pub == nil {
-		log.Fatalln("Verifier does not contain public key")
+		govpn.LogEvent("conf_invalid").Fatal("Verifier does not contain public key")
 	}
 	pub := *v.Pub
-	v.PasswordApply(key)
+	if *upgrade && !govpn.VerifierPasswordBased(v.Alg) {
+		govpn.LogEvent("conf_invalid").Field("alg", v.Alg).Fatal("Only password based verifier can be upgraded")
+	}
+	if v.Alg == govpn.VerifierEd25519 {
+		prv, err := govpn.KeyFileRead(*keyFile, *keyPath)
+		if err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key file")
+		}
+		v.KeyApply(prv)
+	} else {
+		key, err := govpn.KeyRead(*keyPath)
+		if err != nil {
+			govpn.LogEvent("key_failed").Err(err).Fatal("Unable to read the key")
+		}
+		v.PasswordApply(key)
+		if *upgrade {
+			if !bytes.Equal(v.Pub[:], pub[:]) {
+				govpn.LogEvent("key_invalid").Fatal("Passphrase does not match the verifier")
+			}
+			passwordVerifierGen(key)
+			return
+		}
+	}
 	fmt.Println(bytes.Equal(v.Pub[:], pub[:]))
 }
@@ -19,7 +19,6 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
-	"log"
 	"os"
 	"os/exec"
 	"runtime"
@@ -30,9 +29,24 @@ const (
 	EtherSize      = 14
 	MTUMax         = 9000 + EtherSize + 1
 	MTUDefault     = 1500 + EtherSize + 1
+	MTUDefaultTUN  = 1500 + 1
+
+	// Interface modes: layer-2 TAP carries Ethernet frames, layer-3 TUN
+	// carries bare IP packets
+	ModeTAP = "tap"
+	ModeTUN = "tun"
+	// Minimal IP packet length (IPv4 header without options)
+	IPHeaderMinSize = 20
 
 	ENV_IFACE  = "GOVPN_IFACE"
 	ENV_REMOTE = "GOVPN_REMOTE"
+	ENV_EVENT  = "GOVPN_EVENT"
+
+	// Events passed to client's up/down-scripts
+	EventUp           = "up"
+	EventDown         = "down"
+	EventReconnecting = "reconnecting"
+	EventReconnected  = "reconnected"
 )
 
 var (
@@ -44,6 +58,12 @@ var (
 // that will be the first argument when calling it. Function will return
 // it's output and possible error.
 func ScriptCall(path, ifaceName, remoteAddr string) ([]byte, error) {
+	return ScriptCallEnv(path, ifaceName, remoteAddr, nil)
+}
+
+// Same as ScriptCall, but additional environment variables are passed
+// to the script.
+func ScriptCallEnv(path, ifaceName, remoteAddr string, env map[string]string) ([]byte, error) {
 	if path == "" {
 		return nil, nil
 	}
@@ -51,15 +71,32 @@ func ScriptCall(path, ifaceName, remoteAddr string) ([]byte, error) {
 		return nil, err
 	}
 	cmd := exec.Command(path)
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
 	cmd.Env = append(cmd.Env, ENV_IFACE+"="+ifaceName)
 	cmd.Env = append(cmd.Env, ENV_REMOTE+"="+remoteAddr)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Println("Script error", path, err, string(out))
+		LogEvent("script_failed").Err(err).Field("script", path).Field("output", string(out)).Error("Script error")
 	}
 	return out, err
 }
 
+// Check that interface mode is known. Empty mode means TAP.
+func ModeValid(mode string) bool {
+	return mode == "" || mode == ModeTAP || mode == ModeTUN
+}
+
+// Default MTU for the given interface mode. TUN frames lack Ethernet
+// header, so they are EtherSize bytes shorter.
+func MTUDefaultFor(mode string) int {
+	if mode == ModeTUN {
+		return MTUDefaultTUN
+	}
+	return MTUDefault
+}
+
 // Zero each byte.
 func SliceZero(data []byte) {
 	for i := 0; i < len(data); i++ {
@@ -25,22 +25,39 @@ import (
 )
 
 type PeerConf struct {
-	Id          *PeerId       `yaml:"-"`
-	Name        string        `yaml:"name"`
-	Iface       string        `yaml:"iface"`
-	MTU         int           `yaml:"mtu"`
-	Up          string        `yaml:"up"`
-	Down        string        `yaml:"down"`
-	TimeoutInt  int           `yaml:"timeout"`
-	Timeout     time.Duration `yaml:"-"`
-	Noise       bool          `yaml:"noise"`
-	CPR         int           `yaml:"cpr"`
-	Encless     bool          `yaml:"encless"`
-	TimeSync    int           `yaml:"timesync"`
-	VerifierRaw string        `yaml:"verifier"`
+	Id          *PeerId           `yaml:"-"`
+	Name        string            `yaml:"name"`
+	Iface       string            `yaml:"iface"`
+	Mode        string            `yaml:"mode"`
+	MTU         int               `yaml:"mtu"`
+	Up          string            `yaml:"up"`
+	Down        string            `yaml:"down"`
+	TimeoutInt  int               `yaml:"timeout"`
+	Timeout     time.Duration     `yaml:"-"`
+	RekeyInt    int               `yaml:"rekey"`
+	Rekey       time.Duration     `yaml:"-"`
+	Noise       bool              `yaml:"noise"`
+	CPR         int               `yaml:"cpr"`
+	Encless     bool              `yaml:"encless"`
+	TimeSync    int               `yaml:"timesync"`
+	VerifierRaw string            `yaml:"verifier"`
+	VerifierOld string            `yaml:"verifier_old"`
+	IP4Pool     string            `yaml:"ip4pool"`
+	IP6Pool     string            `yaml:"ip6pool"`
+	Env         map[string]string `yaml:"env"`
+	Transport   string            `yaml:"transport"`
+	ACLRaw      ACLConf           `yaml:"acl"`
+	Rate        RateConf          `yaml:"rate"`
+	Quota       QuotaConf         `yaml:"quota"`
 
 	// This is passphrase verifier
 	Verifier *Verifier `yaml:"-"`
+	// Parsed access control list, nil if everything is allowed
+	ACL *ACL `yaml:"-"`
 	// This field exists only on client's side
 	DSAPriv *[ed25519.PrivateKeySize]byte `yaml:"-"`
+	// Server's identity key, exists only on server's side
+	ServerPriv *[ed25519.PrivateKeySize]byte `yaml:"-"`
+	// Pinned server's identity public key, exists only on client's side
+	ServerPub *[ed25519.PublicKeySize]byte `yaml:"-"`
 }
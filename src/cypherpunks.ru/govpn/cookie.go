@@ -0,0 +1,165 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/subtle"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/salsa20"
+	"golang.org/x/crypto/xtea"
+)
+
+const (
+	CookieSize = 16
+	// How long the server's cookie secret is used. Cookies remain
+	// valid for up to two lifetimes.
+	CookieLifetime = 30 * time.Second
+)
+
+// Server's stateless handshake cookies. Under the load server does not
+// create the handshake state for the first message of the client.
+// Instead it replies with the cookie: MAC of the client's address and
+// handshake's nonce under the periodically changing secret. Client
+// repeats its message with the cookie appended and only then the DH
+// computation is made. So the client has to receive packets on its
+// address before it can consume server's resources.
+type CookieJar struct {
+	sync.Mutex
+	secrets [2]*[32]byte
+	rotated time.Time
+}
+
+func NewCookieJar() *CookieJar {
+	j := CookieJar{}
+	j.rotate(time.Now())
+	j.rotate(time.Now())
+	return &j
+}
+
+// Replace the previous secret with the current one and generate the
+// new current one. Must be called under the lock.
+func (j *CookieJar) rotate(now time.Time) {
+	secret := new([32]byte)
+	if _, err := Rand.Read(secret[:]); err != nil {
+		LogEvent("random_failed").Err(err).Fatal("Error reading random for cookie secret")
+	}
+	if j.secrets[1] != nil {
+		SliceZero(j.secrets[1][:])
+	}
+	j.secrets[1], j.secrets[0] = j.secrets[0], secret
+	j.rotated = now
+}
+
+func cookieMAC(secret *[32]byte, addr string, rNonce []byte) []byte {
+	mac := blake2b.NewMAC(CookieSize, secret[:])
+	mac.Write([]byte(addr))
+	mac.Write(rNonce)
+	return mac.Sum(nil)
+}
+
+// Cookie for the client's first handshake message from addr.
+func (j *CookieJar) Cookie(addr string, data []byte) []byte {
+	now := time.Now()
+	j.Lock()
+	if j.rotated.Add(CookieLifetime).Before(now) {
+		j.rotate(now)
+	}
+	secret := j.secrets[0]
+	j.Unlock()
+	return cookieMAC(secret, addr, data[:RSize])
+}
+
+// Check the cookie at the end of client's first handshake message
+// (just before its tag). Returns the message without the cookie if it
+// is valid.
+func (j *CookieJar) Check(addr string, data []byte) ([]byte, bool) {
+	if len(data) < RSize+CookieSize+xtea.BlockSize {
+		return nil, false
+	}
+	cookie := data[len(data)-xtea.BlockSize-CookieSize : len(data)-xtea.BlockSize]
+	j.Lock()
+	secrets := j.secrets
+	j.Unlock()
+	valid := 0
+	for _, secret := range secrets {
+		valid |= subtle.ConstantTimeCompare(cookie, cookieMAC(secret, addr, data[:RSize]))
+	}
+	if valid != 1 {
+		return nil, false
+	}
+	msg := make([]byte, 0, len(data)-CookieSize)
+	msg = append(msg, data[:len(data)-xtea.BlockSize-CookieSize]...)
+	return append(msg, data[len(data)-xtea.BlockSize:]...), true
+}
+
+// Reply with the cookie to the client's first handshake message data,
+// without creating the handshake state.
+// ENC(H(DSAPub), R+3, Cookie + Zeros) + IDtag
+func HandshakeChallenge(conn io.Writer, conf *PeerConf, cookie, data []byte) {
+	dsaPubH := blake2b.Sum256(conf.Verifier.Pub[:])
+	defer SliceZero(dsaPubH[:])
+	nonce := rNonceAdd(data[:RSize], 3)
+	var enc []byte
+	if conf.Noise || conf.Encless {
+		enc = make([]byte, conf.MTU-xtea.BlockSize)
+	} else {
+		enc = make([]byte, 2*CookieSize)
+	}
+	copy(enc, cookie)
+	if conf.Encless {
+		var err error
+		enc, err = EnclessEncode(&dsaPubH, nonce, enc)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		salsa20.XORKeyStream(enc, enc, nonce, &dsaPubH)
+	}
+	conn.Write(append(enc, idTag(conf.Id, conf.TimeSync, enc)...))
+}
+
+// Extract the cookie from the server's challenge message. Returns nil
+// if it is not the challenge.
+func (h *Handshake) cookieGet(data []byte) []byte {
+	var dec []byte
+	if h.Conf.Encless {
+		if len(data) != EnclessEnlargeSize+h.Conf.MTU {
+			return nil
+		}
+		var err error
+		dec, err = EnclessDecode(h.dsaPubH, h.rNonceNext(3), data[:len(data)-xtea.BlockSize])
+		if err != nil || len(dec) < 2*CookieSize {
+			return nil
+		}
+	} else {
+		if len(data) < 2*CookieSize+xtea.BlockSize {
+			return nil
+		}
+		dec = make([]byte, 2*CookieSize)
+		salsa20.XORKeyStream(dec, data[:2*CookieSize], h.rNonceNext(3), h.dsaPubH)
+	}
+	if subtle.ConstantTimeCompare(dec[CookieSize:2*CookieSize], make([]byte, CookieSize)) != 1 {
+		return nil
+	}
+	return dec[:CookieSize]
+}
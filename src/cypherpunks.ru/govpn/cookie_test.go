@@ -0,0 +1,83 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+)
+
+func testHandshakeCookie(t *testing.T, conf *PeerConf) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	conf.Verifier = v
+	conf.DSAPriv = v.PasswordApply("does not matter")
+	jar := NewCookieJar()
+	hsC := HandshakeStart("client", Dummy{&testCt}, conf)
+	start := testCt
+	if _, ok := jar.Check("client", start); ok {
+		t.Fatal("message without cookie is accepted")
+	}
+	HandshakeChallenge(Dummy{&testCt}, conf, jar.Cookie("client", start), start)
+	if peer, err := hsC.Client(testCt); peer != nil || err != nil {
+		t.Fatal("challenge is not accepted", err)
+	}
+	if _, ok := jar.Check("elsewhere", testCt); ok {
+		t.Fatal("cookie of another address is accepted")
+	}
+	msg, ok := jar.Check("client", testCt)
+	if !ok {
+		t.Fatal("cookie is not accepted")
+	}
+	hsS := NewHandshake("server", Dummy{&testCt}, conf)
+	if peer, err := hsS.Server(msg); peer != nil || err != nil {
+		t.Fatal("first message is not accepted", err)
+	}
+	hsC.Client(testCt)
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
+		t.Fatal("server has not finished", err)
+	}
+	if peer, err := hsC.Client(testCt); err != nil || peer == nil {
+		t.Fatal("client has not finished", err)
+	}
+}
+
+func TestHandshakeCookie(t *testing.T) {
+	conf := *testConf
+	testHandshakeCookie(t, &conf)
+	conf.Noise = true
+	testHandshakeCookie(t, &conf)
+	conf.Encless = true
+	testHandshakeCookie(t, &conf)
+}
+
+func TestCookieJarRotation(t *testing.T) {
+	jar := NewCookieJar()
+	data := make([]byte, RSize+8)
+	cookie := jar.Cookie("client", data)
+	data = append(data[:RSize], append(cookie, make([]byte, 8)...)...)
+	jar.rotated = jar.rotated.Add(-CookieLifetime - 1)
+	jar.Cookie("client", data)
+	if _, ok := jar.Check("client", data); !ok {
+		t.Fatal("previous secret's cookie is not accepted")
+	}
+	jar.rotated = jar.rotated.Add(-CookieLifetime - 1)
+	jar.Cookie("client", data)
+	if _, ok := jar.Check("client", data); ok {
+		t.Fatal("expired cookie is accepted")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Commands of the server's runtime control socket.
+const (
+	CtlList   = "list"
+	CtlKick   = "kick"
+	CtlReload = "reload"
+	CtlBan    = "ban"
+	CtlUnban  = "unban"
+	CtlRekey  = "rekey"
+)
+
+// Request sent to the control socket. Each connection carries single
+// JSON-encoded request and response.
+type CtlRequest struct {
+	Cmd    string
+	PeerId string `json:",omitempty"`
+	// Ban duration in seconds
+	Duration int `json:",omitempty"`
+}
+
+type CtlPeer struct {
+	Id          string
+	Name        string
+	Addr        string
+	Established time.Time
+	BytesIn     uint64
+	BytesOut    uint64
+}
+
+type CtlBanned struct {
+	Id    string
+	Until time.Time
+}
+
+type CtlResponse struct {
+	Error      string      `json:",omitempty"`
+	Peers      []CtlPeer   `json:",omitempty"`
+	Handshakes []string    `json:",omitempty"`
+	Banned     []CtlBanned `json:",omitempty"`
+}
+
+// Send request to the control socket and wait for the response.
+func CtlCall(path string, req *CtlRequest) (*CtlResponse, error) {
+	conn, err := net.DialTimeout("unix", path, RWTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(RWTimeout))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp CtlResponse
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,168 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Control message with "KEY=VALUE\n" environment lines, pushed by
+	// the server after the handshake
+	CtrlEnv = byte(0x01)
+
+	ENV_IP4_ADDRESS = "INTERNAL_IP4_ADDRESS"
+	ENV_IP4_GATEWAY = "INTERNAL_IP4_GATEWAY"
+	ENV_IP6_ADDRESS = "INTERNAL_IP6_ADDRESS"
+	ENV_IP6_GATEWAY = "INTERNAL_IP6_GATEWAY"
+
+	// Authoritative peer's parameters, pushed by the server
+	ENV_MTU      = "GOVPN_MTU"
+	ENV_NOISE    = "GOVPN_NOISE"
+	ENV_CPR      = "GOVPN_CPR"
+	ENV_ENCLESS  = "GOVPN_ENCLESS"
+	ENV_TIMESYNC = "GOVPN_TIMESYNC"
+	ENV_TIMEOUT  = "GOVPN_TIMEOUT"
+
+	// Prefix of arbitrary variables pushed from peer's configuration
+	ENV_PUSH_PREFIX = "GOVPN_PUSH_"
+)
+
+// Whether environment variable can be pushed by the server: only
+// address pool's, peer's parameters and ENV_PUSH_PREFIX-ed ones are
+// allowed, so server can not influence things like PATH or LD_PRELOAD
+// of client's scripts.
+func EnvPushable(k string) bool {
+	switch k {
+	case ENV_IP4_ADDRESS, ENV_IP4_GATEWAY, ENV_IP6_ADDRESS, ENV_IP6_GATEWAY,
+		ENV_MTU, ENV_NOISE, ENV_CPR, ENV_ENCLESS, ENV_TIMESYNC, ENV_TIMEOUT:
+		return true
+	}
+	return strings.HasPrefix(k, ENV_PUSH_PREFIX) && len(k) > len(ENV_PUSH_PREFIX)
+}
+
+func envKeyValid(k string) bool {
+	return k != "" && !strings.ContainsAny(k, "=\n\x00")
+}
+
+// Serialize environment for CtrlEnv message. Keys are sorted, so
+// output is deterministic.
+func CtrlEnvEncode(env map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(env))
+	for k, v := range env {
+		if !envKeyValid(k) || strings.ContainsAny(v, "\n\x00") {
+			return nil, errors.New("Invalid environment entry: " + k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k + "=" + env[k] + "\n")
+	}
+	return buf.Bytes(), nil
+}
+
+// Parse CtrlEnv message's body.
+func CtrlEnvDecode(data []byte) (map[string]string, error) {
+	env := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || !envKeyValid(kv[0]) || strings.ContainsRune(kv[1], 0) {
+			return nil, errors.New("Invalid environment line")
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, nil
+}
+
+// Peer's parameters in the form of environment, pushed by the server
+// to the client together with other CtrlEnv variables.
+func ParamsEnv(conf *PeerConf) map[string]string {
+	return map[string]string{
+		ENV_MTU:      strconv.Itoa(conf.MTU),
+		ENV_NOISE:    strconv.FormatBool(conf.Noise),
+		ENV_CPR:      strconv.Itoa(conf.CPR),
+		ENV_ENCLESS:  strconv.FormatBool(conf.Encless),
+		ENV_TIMESYNC: strconv.Itoa(conf.TimeSync),
+		ENV_TIMEOUT:  strconv.Itoa(int(conf.Timeout / time.Second)),
+	}
+}
+
+// Apply parameters pushed by the server to the configuration. Missing
+// ones are left intact, nothing is applied if any of them is invalid.
+// Returns true if any of them was changed. ENV_ENCLESS and ENV_TIMESYNC
+// are ignored: they influence the handshake itself, so they are already
+// the same as server's ones, if the push has been received.
+func ParamsApply(conf *PeerConf, env map[string]string) (bool, error) {
+	applied := *conf
+	changed := false
+	intApply := func(key string, dst *int, min, max int) error {
+		v, exists := env[key]
+		if !exists {
+			return nil
+		}
+		i, err := strconv.Atoi(v)
+		if err != nil || i < min || i > max {
+			return errors.New("Invalid " + key + " value: " + v)
+		}
+		if *dst != i {
+			*dst = i
+			changed = true
+		}
+		return nil
+	}
+	boolApply := func(key string, dst *bool) error {
+		v, exists := env[key]
+		if !exists {
+			return nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("Invalid " + key + " value: " + v)
+		}
+		if *dst != b {
+			*dst = b
+			changed = true
+		}
+		return nil
+	}
+	timeout := int(applied.Timeout / time.Second)
+	for _, err := range []error{
+		intApply(ENV_MTU, &applied.MTU, MinPktLength, MTUMax),
+		boolApply(ENV_NOISE, &applied.Noise),
+		intApply(ENV_CPR, &applied.CPR, 0, 1<<20),
+		intApply(ENV_TIMEOUT, &timeout, 1, 1<<20),
+	} {
+		if err != nil {
+			return false, err
+		}
+	}
+	applied.Timeout = time.Second * time.Duration(timeout)
+	*conf = applied
+	return changed, nil
+}
@@ -19,6 +19,8 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"errors"
+
 	"cypherpunks.ru/govpn/aont"
 	"cypherpunks.ru/govpn/cnw"
 )
@@ -53,6 +55,9 @@ func EnclessEncode(authKey *[32]byte, nonce, in []byte) ([]byte, error) {
 
 // Decode EnclessEncode-ed data.
 func EnclessDecode(authKey *[32]byte, nonce, in []byte) ([]byte, error) {
+	if len(in) < EnclessEnlargeSize {
+		return nil, errors.New("Too short encoded data")
+	}
 	var err error
 	winnowed, err := cnw.Winnow(
 		authKey, nonce, in[:aont.RSize*cnw.EnlargeFactor],
@@ -53,6 +53,13 @@ func TestEnclessSymmetric(t *testing.T) {
 	}
 }
 
+func TestEnclessShort(t *testing.T) {
+	nonce := make([]byte, 8)
+	if _, err := EnclessDecode(testKey, nonce, make([]byte, EnclessEnlargeSize-1)); err == nil {
+		t.Fatal("Too short data accepted")
+	}
+}
+
 func BenchmarkEnclessEncode(b *testing.B) {
 	nonce := make([]byte, 8)
 	data := make([]byte, 128)
@@ -22,7 +22,6 @@ import (
 	"crypto/subtle"
 	"encoding/binary"
 	"io"
-	"log"
 	"time"
 
 	"github.com/agl/ed25519"
@@ -38,6 +37,41 @@ const (
 	SSize = 32
 )
 
+// Reason of the handshake failure.
+type HandshakeError struct {
+	Reason string
+	msg    string
+}
+
+func (e *HandshakeError) Error() string {
+	return e.msg
+}
+
+var (
+	HandshakeErrUnknownId          = &HandshakeError{"unknown_id", "Unknown identity"}
+	HandshakeErrTimeSync           = &HandshakeError{"timesync", "Time synchronization mismatch"}
+	HandshakeErrReplay             = &HandshakeError{"replay", "Identification token replay"}
+	HandshakeErrBadLength          = &HandshakeError{"bad_length", "Unexpected handshake message length"}
+	HandshakeErrBadDecode          = &HandshakeError{"bad_decode", "Unable to decode handshake message"}
+	HandshakeErrBadRandom          = &HandshakeError{"bad_random", "Invalid random number"}
+	HandshakeErrBadSignature       = &HandshakeError{"bad_signature", "Invalid signature"}
+	HandshakeErrBadServerSignature = &HandshakeError{"bad_server_signature", "Invalid server's signature"}
+	HandshakeErrTimeout            = &HandshakeError{"timeout", "Handshake timed out"}
+
+	// All possible failure reasons
+	HandshakeErrors = []*HandshakeError{
+		HandshakeErrUnknownId,
+		HandshakeErrTimeSync,
+		HandshakeErrReplay,
+		HandshakeErrBadLength,
+		HandshakeErrBadDecode,
+		HandshakeErrBadRandom,
+		HandshakeErrBadSignature,
+		HandshakeErrBadServerSignature,
+		HandshakeErrTimeout,
+	}
+)
+
 type Handshake struct {
 	addr     string
 	conn     io.Writer
@@ -51,6 +85,8 @@ type Handshake struct {
 	rClient  *[RSize]byte
 	sServer  *[SSize]byte // secret string for main key calculation
 	sClient  *[SSize]byte
+	start    []byte // client's first message without the tag
+	cookie   []byte // server's cookie, if it has challenged
 }
 
 func keyFromSecrets(server, client []byte) *[SSize]byte {
@@ -61,6 +97,22 @@ func keyFromSecrets(server, client []byte) *[SSize]byte {
 	return k
 }
 
+// Start the record of handshake's event with the peer.
+func (h *Handshake) log(event string) *LogEntry {
+	return LogEvent(event).PeerName(h.Conf.Name).PeerId(h.Conf.Id).Addr(h.addr)
+}
+
+// Log the handshake's failure with optional underlying error.
+func (h *Handshake) fail(reason *HandshakeError, err error) error {
+	h.log("handshake_failed").Field("reason", reason.Reason).Err(err).Warn(reason.Error())
+	return reason
+}
+
+// Report the handshake's expiration before its completion.
+func (h *Handshake) Expire() error {
+	return h.fail(HandshakeErrTimeout, nil)
+}
+
 // Zero handshake's memory state
 func (h *Handshake) Zero() {
 	if h.rNonce != nil {
@@ -90,8 +142,12 @@ func (h *Handshake) Zero() {
 }
 
 func (h *Handshake) rNonceNext(count uint64) []byte {
+	return rNonceAdd(h.rNonce[:], count)
+}
+
+func rNonceAdd(rNonce []byte, count uint64) []byte {
 	nonce := make([]byte, RSize)
-	nonceCurrent, _ := binary.Uvarint(h.rNonce[:])
+	nonceCurrent, _ := binary.Uvarint(rNonce)
 	binary.PutUvarint(nonce, nonceCurrent+count)
 	return nonce
 }
@@ -103,7 +159,7 @@ func dhKeypairGen() (*[32]byte, *[32]byte) {
 	reprFound := false
 	for !reprFound {
 		if _, err := Rand.Read(priv[:]); err != nil {
-			log.Fatalln("Error reading random for DH private key:", err)
+			LogEvent("random_failed").Err(err).Fatal("Error reading random for DH private key")
 		}
 		reprFound = extra25519.ScalarBaseMult(pub, repr, priv)
 	}
@@ -145,6 +201,31 @@ func idTag(id *PeerId, timeSync int, data []byte) []byte {
 	return enc
 }
 
+// Tag of the client's message: identification token if time
+// synchronization is enabled, ID tag otherwise. nil is returned if
+// tokens are spent, as server recognizes time synchronized peers only
+// by them.
+func (h *Handshake) clientTag(data []byte) []byte {
+	if h.Conf.TimeSync == 0 {
+		return idTag(h.Conf.Id, 0, data)
+	}
+	token := idTokenNext(h.Conf.Id, h.Conf.TimeSync)
+	if token == nil {
+		h.log("tokens_spent").Warn("Identification tokens are spent, message is not sent")
+	}
+	return token
+}
+
+// Send client's message with the tag of tagData appended. Nothing is
+// sent if there is no tag: handshake times out and is retried later.
+func (h *Handshake) clientSend(data, tagData []byte) {
+	tag := h.clientTag(tagData)
+	if tag == nil {
+		return
+	}
+	h.conn.Write(append(data, tag...))
+}
+
 // Start handshake's procedure from the client. It is the entry point
 // for starting the handshake procedure. // First handshake packet
 // will be sent immediately.
@@ -155,7 +236,7 @@ func HandshakeStart(addr string, conn io.Writer, conf *PeerConf) *Handshake {
 
 	state.rNonce = new([RSize]byte)
 	if _, err := Rand.Read(state.rNonce[:]); err != nil {
-		log.Fatalln("Error reading random for nonce:", err)
+		LogEvent("random_failed").Err(err).Fatal("Error reading random for nonce")
 	}
 	var enc []byte
 	if conf.Noise {
@@ -173,18 +254,91 @@ func HandshakeStart(addr string, conn io.Writer, conf *PeerConf) *Handshake {
 	} else {
 		salsa20.XORKeyStream(enc, enc, state.rNonce[:], state.dsaPubH)
 	}
-	data := append(state.rNonce[:], enc...)
-	data = append(data, idTag(state.Conf.Id, state.Conf.TimeSync, state.rNonce[:])...)
-	state.conn.Write(data)
+	state.start = append(state.rNonce[:], enc...)
+	state.clientSend(state.start, state.rNonce[:])
 	return state
 }
 
+// Repeat the first client's message with the cookie.
+// R + ENC(H(DSAPub), R, El(CDHPub)) + Cookie + IDtag
+func (h *Handshake) startCookied(cookie []byte) {
+	h.cookie = cookie
+	data := h.start
+	if h.Conf.Noise && !h.Conf.Encless {
+		// Do not exceed MTU, sacrificing the padding
+		data = data[:len(data)-CookieSize]
+	}
+	data = append(append([]byte{}, data...), cookie...)
+	h.clientSend(data, h.rNonce[:])
+}
+
+// Is it the repetition of the first client's message, having the
+// same R, that is received instead of the third one.
+func (h *Handshake) startRepeated(data []byte) bool {
+	return len(data) >= RSize+xtea.BlockSize &&
+		subtle.ConstantTimeCompare(data[:RSize], h.rNonce[:]) == 1
+}
+
+// Is it the first message of the client, that started the handshake
+// anew, received instead of the third one. Both of them have the same
+// length with noise or encryptionless mode, so the first one is
+// recognized by decoding it with H(DSAPub): zero noise padding or
+// successfully decoded encryptionless message is expected. Otherwise
+// the failure of the third message is counted, for example for lockouts.
+func (h *Handshake) startRenewed(data []byte) bool {
+	if h.Conf.Encless {
+		if len(data) != EnclessEnlargeSize+h.Conf.MTU {
+			return false
+		}
+		_, err := EnclessDecode(h.dsaPubH, data[:RSize], data[RSize:len(data)-xtea.BlockSize])
+		return err == nil
+	}
+	if !h.Conf.Noise || len(data) != h.Conf.MTU {
+		return false
+	}
+	dec := make([]byte, len(data)-RSize-xtea.BlockSize)
+	salsa20.XORKeyStream(dec, data[RSize:len(data)-xtea.BlockSize], data[:RSize], h.dsaPubH)
+	// Padding may be shortened by the cookie
+	padding := dec[32 : len(dec)-CookieSize]
+	return len(padding) >= xtea.BlockSize &&
+		subtle.ConstantTimeCompare(padding, make([]byte, len(padding))) == 1
+}
+
+// Forget the state of the first message's processing.
+func (h *Handshake) restart() {
+	SliceZero(h.rNonce[:])
+	if h.dhPriv != nil {
+		SliceZero(h.dhPriv[:])
+	}
+	if h.key != nil {
+		SliceZero(h.key[:])
+	}
+	if h.rServer != nil {
+		SliceZero(h.rServer[:])
+	}
+	if h.sServer != nil {
+		SliceZero(h.sServer[:])
+	}
+	h.rNonce, h.dhPriv, h.key, h.rServer, h.sServer = nil, nil, nil, nil, nil
+}
+
 // Process handshake message on the server side.
 // This function is intended to be called on server's side.
 // If this is the final handshake message, then new Peer object
 // will be created and used as a transport. If no mutually
-// authenticated Peer is ready, then return nil.
-func (h *Handshake) Server(data []byte) *Peer {
+// authenticated Peer is ready yet, then return nil. Failure reason is
+// returned as *HandshakeError.
+func (h *Handshake) Server(data []byte) (*Peer, error) {
+	if h.rNonce != nil && h.rClient == nil {
+		if h.startRepeated(data) {
+			// Retransmission, that can not be verified, is ignored
+			return nil, nil
+		}
+		if h.startRenewed(data) {
+			h.log("handshake_restarted").Info("Client started the handshake anew")
+			h.restart()
+		}
+	}
 	// R + ENC(H(DSAPub), R, El(CDHPub)) + IDtag
 	if h.rNonce == nil && ((!h.Conf.Encless && len(data) >= 48) ||
 		(h.Conf.Encless && len(data) == EnclessEnlargeSize+h.Conf.MTU)) {
@@ -200,8 +354,7 @@ func (h *Handshake) Server(data []byte) *Peer {
 				data[RSize:len(data)-xtea.BlockSize],
 			)
 			if err != nil {
-				log.Println("Unable to decode packet from", h.addr, err)
-				return nil
+				return nil, h.fail(HandshakeErrBadDecode, err)
 			}
 			copy(cDHRepr[:], out)
 		} else {
@@ -239,11 +392,11 @@ func (h *Handshake) Server(data []byte) *Peer {
 		// Generate R* and encrypt them
 		h.rServer = new([RSize]byte)
 		if _, err = Rand.Read(h.rServer[:]); err != nil {
-			log.Fatalln("Error reading random for R:", err)
+			LogEvent("random_failed").Err(err).Fatal("Error reading random for R")
 		}
 		h.sServer = new([SSize]byte)
 		if _, err = Rand.Read(h.sServer[:]); err != nil {
-			log.Fatalln("Error reading random for S:", err)
+			LogEvent("random_failed").Err(err).Fatal("Error reading random for S")
 		}
 		var encRs []byte
 		if h.Conf.Noise && !h.Conf.Encless {
@@ -281,8 +434,7 @@ func (h *Handshake) Server(data []byte) *Peer {
 				data[:len(data)-xtea.BlockSize],
 			)
 			if err != nil {
-				log.Println("Unable to decode packet from", h.addr, err)
-				return nil
+				return nil, h.fail(HandshakeErrBadDecode, err)
 			}
 			dec = dec[:RSize+RSize+SSize+ed25519.SignatureSize]
 		} else {
@@ -295,24 +447,28 @@ func (h *Handshake) Server(data []byte) *Peer {
 			)
 		}
 		if subtle.ConstantTimeCompare(dec[:RSize], h.rServer[:]) != 1 {
-			log.Println("Invalid server's random number with", h.addr)
-			return nil
+			return nil, h.fail(HandshakeErrBadRandom, nil)
 		}
 		sign := new([ed25519.SignatureSize]byte)
 		copy(sign[:], dec[RSize+RSize+SSize:])
 		if !ed25519.Verify(h.Conf.Verifier.Pub, h.key[:], sign) {
-			log.Println("Invalid signature from", h.addr)
-			return nil
+			return nil, h.fail(HandshakeErrBadSignature, nil)
 		}
 
 		// Send final answer to client
 		var enc []byte
 		if h.Conf.Noise {
 			enc = make([]byte, h.Conf.MTU-xtea.BlockSize)
+		} else if h.Conf.ServerPriv != nil {
+			enc = make([]byte, RSize+ed25519.SignatureSize)
 		} else {
 			enc = make([]byte, RSize)
 		}
 		copy(enc, dec[RSize:RSize+RSize])
+		if h.Conf.ServerPriv != nil {
+			sign := ed25519.Sign(h.Conf.ServerPriv, h.key[:])
+			copy(enc[RSize:], sign[:])
+		}
 		if h.Conf.Encless {
 			enc, err = EnclessEncode(h.key, h.rNonceNext(2), enc)
 			if err != nil {
@@ -331,19 +487,29 @@ func (h *Handshake) Server(data []byte) *Peer {
 			h.Conf,
 			keyFromSecrets(h.sServer[:], dec[RSize+RSize:RSize+RSize+SSize]))
 		h.LastPing = time.Now()
-		return peer
+		return peer, nil
 	} else {
-		log.Println("Invalid handshake message from", h.addr)
+		return nil, h.fail(HandshakeErrBadLength, nil)
 	}
-	return nil
+	return nil, nil
 }
 
 // Process handshake message on the client side.
 // This function is intended to be called on client's side.
 // If this is the final handshake message, then new Peer object
 // will be created and used as a transport. If no mutually
-// authenticated Peer is ready, then return nil.
-func (h *Handshake) Client(data []byte) *Peer {
+// authenticated Peer is ready yet, then return nil. Failure reason is
+// returned as *HandshakeError.
+func (h *Handshake) Client(data []byte) (*Peer, error) {
+	// ENC(H(DSAPub), R+3, Cookie + Zeros) + IDtag
+	if h.rServer == nil && h.key == nil && h.cookie == nil {
+		if cookie := h.cookieGet(data); cookie != nil {
+			h.log("handshake_challenged").Debug("Server requested the cookie")
+			h.startCookied(cookie)
+			h.LastPing = time.Now()
+			return nil, nil
+		}
+	}
 	// ENC(H(DSAPub), R+1, El(SDHPub)) + ENC(K, R, RS + SS) + IDtag
 	if h.rServer == nil && h.key == nil &&
 		((!h.Conf.Encless && len(data) >= 80) ||
@@ -359,8 +525,7 @@ func (h *Handshake) Client(data []byte) *Peer {
 				data[:len(data)/2],
 			)
 			if err != nil {
-				log.Println("Unable to decode packet from", h.addr, err)
-				return nil
+				return nil, h.fail(HandshakeErrBadDecode, err)
 			}
 			copy(sDHRepr[:], tmp[:32])
 		} else {
@@ -387,8 +552,7 @@ func (h *Handshake) Client(data []byte) *Peer {
 				data[len(data)/2:len(data)-xtea.BlockSize],
 			)
 			if err != nil {
-				log.Println("Unable to decode packet from", h.addr, err)
-				return nil
+				return nil, h.fail(HandshakeErrBadDecode, err)
 			}
 			copy(h.rServer[:], tmp[:RSize])
 			copy(h.sServer[:], tmp[RSize:RSize+SSize])
@@ -407,11 +571,11 @@ func (h *Handshake) Client(data []byte) *Peer {
 		// Generate R* and signature and encrypt them
 		h.rClient = new([RSize]byte)
 		if _, err = Rand.Read(h.rClient[:]); err != nil {
-			log.Fatalln("Error reading random for R:", err)
+			LogEvent("random_failed").Err(err).Fatal("Error reading random for R")
 		}
 		h.sClient = new([SSize]byte)
 		if _, err = Rand.Read(h.sClient[:]); err != nil {
-			log.Fatalln("Error reading random for S:", err)
+			LogEvent("random_failed").Err(err).Fatal("Error reading random for S")
 		}
 		sign := ed25519.Sign(h.Conf.DSAPriv, h.key[:])
 
@@ -435,14 +599,18 @@ func (h *Handshake) Client(data []byte) *Peer {
 		}
 
 		// Send that to server
-		h.conn.Write(append(enc, idTag(h.Conf.Id, h.Conf.TimeSync, enc)...))
+		h.clientSend(enc, enc)
 		h.LastPing = time.Now()
 	} else
-	// ENC(K, R+2, RC) + IDtag
+	// ENC(K, R+2, RC [+ Sign(ServerPriv, K)]) + IDtag
 	if h.key != nil && ((!h.Conf.Encless && len(data) >= 16) ||
 		(h.Conf.Encless && len(data) == EnclessEnlargeSize+h.Conf.MTU)) {
 		var err error
-		// Decrypt rClient
+		// Decrypt rClient and optional server's signature
+		decSize := RSize
+		if h.Conf.ServerPub != nil {
+			decSize += ed25519.SignatureSize
+		}
 		var dec []byte
 		if h.Conf.Encless {
 			dec, err = EnclessDecode(
@@ -451,17 +619,29 @@ func (h *Handshake) Client(data []byte) *Peer {
 				data[:len(data)-xtea.BlockSize],
 			)
 			if err != nil {
-				log.Println("Unable to decode packet from", h.addr, err)
-				return nil
+				return nil, h.fail(HandshakeErrBadDecode, err)
 			}
-			dec = dec[:RSize]
+			dec = dec[:decSize]
 		} else {
-			dec = make([]byte, RSize)
-			salsa20.XORKeyStream(dec, data[:RSize], h.rNonceNext(2), h.key)
+			if len(data) < decSize+xtea.BlockSize {
+				if h.Conf.ServerPub != nil {
+					// Server has not signed the message
+					return nil, h.fail(HandshakeErrBadServerSignature, nil)
+				}
+				return nil, h.fail(HandshakeErrBadLength, nil)
+			}
+			dec = make([]byte, decSize)
+			salsa20.XORKeyStream(dec, data[:decSize], h.rNonceNext(2), h.key)
+		}
+		if subtle.ConstantTimeCompare(dec[:RSize], h.rClient[:]) != 1 {
+			return nil, h.fail(HandshakeErrBadRandom, nil)
 		}
-		if subtle.ConstantTimeCompare(dec, h.rClient[:]) != 1 {
-			log.Println("Invalid client's random number with", h.addr)
-			return nil
+		if h.Conf.ServerPub != nil {
+			sign := new([ed25519.SignatureSize]byte)
+			copy(sign[:], dec[RSize:])
+			if !ed25519.Verify(h.Conf.ServerPub, h.key[:], sign) {
+				return nil, h.fail(HandshakeErrBadServerSignature, nil)
+			}
 		}
 
 		// Switch peer
@@ -473,9 +653,9 @@ func (h *Handshake) Client(data []byte) *Peer {
 			keyFromSecrets(h.sServer[:], h.sClient[:]),
 		)
 		h.LastPing = time.Now()
-		return peer
+		return peer, nil
 	} else {
-		log.Println("Invalid handshake stage from", h.addr)
+		return nil, h.fail(HandshakeErrBadLength, nil)
 	}
-	return nil
+	return nil, nil
 }
@@ -20,6 +20,9 @@ package govpn
 
 import (
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/xtea"
 )
 
 func TestHandshakeSymmetric(t *testing.T) {
@@ -31,10 +34,10 @@ func TestHandshakeSymmetric(t *testing.T) {
 	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
 	hsS.Server(testCt)
 	hsC.Client(testCt)
-	if hsS.Server(testCt) == nil {
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
-	if hsC.Client(testCt) == nil {
+	if peer, err := hsC.Client(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
 }
@@ -49,10 +52,10 @@ func TestHandshakeNoiseSymmetric(t *testing.T) {
 	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
 	hsS.Server(testCt)
 	hsC.Client(testCt)
-	if hsS.Server(testCt) == nil {
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
-	if hsC.Client(testCt) == nil {
+	if peer, err := hsC.Client(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
 	testConf.Noise = false
@@ -68,12 +71,187 @@ func TestHandshakeEnclessSymmetric(t *testing.T) {
 	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
 	hsS.Server(testCt)
 	hsC.Client(testCt)
-	if hsS.Server(testCt) == nil {
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
-	if hsC.Client(testCt) == nil {
+	if peer, err := hsC.Client(testCt); err != nil || peer == nil {
 		t.Fail()
 	}
 	testConf.Encless = false
 	testConf.Noise = false
 }
+
+func testHandshakeIdentity(t *testing.T, serverPriv *[64]byte, serverPub *[32]byte) error {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.Verifier = v
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	confS := *testConf
+	confS.ServerPriv = serverPriv
+	confC := *testConf
+	confC.ServerPub = serverPub
+	hsS := NewHandshake("server", Dummy{&testCt}, &confS)
+	hsC := HandshakeStart("client", Dummy{&testCt}, &confC)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
+		t.Fatal("server failed")
+	}
+	_, err := hsC.Client(testCt)
+	return err
+}
+
+func TestHandshakeServerIdentity(t *testing.T) {
+	_, prv, err := VerifierNewEd25519(&testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, prvOther, err := VerifierNewEd25519(&testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := KeyPubFromString(KeyPubString(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubOther, _ := KeyPubFromString(KeyPubString(prvOther))
+	if testHandshakeIdentity(t, prv, pub) != nil {
+		t.Fatal("pinned server is rejected")
+	}
+	if testHandshakeIdentity(t, prv, nil) != nil {
+		t.Fatal("signing server is rejected by non-pinning client")
+	}
+	if testHandshakeIdentity(t, prv, pubOther) != HandshakeErrBadServerSignature {
+		t.Fatal("server with other identity is accepted")
+	}
+	if testHandshakeIdentity(t, nil, pub) != HandshakeErrBadServerSignature {
+		t.Fatal("server without identity is accepted")
+	}
+}
+
+func TestHandshakeWrongPassword(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	testConf.DSAPriv = v.PasswordApply("does not matter")
+	testConf.Verifier = v
+	confC := *testConf
+	confC.Verifier = VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	confC.DSAPriv = confC.Verifier.PasswordApply("wrong")
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, &confC)
+	if _, err := hsS.Server(testCt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hsC.Client(testCt); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err := hsS.Server(testCt); peer != nil || err != HandshakeErrBadRandom {
+		t.Fatal("unexpected result", err)
+	}
+	if peer, err := hsS.Server(testCt[:10]); peer != nil || err != HandshakeErrBadLength {
+		t.Fatal("unexpected result", err)
+	}
+}
+
+func TestCipherCacheLookup(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	cc := NewCipherCache()
+	cc.Update(&map[PeerId]*PeerConf{testPeerId: &conf})
+	data := []byte("whatever")
+	if pid, err := cc.Lookup(append(data, idTag(&testPeerId, 30, data)...)); err != nil || *pid != testPeerId {
+		t.Fatal("identity is not found", err)
+	}
+	if pid, err := cc.Lookup(append(data, idTag(&testPeerId, 0, data)...)); err != HandshakeErrTimeSync || *pid != testPeerId {
+		t.Fatal("disabled time synchronization is not recognized", err)
+	}
+	ciph, _ := xtea.NewCipher(testPeerId[:])
+	tag := make([]byte, xtea.BlockSize)
+	copy(tag, data)
+	addTimeSyncAt(30, tag, time.Now().Add(-time.Minute))
+	ciph.Encrypt(tag, tag)
+	if pid, err := cc.Lookup(append(data, tag...)); err != HandshakeErrTimeSync || *pid != testPeerId {
+		t.Fatal("skewed clock is not recognized", err)
+	}
+	other := PeerId{1}
+	if pid, err := cc.Lookup(append(data, idTag(&other, 30, data)...)); err != HandshakeErrUnknownId || pid != nil {
+		t.Fatal("unknown identity is found", err)
+	}
+	if _, err := cc.Lookup(data); err != HandshakeErrBadLength {
+		t.Fatal("short message is accepted", err)
+	}
+}
+
+func TestHandshakeTokensSpent(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	idTokenSeqs.Lock()
+	idTokenSeqs.m[*conf.Id] = &idTokenPos{30, time.Now().Unix()/30 + IDTokensSkew, IDTokensPerWindow}
+	idTokenSeqs.Unlock()
+	var sent []byte
+	HandshakeStart("client", Dummy{&sent}, &conf)
+	if sent != nil {
+		t.Fatal("message without token is sent")
+	}
+	idTokenSeqs.m[*conf.Id] = &idTokenPos{}
+	HandshakeStart("client", Dummy{&sent}, &conf)
+	if sent == nil {
+		t.Fatal("message is not sent")
+	}
+}
+
+func testHandshakeRetransmit(t *testing.T, conf *PeerConf) {
+	v := VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	conf.Verifier = v
+	conf.DSAPriv = v.PasswordApply("does not matter")
+	var start, ct []byte
+	hsS := NewHandshake("server", Dummy{&ct}, conf)
+	HandshakeStart("client", Dummy{&start}, conf)
+	if _, err := hsS.Server(start); err != nil {
+		t.Fatal(err)
+	}
+	if peer, err := hsS.Server(start); peer != nil || err != nil {
+		t.Fatal("repeated message is not ignored", err)
+	}
+	// Client gave up waiting and started anew
+	hsC := HandshakeStart("client", Dummy{&ct}, conf)
+	if _, err := hsS.Server(ct); err != nil {
+		t.Fatal("renewed message is not accepted", err)
+	}
+	hsC.Client(ct)
+	if peer, err := hsS.Server(ct); err != nil || peer == nil {
+		t.Fatal("renewed handshake failed", err)
+	}
+	if peer, err := hsC.Client(ct); err != nil || peer == nil {
+		t.Fatal("renewed handshake failed on client", err)
+	}
+
+	// Third message with wrong password is still a failure
+	confC := *conf
+	confC.Verifier = VerifierNew(1<<10, 1<<4, 1, &testPeerId)
+	confC.DSAPriv = confC.Verifier.PasswordApply("wrong")
+	hsS = NewHandshake("server", Dummy{&ct}, conf)
+	hsC = HandshakeStart("client", Dummy{&ct}, &confC)
+	// Encryptionless mode fails already on the first message
+	_, err := hsS.Server(ct)
+	if err == nil {
+		hsC.Client(ct)
+		_, err = hsS.Server(ct)
+	}
+	if err != HandshakeErrBadRandom && err != HandshakeErrBadDecode {
+		t.Fatal("wrong password is accepted", err)
+	}
+}
+
+func TestHandshakeNoiseRetransmit(t *testing.T) {
+	conf := *testConf
+	conf.Noise = true
+	testHandshakeRetransmit(t, &conf)
+}
+
+func TestHandshakeEnclessRetransmit(t *testing.T) {
+	conf := *testConf
+	conf.Noise = true
+	conf.Encless = true
+	testHandshakeRetransmit(t, &conf)
+}
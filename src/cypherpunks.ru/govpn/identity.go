@@ -22,7 +22,7 @@ import (
 	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
-	"log"
+	"errors"
 	"sync"
 	"time"
 
@@ -31,6 +31,9 @@ import (
 
 const (
 	IDSize = 128 / 8
+	// Clock skew, in time synchronization periods, still recognized
+	// as a mismatch, not an unknown identity
+	TimeSyncSkewMax = 3
 )
 
 type PeerId [IDSize]byte
@@ -39,6 +42,19 @@ func (id PeerId) String() string {
 	return base64.RawStdEncoding.EncodeToString(id[:])
 }
 
+func PeerIdFromString(s string) (*PeerId, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != IDSize {
+		return nil, errors.New("Invalid peer identity length")
+	}
+	id := new(PeerId)
+	copy(id[:], raw)
+	return id, nil
+}
+
 func (id PeerId) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + id.String() + `"`), nil
 }
@@ -50,67 +66,234 @@ type CipherAndTimeSync struct {
 
 type CipherCache struct {
 	c map[PeerId]*CipherAndTimeSync
-	l sync.RWMutex
+	// Identification tokens of time synchronized peers, grouped by
+	// the synchronization period. nil if tokens are not used.
+	tokens map[int]*idTokens
+	// Peers without time synchronization, identified by ID tags
+	tagged map[PeerId]*CipherAndTimeSync
+	l      sync.RWMutex
+	// Already accepted tokens with the time they are valid until
+	tokensUsed  map[uint64]int64
+	tokensUsedL sync.Mutex
 }
 
 func NewCipherCache() *CipherCache {
 	return &CipherCache{c: make(map[PeerId]*CipherAndTimeSync)}
 }
 
+// Cipher cache of the server: time synchronized peers are identified
+// by precomputed tokens.
+func NewServerCipherCache() *CipherCache {
+	cc := NewCipherCache()
+	cc.tokens = make(map[int]*idTokens)
+	cc.tokensUsed = make(map[uint64]int64)
+	go func() {
+		for now := range time.Tick(time.Second) {
+			cc.tokensRotate(now.Unix())
+		}
+	}()
+	return cc
+}
+
 // Remove disappeared keys, add missing ones with initialized ciphers.
 func (cc *CipherCache) Update(peers *map[PeerId]*PeerConf) {
 	cc.l.Lock()
+	changed := false
 	for pid, _ := range cc.c {
 		if _, exists := (*peers)[pid]; !exists {
-			log.Println("Cleaning key:", pid)
+			LogEvent("key_removed").PeerId(&pid).Info("Cleaning key")
 			delete(cc.c, pid)
+			changed = true
 		}
 	}
 	for pid, pc := range *peers {
 		if _, exists := cc.c[pid]; exists {
-			cc.c[pid].t = pc.TimeSync
+			if cc.c[pid].t != pc.TimeSync {
+				cc.c[pid].t = pc.TimeSync
+				changed = true
+			}
 		} else {
-			log.Println("Adding key", pid)
+			LogEvent("key_added").PeerName(pc.Name).PeerId(&pid).Info("Adding key")
 			cipher, err := xtea.NewCipher(pid[:])
 			if err != nil {
 				panic(err)
 			}
 			cc.c[pid] = &CipherAndTimeSync{cipher, pc.TimeSync}
+			changed = true
 		}
 	}
+	if !changed || cc.tokens == nil {
+		cc.l.Unlock()
+		return
+	}
+	tagged := make(map[PeerId]*CipherAndTimeSync)
+	tables := make(map[int]*idTokens)
+	for pid, ct := range cc.c {
+		if ct.t == 0 {
+			tagged[pid] = ct
+			continue
+		}
+		tokens, exists := tables[ct.t]
+		if !exists {
+			tokens = &idTokens{period: int64(ct.t)}
+			tables[ct.t] = tokens
+		}
+		tokens.peers = append(tokens.peers, pid)
+		tokens.ciphers = append(tokens.ciphers, ct.c)
+	}
+	cc.l.Unlock()
+	// Tokens computation is long, so do not block lookups meanwhile
+	now := time.Now().Unix()
+	for _, tokens := range tables {
+		tokens.rotate(now)
+	}
+	cc.l.Lock()
+	cc.tokens, cc.tagged = tables, tagged
 	cc.l.Unlock()
 }
 
 // If timeSync > 0, then XOR timestamp with the data.
 func AddTimeSync(ts int, data []byte) {
+	addTimeSyncAt(ts, data, time.Now())
+}
+
+func addTimeSyncAt(ts int, data []byte, now time.Time) {
 	if ts == 0 {
 		return
 	}
 	buf := make([]byte, 8)
-	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()/int64(ts)*int64(ts)))
+	binary.BigEndian.PutUint64(buf, uint64(now.Unix()/int64(ts)*int64(ts)))
 	for i := 0; i < 8; i++ {
 		data[i] ^= buf[i]
 	}
 }
 
-// Try to find peer's identity (that equals to an encryption key)
-// by taking first blocksize sized bytes from data at the beginning
-// as plaintext and last bytes as cyphertext.
+// Try to find peer's identity (that equals to an encryption key).
 func (cc *CipherCache) Find(data []byte) *PeerId {
+	if pid, err := cc.Lookup(data); err == nil {
+		return pid
+	}
+	return nil
+}
+
+// Try to find peer's identity by taking the last blocksize sized bytes
+// of data. At first they are looked up in identification tokens of the
+// time synchronized peers. Then they are treated as the ID tag: as the
+// ciphertext of first blocksize sized bytes at the beginning. Server's
+// cache checks tags only for the peers without time synchronization,
+// trying each of them in turn: only tokens are indexed.
+//
+// If the token belongs to up to IDTokensSkewMax periods away window,
+// then HandshakeErrTimeSync is returned together with the identity,
+// HandshakeErrReplay if the token has been already accepted.
+// Client's cache does the same for the ID tag with the time
+// synchronization disabled or the clock skewed by up to TimeSyncSkewMax
+// periods. Otherwise it is HandshakeErrUnknownId.
+func (cc *CipherCache) Lookup(data []byte) (*PeerId, error) {
 	if len(data) < xtea.BlockSize*2 {
-		return nil
+		return nil, HandshakeErrBadLength
 	}
-	buf := make([]byte, xtea.BlockSize)
+	now := time.Now()
+	tag := data[len(data)-xtea.BlockSize:]
 	cc.l.RLock()
-	for pid, ct := range cc.c {
-		ct.c.Decrypt(buf, data[len(data)-xtea.BlockSize:])
+	defer cc.l.RUnlock()
+	token := binary.BigEndian.Uint64(tag)
+	for _, tokens := range cc.tokens {
+		if pid, skew := tokens.find(token, now.Unix()); pid != nil {
+			ppid := *pid
+			if skew < -IDTokensSkew || skew > IDTokensSkew {
+				return &ppid, HandshakeErrTimeSync
+			}
+			window := now.Unix()/tokens.period + skew
+			if !cc.tokenUse(token, (window+IDTokensSkew+1)*tokens.period, now.Unix()) {
+				return &ppid, HandshakeErrReplay
+			}
+			return &ppid, nil
+		}
+	}
+	tagged := cc.c
+	if cc.tokens != nil {
+		tagged = cc.tagged
+	}
+	buf := make([]byte, xtea.BlockSize)
+	for pid, ct := range tagged {
+		ct.c.Decrypt(buf, tag)
 		AddTimeSync(ct.t, buf)
 		if subtle.ConstantTimeCompare(buf, data[:xtea.BlockSize]) == 1 {
 			ppid := PeerId(pid)
-			cc.l.RUnlock()
-			return &ppid
+			return &ppid, nil
+		}
+	}
+	if cc.tokens != nil {
+		return nil, HandshakeErrUnknownId
+	}
+	for pid, ct := range cc.c {
+		if ct.t == 0 {
+			continue
+		}
+		ct.c.Decrypt(buf, tag)
+		if subtle.ConstantTimeCompare(buf, data[:xtea.BlockSize]) == 1 {
+			ppid := PeerId(pid)
+			return &ppid, HandshakeErrTimeSync
+		}
+		for skew := -TimeSyncSkewMax; skew <= TimeSyncSkewMax; skew++ {
+			if skew == 0 {
+				continue
+			}
+			ct.c.Decrypt(buf, tag)
+			addTimeSyncAt(ct.t, buf, now.Add(time.Duration(skew*ct.t)*time.Second))
+			if subtle.ConstantTimeCompare(buf, data[:xtea.BlockSize]) == 1 {
+				ppid := PeerId(pid)
+				return &ppid, HandshakeErrTimeSync
+			}
+		}
+	}
+	return nil, HandshakeErrUnknownId
+}
+
+// Remember the accepted token until it is valid. Returns false if it
+// is already used.
+func (cc *CipherCache) tokenUse(token uint64, until, now int64) bool {
+	cc.tokensUsedL.Lock()
+	defer cc.tokensUsedL.Unlock()
+	if u, used := cc.tokensUsed[token]; used && u > now {
+		return false
+	}
+	cc.tokensUsed[token] = until
+	return true
+}
+
+// Move the rings of token tables, that are stale, and forget expired
+// used tokens. Tables are computed outside the lock on the copies, so
+// lookups are not blocked meanwhile, and then swapped in, unless
+// Update has replaced them.
+func (cc *CipherCache) tokensRotate(now int64) {
+	stale := make(map[int]*idTokens)
+	cc.l.RLock()
+	for period, tokens := range cc.tokens {
+		if tokens.stale(now) {
+			stale[period] = tokens
 		}
 	}
 	cc.l.RUnlock()
-	return nil
+	rotated := make(map[int]*idTokens, len(stale))
+	for period, tokens := range stale {
+		moved := *tokens
+		moved.rotate(now)
+		rotated[period] = &moved
+	}
+	cc.l.Lock()
+	for period, moved := range rotated {
+		if cc.tokens[period] == stale[period] {
+			cc.tokens[period] = moved
+		}
+	}
+	cc.l.Unlock()
+	cc.tokensUsedL.Lock()
+	for token, until := range cc.tokensUsed {
+		if until <= now {
+			delete(cc.tokensUsed, token)
+		}
+	}
+	cc.tokensUsedL.Unlock()
 }
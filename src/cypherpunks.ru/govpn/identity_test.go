@@ -0,0 +1,272 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/xtea"
+)
+
+func testIdToken(id *PeerId, window int64) []byte {
+	ciph, _ := xtea.NewCipher(id[:])
+	token := make([]byte, xtea.BlockSize)
+	binary.BigEndian.PutUint64(token, idToken(ciph, window, 0))
+	return token
+}
+
+func TestServerCipherCacheTokens(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	legacy := PeerId{1}
+	legacyConf := *testConf
+	legacyConf.TimeSync = 0
+	cc := NewServerCipherCache()
+	cc.Update(&map[PeerId]*PeerConf{testPeerId: &conf, legacy: &legacyConf})
+	data := []byte("whatever")
+	seen := make(map[string]struct{})
+	idTokenSeqs.m[testPeerId] = &idTokenPos{}
+	for i := 0; i < IDTokensPerWindow; i++ {
+		token := idTokenNext(&testPeerId, 30)
+		if pid, err := cc.Lookup(append(data, token...)); err != nil || *pid != testPeerId {
+			t.Fatal("identity is not found", err)
+		}
+		seen[string(token)] = struct{}{}
+	}
+	if len(seen) != IDTokensPerWindow {
+		t.Fatal("tokens are reused", len(seen))
+	}
+	window := time.Now().Unix() / 30
+	if pid, err := cc.Lookup(append(data, testIdToken(&testPeerId, window-1)...)); err != nil || *pid != testPeerId {
+		t.Fatal("previous window is not accepted", err)
+	}
+	if pid, err := cc.Lookup(append(data, testIdToken(&testPeerId, window+2)...)); err != HandshakeErrTimeSync || *pid != testPeerId {
+		t.Fatal("skewed clock is not recognized", err)
+	}
+	if pid, err := cc.Lookup(append(data, testIdToken(&testPeerId, window+5)...)); err != HandshakeErrUnknownId || pid != nil {
+		t.Fatal("far window is accepted", err)
+	}
+	if pid, err := cc.Lookup(append(data, idTag(&testPeerId, 30, data)...)); err != HandshakeErrUnknownId || pid != nil {
+		t.Fatal("tag of time synchronized peer is accepted", err)
+	}
+	if pid, err := cc.Lookup(append(data, idTag(&legacy, 0, data)...)); err != nil || *pid != legacy {
+		t.Fatal("peer without time synchronization is not found", err)
+	}
+	cc.Update(&map[PeerId]*PeerConf{legacy: &legacyConf})
+	if pid := cc.Find(append(data, testIdToken(&testPeerId, window)...)); pid != nil {
+		t.Fatal("removed identity is found")
+	}
+}
+
+func TestIdTokensNotReused(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	cc := NewServerCipherCache()
+	cc.Update(&map[PeerId]*PeerConf{testPeerId: &conf})
+	data := []byte("whatever")
+	seen := make(map[string]struct{})
+	idTokenSeqs.m[testPeerId] = &idTokenPos{}
+	for i := 0; i < IDTokensPerWindow*(IDTokensSkew+1); i++ {
+		token := idTokenNext(&testPeerId, 30)
+		if token == nil {
+			// Window has changed during the test
+			break
+		}
+		if _, reused := seen[string(token)]; reused {
+			t.Fatal("token is reused", i)
+		}
+		seen[string(token)] = struct{}{}
+		if pid, err := cc.Lookup(append(data, token...)); err != nil || *pid != testPeerId {
+			t.Fatal("identity is not found", i, err)
+		}
+	}
+	for i := 0; i < IDTokensPerWindow; i++ {
+		token := idTokenNext(&testPeerId, 30)
+		if token == nil {
+			continue
+		}
+		if _, reused := seen[string(token)]; reused {
+			t.Fatal("token is reused", i)
+		}
+		seen[string(token)] = struct{}{}
+	}
+}
+
+func TestIdTokensPerPeer(t *testing.T) {
+	other := PeerId{2}
+	delete(idTokenSeqs.m, testPeerId)
+	delete(idTokenSeqs.m, other)
+	ciph, _ := xtea.NewCipher(testPeerId[:])
+	current := time.Now().Unix() / 30
+	first := binary.BigEndian.Uint64(idTokenNext(&testPeerId, 30))
+	found := false
+	for seq := 0; seq < IDTokensPerWindow; seq++ {
+		if idToken(ciph, current, seq) == first {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("first token is not from the current window")
+	}
+	for i := 0; i < IDTokensPerWindow*(IDTokensSkew+1); i++ {
+		if idTokenNext(&testPeerId, 30) == nil {
+			break
+		}
+	}
+	if idTokenNext(&testPeerId, 30) != nil {
+		t.Fatal("tokens are not spent")
+	}
+	if idTokenNext(&other, 30) == nil {
+		t.Fatal("tokens of another identity are spent")
+	}
+	idTokenSeqs.m[testPeerId] = &idTokenPos{}
+}
+
+func TestIdTokensReplay(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	cc := NewServerCipherCache()
+	cc.Update(&map[PeerId]*PeerConf{testPeerId: &conf})
+	data := append([]byte("whatever"), testIdToken(&testPeerId, time.Now().Unix()/30)...)
+	if pid, err := cc.Lookup(data); err != nil || *pid != testPeerId {
+		t.Fatal("identity is not found", err)
+	}
+	if pid, err := cc.Lookup(data); err != HandshakeErrReplay || *pid != testPeerId {
+		t.Fatal("replay is accepted", err)
+	}
+	if cc.Find(data) != nil {
+		t.Fatal("replay is found")
+	}
+	if !cc.tokenUse(1, 100, 50) || cc.tokenUse(1, 100, 50) {
+		t.Fatal("token is not remembered")
+	}
+	if !cc.tokenUse(2, 200, 100) || !cc.tokenUse(1, 200, 100) {
+		t.Fatal("expired token is not forgotten")
+	}
+}
+
+func TestIdTokensRotate(t *testing.T) {
+	conf := *testConf
+	conf.TimeSync = 30
+	cc := NewServerCipherCache()
+	cc.Update(&map[PeerId]*PeerConf{testPeerId: &conf})
+	now := time.Now().Unix()
+	cc.tokenUse(1, now+30, now)
+	cc.l.RLock()
+	prev := cc.tokens[30]
+	windowsNum := prev.windowsNum
+	cc.l.RUnlock()
+	cc.tokensRotate(now)
+	if cc.tokens[30] != prev {
+		t.Fatal("fresh tables are rotated")
+	}
+	cc.tokensRotate(now + 60)
+	cc.l.RLock()
+	moved := cc.tokens[30]
+	cc.l.RUnlock()
+	if moved == prev || prev.windowsNum != windowsNum {
+		t.Fatal("tables are not rotated on the copy")
+	}
+	if moved.stale(now+60) || !prev.stale(now+60) {
+		t.Fatal("tables are stale")
+	}
+	if pid, _ := moved.find(binary.BigEndian.Uint64(testIdToken(&testPeerId, (now+60)/30+1)), now+60); pid == nil {
+		t.Fatal("next window is not found")
+	}
+	if len(cc.tokensUsed) != 0 {
+		t.Fatal("expired token is not forgotten")
+	}
+}
+
+func benchmarkCipherCache(b *testing.B, peers, timeSync int) (*CipherCache, []PeerId) {
+	LogSetup("error", LogFormatText, "")
+	defer LogSetup("info", LogFormatText, "")
+	confs := make(map[PeerId]*PeerConf, peers)
+	ids := make([]PeerId, peers)
+	for i := 0; i < peers; i++ {
+		binary.BigEndian.PutUint64(ids[i][:], uint64(i)+1)
+		conf := *testConf
+		conf.Id = &ids[i]
+		conf.TimeSync = timeSync
+		confs[ids[i]] = &conf
+	}
+	cc := NewServerCipherCache()
+	cc.Update(&confs)
+	return cc, ids
+}
+
+func BenchmarkCipherCacheFindToken(b *testing.B) {
+	cc, ids := benchmarkCipherCache(b, 10000, 30)
+	data := append(make([]byte, 48), idTokenNext(&ids[len(ids)-1], 30)...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Token is found each time, but accepted only once
+		if pid, _ := cc.Lookup(data); pid == nil {
+			b.Fatal("identity is not found")
+		}
+	}
+}
+
+func BenchmarkCipherCacheFindUnknownToken(b *testing.B) {
+	cc, _ := benchmarkCipherCache(b, 10000, 30)
+	data := make([]byte, 56)
+	Rand.Read(data)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cc.Find(data) != nil {
+			b.Fatal("identity is found")
+		}
+	}
+}
+
+// Peers without time synchronization are not indexed: each of them is
+// tried in turn.
+func BenchmarkCipherCacheFindTag(b *testing.B) {
+	cc, ids := benchmarkCipherCache(b, 10000, 0)
+	data := make([]byte, 48)
+	data = append(data, idTag(&ids[len(ids)-1], 0, data)...)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cc.Find(data) == nil {
+			b.Fatal("identity is not found")
+		}
+	}
+}
+
+func BenchmarkCipherCacheUpdate(b *testing.B) {
+	cc, ids := benchmarkCipherCache(b, 10000, 30)
+	confs := make(map[PeerId]*PeerConf, len(ids))
+	for _, id := range ids {
+		conf := *testConf
+		conf.TimeSync = 30
+		confs[id] = &conf
+	}
+	LogSetup("error", LogFormatText, "")
+	defer LogSetup("info", LogFormatText, "")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		delete(confs, ids[i%len(ids)])
+		cc.Update(&confs)
+		conf := *testConf
+		conf.TimeSync = 30
+		confs[ids[i%len(ids)]] = &conf
+	}
+}
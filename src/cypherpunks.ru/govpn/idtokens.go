@@ -0,0 +1,171 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/xtea"
+)
+
+const (
+	// Number of identification tokens of each time synchronized
+	// client in the time window
+	IDTokensPerWindow = 16
+	// Number of windows around the current one, whose tokens are
+	// accepted
+	IDTokensSkew = 1
+	// and whose tokens are recognized as the clock skew
+	IDTokensSkewMax = 2
+)
+
+// Identification token of the client's handshake message: XTEA
+// encrypted time window number and message's sequence number in it.
+// Unlike the tag it does not depend on the message itself, so server
+// can precompute all of them and find the peer with the single lookup.
+// Client never sends the same token twice and server refuses the
+// repeated ones, so it is still unlinkable and can not be replayed.
+func idToken(ciph *xtea.Cipher, window int64, seq int) uint64 {
+	block := make([]byte, xtea.BlockSize)
+	binary.BigEndian.PutUint64(block, uint64(window)<<8|uint64(seq))
+	ciph.Encrypt(block, block)
+	return binary.BigEndian.Uint64(block)
+}
+
+// Client's position of the next unused token: window number and
+// sequence number in it.
+type idTokenPos struct {
+	period int64
+	window int64
+	seq    int
+}
+
+// Positions of the client's identities.
+var idTokenSeqs = struct {
+	sync.Mutex
+	m map[PeerId]*idTokenPos
+}{m: make(map[PeerId]*idTokenPos)}
+
+// Token for the next client's message. Tokens are never reused: when
+// all of them are spent in the current window, tokens of up to
+// IDTokensSkew next windows are taken, that server still accepts. nil
+// is returned if even they are spent. Process starts at the random
+// position of the window, so restarted client is unlikely to send
+// tokens already spent by the previous process, that server refuses.
+func idTokenNext(id *PeerId, timeSync int) []byte {
+	ciph, err := xtea.NewCipher(id[:])
+	if err != nil {
+		panic(err)
+	}
+	current := time.Now().Unix() / int64(timeSync)
+	idTokenSeqs.Lock()
+	pos, exists := idTokenSeqs.m[*id]
+	if !exists {
+		pos = &idTokenPos{period: int64(timeSync), window: current}
+		pos.seq = idTokenSeqRandom()
+		idTokenSeqs.m[*id] = pos
+	}
+	if pos.period != int64(timeSync) || pos.window < current {
+		pos.period = int64(timeSync)
+		pos.window = current
+		pos.seq = 0
+	}
+	if pos.seq == IDTokensPerWindow {
+		pos.window++
+		pos.seq = 0
+	}
+	window, seq := pos.window, pos.seq
+	if window > current+IDTokensSkew {
+		pos.window, pos.seq = window-1, IDTokensPerWindow
+		idTokenSeqs.Unlock()
+		return nil
+	}
+	pos.seq++
+	idTokenSeqs.Unlock()
+	token := make([]byte, xtea.BlockSize)
+	binary.BigEndian.PutUint64(token, idToken(ciph, window, seq))
+	return token
+}
+
+func idTokenSeqRandom() int {
+	buf := make([]byte, 1)
+	if _, err := Rand.Read(buf); err != nil {
+		LogEvent("random_failed").Err(err).Fatal("Error reading random for token")
+	}
+	return int(buf[0]) % IDTokensPerWindow
+}
+
+// Precomputed tokens of the peers with the same time synchronization
+// period for the windows around the current one.
+type idTokens struct {
+	period  int64
+	peers   []PeerId
+	ciphers []*xtea.Cipher
+	// Ring of token -> peer's index maps, indexed by window number
+	windows    [2*IDTokensSkewMax + 1]map[uint64]int
+	windowsNum [2*IDTokensSkewMax + 1]int64
+}
+
+func (t *idTokens) slot(window int64) int {
+	return int(window % int64(len(t.windows)))
+}
+
+// Does the ring of windows need to be moved.
+func (t *idTokens) stale(now int64) bool {
+	window := now/t.period + IDTokensSkewMax
+	return t.windows[t.slot(window)] == nil || t.windowsNum[t.slot(window)] != window
+}
+
+// Compute tokens for the windows around the current one, that are not
+// computed yet.
+func (t *idTokens) rotate(now int64) {
+	current := now / t.period
+	for window := current - IDTokensSkewMax; window <= current+IDTokensSkewMax; window++ {
+		slot := t.slot(window)
+		if t.windows[slot] != nil && t.windowsNum[slot] == window {
+			continue
+		}
+		tokens := make(map[uint64]int, len(t.peers)*IDTokensPerWindow)
+		for i, ciph := range t.ciphers {
+			for seq := 0; seq < IDTokensPerWindow; seq++ {
+				tokens[idToken(ciph, window, seq)] = i
+			}
+		}
+		t.windows[slot] = tokens
+		t.windowsNum[slot] = window
+	}
+}
+
+// Find the peer by the token. Returns how many windows the token is
+// away from the current one.
+func (t *idTokens) find(token uint64, now int64) (*PeerId, int64) {
+	current := now / t.period
+	for slot, tokens := range t.windows {
+		if i, found := tokens[token]; found {
+			skew := t.windowsNum[slot] - current
+			if skew < -IDTokensSkewMax || skew > IDTokensSkewMax {
+				return nil, 0
+			}
+			return &t.peers[i], skew
+		}
+	}
+	return nil, 0
+}
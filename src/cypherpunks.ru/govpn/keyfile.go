@@ -0,0 +1,196 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/agl/ed25519"
+	"github.com/magical/argon2"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/salsa20"
+)
+
+const (
+	// Plaintext key file: $ed25519-key$SEED
+	KeyFilePlain = "ed25519-key"
+	// Encrypted key file: $ed25519-key-argon2d$m=M,t=T,p=P$SALT$TAG||ENC(SEED)
+	KeyFileEncrypted = "ed25519-key-argon2d"
+
+	keySeedSize = 32
+	keySaltSize = 16
+)
+
+// Encrypt or decrypt Ed25519 seed with the key derived from the
+// passphrase. Salsa20 keystream's first 32 bytes are Poly1305 key.
+func keyFileCipher(passphrase string, salt []byte, m, t, p int, data []byte) ([]byte, *[SSize]byte, error) {
+	r, err := argon2.Key([]byte(passphrase), salt, t, p, int64(m), SSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer SliceZero(r)
+	key := new([SSize]byte)
+	copy(key[:], r)
+	defer SliceZero(key[:])
+	buf := make([]byte, SSize+len(data))
+	copy(buf[SSize:], data)
+	salsa20.XORKeyStream(buf, buf, make([]byte, 8), key)
+	authKey := new([SSize]byte)
+	copy(authKey[:], buf[:SSize])
+	return buf[SSize:], authKey, nil
+}
+
+// Encode Ed25519 private key for storing in the key file. If
+// passphrase is not empty, then key is encrypted with it, using
+// Argon2d with default parameters.
+func KeyFileEncode(prv *[ed25519.PrivateKeySize]byte, passphrase string) (string, error) {
+	return keyFileEncode(prv, passphrase, DefaultM, DefaultT, DefaultP)
+}
+
+func keyFileEncode(prv *[ed25519.PrivateKeySize]byte, passphrase string, m, t, p int) (string, error) {
+	seed := prv[:keySeedSize]
+	if passphrase == "" {
+		return "$" + KeyFilePlain + "$" + base64.RawStdEncoding.EncodeToString(seed), nil
+	}
+	salt := make([]byte, keySaltSize)
+	if _, err := Rand.Read(salt); err != nil {
+		return "", err
+	}
+	enc, authKey, err := keyFileCipher(passphrase, salt, m, t, p, seed)
+	if err != nil {
+		return "", err
+	}
+	tag := new([TagSize]byte)
+	poly1305.Sum(tag, enc, authKey)
+	return fmt.Sprintf(
+		"$%s$m=%d,t=%d,p=%d$%s$%s",
+		KeyFileEncrypted, m, t, p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(append(tag[:], enc...)),
+	), nil
+}
+
+// Is key file's contents encrypted.
+func KeyFileIsEncrypted(data string) bool {
+	return strings.HasPrefix(data, "$"+KeyFileEncrypted+"$")
+}
+
+// Decode Ed25519 private key from the key file's contents. Passphrase
+// is used only if it is encrypted.
+func KeyFileDecode(data, passphrase string) (*[ed25519.PrivateKeySize]byte, error) {
+	s := strings.Split(strings.TrimSpace(data), "$")
+	if len(s) < 3 || s[0] != "" {
+		return nil, errors.New("Invalid key file structure")
+	}
+	var seed []byte
+	var err error
+	switch s[1] {
+	case KeyFilePlain:
+		if len(s) != 3 {
+			return nil, errors.New("Invalid key file structure")
+		}
+		if seed, err = base64.RawStdEncoding.DecodeString(s[2]); err != nil {
+			return nil, err
+		}
+	case KeyFileEncrypted:
+		if len(s) != 5 {
+			return nil, errors.New("Invalid key file structure")
+		}
+		var m, t, p int
+		n, err := fmt.Sscanf(s[2], "m=%d,t=%d,p=%d", &m, &t, &p)
+		if n != 3 || err != nil {
+			return nil, errors.New("Invalid key file parameters")
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(s[3])
+		if err != nil {
+			return nil, err
+		}
+		ct, err := base64.RawStdEncoding.DecodeString(s[4])
+		if err != nil {
+			return nil, err
+		}
+		if len(ct) != TagSize+keySeedSize {
+			return nil, errors.New("Invalid key file structure")
+		}
+		var authKey *[SSize]byte
+		seed, authKey, err = keyFileCipher(passphrase, salt, m, t, p, ct[TagSize:])
+		if err != nil {
+			return nil, err
+		}
+		tag := new([TagSize]byte)
+		poly1305.Sum(tag, ct[TagSize:], authKey)
+		if subtle.ConstantTimeCompare(tag[:], ct[:TagSize]) != 1 {
+			return nil, errors.New("Invalid key file passphrase")
+		}
+	default:
+		return nil, errors.New("Unknown key file type: " + s[1])
+	}
+	defer SliceZero(seed)
+	return keyFromSeed(seed)
+}
+
+func keyFromSeed(seed []byte) (*[ed25519.PrivateKeySize]byte, error) {
+	if len(seed) != keySeedSize {
+		return nil, errors.New("Invalid key file seed")
+	}
+	_, prv, err := ed25519.GenerateKey(bytes.NewReader(seed))
+	return prv, err
+}
+
+// Read Ed25519 private key from the key file. If it is encrypted, then
+// passphrase is read with KeyRead from passPath.
+func KeyFileRead(path, passPath string) (*[ed25519.PrivateKeySize]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var passphrase string
+	if KeyFileIsEncrypted(string(data)) {
+		if passphrase, err = KeyRead(passPath); err != nil {
+			return nil, err
+		}
+	}
+	return KeyFileDecode(string(data), passphrase)
+}
+
+// Public key of Ed25519 private key, base64 encoded. It is used for
+// server's identity pinning.
+func KeyPubString(prv *[ed25519.PrivateKeySize]byte) string {
+	return base64.RawStdEncoding.EncodeToString(prv[32:])
+}
+
+// Decode base64 encoded Ed25519 public key.
+func KeyPubFromString(s string) (*[ed25519.PublicKeySize]byte, error) {
+	raw, err := base64.RawStdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid public key size")
+	}
+	pub := new([ed25519.PublicKeySize]byte)
+	copy(pub[:], raw)
+	return pub, nil
+}
@@ -0,0 +1,90 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	v, prv, err := VerifierNewEd25519(&testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, passphrase := range []string{"", "secret"} {
+		data, err := keyFileEncode(prv, passphrase, 1<<10, 1<<4, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if KeyFileIsEncrypted(data) != (passphrase != "") {
+			t.Fatal("encryption mismatch")
+		}
+		decoded, err := KeyFileDecode(data+"\n", passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded[:], prv[:]) {
+			t.Fatal("decoded key differs")
+		}
+	}
+	data, _ := keyFileEncode(prv, "secret", 1<<10, 1<<4, 1)
+	if _, err = KeyFileDecode(data, "wrong"); err == nil {
+		t.Fatal("wrong passphrase is accepted")
+	}
+
+	parsed, err := VerifierFromString(v.LongForm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Alg != VerifierEd25519 || *parsed.Id != testPeerId || *parsed.Pub != *v.Pub {
+		t.Fatal("long form is parsed incorrectly")
+	}
+	short, err := VerifierFromString(v.ShortForm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if short.Pub != nil || *short.Id != testPeerId {
+		t.Fatal("short form is parsed incorrectly")
+	}
+	short.KeyApply(prv)
+	if *short.Pub != *v.Pub {
+		t.Fatal("applied key differs")
+	}
+}
+
+func TestHandshakeEd25519Symmetric(t *testing.T) {
+	// initial values are taken from peer_test.go's init()
+	v, prv, err := VerifierNewEd25519(&testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConf.Verifier = v
+	testConf.DSAPriv = prv
+	hsS := NewHandshake("server", Dummy{&testCt}, testConf)
+	hsC := HandshakeStart("client", Dummy{&testCt}, testConf)
+	hsS.Server(testCt)
+	hsC.Client(testCt)
+	if peer, err := hsS.Server(testCt); err != nil || peer == nil {
+		t.Fail()
+	}
+	if peer, err := hsC.Client(testCt); err != nil || peer == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,241 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"errors"
+	"time"
+)
+
+// Handshake failures caused by the wrong password: only they are
+// counted by lockouts.
+var LockoutReasons = []*HandshakeError{
+	HandshakeErrBadDecode,
+	HandshakeErrBadRandom,
+	HandshakeErrBadSignature,
+}
+
+// Failed handshakes of the peer or from the source address.
+type Lockout struct {
+	Failures int `yaml:"failures"`
+	// Number of lockouts in a row
+	Level int       `yaml:"level"`
+	Until time.Time `yaml:"until"`
+	Last  time.Time `yaml:"last"`
+}
+
+func (l *Lockout) locked(now time.Time) bool {
+	return now.Before(l.Until)
+}
+
+// Lockouts of the peers and source addresses after Attempts failed
+// handshakes in a row. Lockout lasts for Period, doubled with each
+// lockout in a row, up to Max. Zero Attempts disables lockouts. It is
+// not safe for concurrent use.
+type Lockouts struct {
+	Attempts int
+	Period   time.Duration
+	Max      time.Duration
+	peers    map[PeerId]*Lockout
+	sources  map[string]*Lockout
+}
+
+// Lockouts state, for example for the state file.
+type LockoutsState struct {
+	Peers   map[string]*Lockout `yaml:"peers,omitempty"`
+	Sources map[string]*Lockout `yaml:"sources,omitempty"`
+}
+
+func NewLockouts(attempts int, period, max time.Duration) (*Lockouts, error) {
+	if attempts < 0 || period <= 0 || max < period {
+		return nil, errors.New("Invalid lockout parameters")
+	}
+	return &Lockouts{
+		Attempts: attempts,
+		Period:   period,
+		Max:      max,
+		peers:    make(map[PeerId]*Lockout),
+		sources:  make(map[string]*Lockout),
+	}, nil
+}
+
+// Duration of the lockout with the given number of lockouts before it.
+func (ls *Lockouts) duration(level int) time.Duration {
+	duration := ls.Period
+	for i := 0; i < level; i++ {
+		if duration > ls.Max/2 {
+			return ls.Max
+		}
+		duration *= 2
+	}
+	if duration > ls.Max {
+		return ls.Max
+	}
+	return duration
+}
+
+// Account the failure. Returns lockout's duration if the attempts
+// budget is spent.
+func (ls *Lockouts) fail(l *Lockout, now time.Time) time.Duration {
+	l.Last = now
+	l.Failures++
+	if l.Failures < ls.Attempts {
+		return 0
+	}
+	duration := ls.duration(l.Level)
+	l.Until = now.Add(duration)
+	l.Level++
+	l.Failures = 0
+	return duration
+}
+
+// Has the lockout expired long enough ago to forget about it.
+func (ls *Lockouts) stale(l *Lockout, now time.Time) bool {
+	return l.Last.Add(ls.Max).Before(now) && !l.locked(now)
+}
+
+// Is either the peer or the source host locked out.
+func (ls *Lockouts) Locked(peerId *PeerId, host string, now time.Time) bool {
+	if ls.Attempts == 0 {
+		return false
+	}
+	if l, exists := ls.sources[host]; exists && l.locked(now) {
+		return true
+	}
+	l, exists := ls.peers[*peerId]
+	return exists && l.locked(now)
+}
+
+// Account the handshake failure of the peer from the source host, if
+// it looks like the password guessing. Returns durations of the peer's
+// and source's lockouts, if they are caused by that failure.
+func (ls *Lockouts) Fail(peerId *PeerId, host string, err error, now time.Time) (time.Duration, time.Duration) {
+	if ls.Attempts == 0 {
+		return 0, 0
+	}
+	guessing := false
+	for _, reason := range LockoutReasons {
+		if err == reason {
+			guessing = true
+		}
+	}
+	if !guessing {
+		return 0, 0
+	}
+	lp, exists := ls.peers[*peerId]
+	if !exists {
+		lp = new(Lockout)
+		ls.peers[*peerId] = lp
+	}
+	lh, exists := ls.sources[host]
+	if !exists {
+		lh = new(Lockout)
+		ls.sources[host] = lh
+	}
+	return ls.fail(lp, now), ls.fail(lh, now)
+}
+
+// Forget failures of the successfully handshaked peer, unless it is
+// locked out. Source host's failures are kept: other identities behind
+// it can still be guessed. Returns true if anything is forgotten.
+func (ls *Lockouts) Reset(peerId *PeerId, now time.Time) bool {
+	l, exists := ls.peers[*peerId]
+	if !exists || l.locked(now) {
+		return false
+	}
+	delete(ls.peers, *peerId)
+	return true
+}
+
+// Forget lockouts expired long ago. Returns true if any is forgotten.
+func (ls *Lockouts) Expire(now time.Time) bool {
+	changed := false
+	for peerId, l := range ls.peers {
+		if ls.stale(l, now) {
+			delete(ls.peers, peerId)
+			changed = true
+		}
+	}
+	for host, l := range ls.sources {
+		if ls.stale(l, now) {
+			delete(ls.sources, host)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Active lockouts: time left for each locked out peer and the number
+// of locked out source hosts.
+func (ls *Lockouts) Active(now time.Time) (map[PeerId]time.Duration, int) {
+	peers := make(map[PeerId]time.Duration)
+	for peerId, l := range ls.peers {
+		if l.locked(now) {
+			peers[peerId] = l.Until.Sub(now)
+		}
+	}
+	sources := 0
+	for _, l := range ls.sources {
+		if l.locked(now) {
+			sources++
+		}
+	}
+	return peers, sources
+}
+
+// Copy of the current state.
+func (ls *Lockouts) State() *LockoutsState {
+	state := LockoutsState{
+		Peers:   make(map[string]*Lockout, len(ls.peers)),
+		Sources: make(map[string]*Lockout, len(ls.sources)),
+	}
+	for peerId, l := range ls.peers {
+		lc := *l
+		state.Peers[peerId.String()] = &lc
+	}
+	for host, l := range ls.sources {
+		lc := *l
+		state.Sources[host] = &lc
+	}
+	return &state
+}
+
+// Restore previously saved state. Invalid entries are skipped and the
+// error is returned about them.
+func (ls *Lockouts) Restore(state *LockoutsState) error {
+	var err error
+	for idRaw, l := range state.Peers {
+		peerId, errId := PeerIdFromString(idRaw)
+		if errId != nil || l == nil {
+			err = errors.New("Invalid lockout: " + idRaw)
+			continue
+		}
+		lc := *l
+		ls.peers[*peerId] = &lc
+	}
+	for host, l := range state.Sources {
+		if l == nil {
+			err = errors.New("Invalid lockout: " + host)
+			continue
+		}
+		lc := *l
+		ls.sources[host] = &lc
+	}
+	return err
+}
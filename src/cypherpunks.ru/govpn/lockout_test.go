@@ -0,0 +1,188 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	ls, _ := NewLockouts(3, time.Minute, time.Hour)
+	for _, c := range []struct {
+		level    int
+		duration time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{5, 32 * time.Minute},
+		{6, time.Hour},
+		{31, time.Hour},
+		{40, time.Hour},
+		{64, time.Hour},
+		{1000, time.Hour},
+	} {
+		if d := ls.duration(c.level); d != c.duration {
+			t.Error("Level", c.level, "unexpected duration", d)
+		}
+	}
+}
+
+func TestLockoutsFail(t *testing.T) {
+	now := time.Now()
+	peer := PeerId{1}
+	for _, c := range []struct {
+		failures int
+		level    int
+		err      error
+		duration time.Duration
+		after    int
+	}{
+		{0, 0, HandshakeErrBadDecode, 0, 1},
+		{1, 0, HandshakeErrBadRandom, 0, 2},
+		{2, 0, HandshakeErrBadSignature, time.Minute, 0},
+		{2, 3, HandshakeErrBadDecode, 8 * time.Minute, 0},
+		{2, 0, HandshakeErrUnknownId, 0, 2},
+		{2, 0, HandshakeErrBadLength, 0, 2},
+		{2, 0, HandshakeErrTimeSync, 0, 2},
+	} {
+		ls, _ := NewLockouts(3, time.Minute, time.Hour)
+		ls.peers[peer] = &Lockout{Failures: c.failures, Level: c.level}
+		ls.sources["192.0.2.1"] = &Lockout{Failures: c.failures, Level: c.level}
+		peerDuration, sourceDuration := ls.Fail(&peer, "192.0.2.1", c.err, now)
+		if peerDuration != c.duration || sourceDuration != c.duration {
+			t.Error(c, "unexpected durations", peerDuration, sourceDuration)
+		}
+		locked := c.duration > 0
+		if ls.Locked(&peer, "192.0.2.2", now) != locked {
+			t.Error(c, "unexpected peer lockout")
+		}
+		if ls.Locked(&PeerId{2}, "192.0.2.1", now) != locked {
+			t.Error(c, "unexpected source lockout")
+		}
+		if ls.Locked(&peer, "192.0.2.1", now.Add(c.duration)) {
+			t.Error(c, "lockout has not ended")
+		}
+		if ls.peers[peer].Failures != c.after {
+			t.Error(c, "unexpected failures", ls.peers[peer].Failures)
+		}
+	}
+}
+
+func TestLockoutsDisabled(t *testing.T) {
+	ls, _ := NewLockouts(0, time.Minute, time.Hour)
+	peer := PeerId{1}
+	for i := 0; i < 10; i++ {
+		ls.Fail(&peer, "192.0.2.1", HandshakeErrBadDecode, time.Now())
+	}
+	if ls.Locked(&peer, "192.0.2.1", time.Now()) {
+		t.Fatal("Disabled lockouts lock out")
+	}
+	if _, err := NewLockouts(1, time.Hour, time.Minute); err == nil {
+		t.Fatal("Maximal duration lower than initial one is accepted")
+	}
+}
+
+func TestLockoutsReset(t *testing.T) {
+	now := time.Now()
+	peer, other := PeerId{1}, PeerId{2}
+	ls, _ := NewLockouts(2, time.Minute, time.Hour)
+	ls.Fail(&peer, "192.0.2.1", HandshakeErrBadDecode, now)
+	if !ls.Reset(&peer, now) {
+		t.Fatal("Peer failures are not forgotten")
+	}
+	if ls.sources["192.0.2.1"] == nil || ls.sources["192.0.2.1"].Failures != 1 {
+		t.Fatal("Source failures are forgotten")
+	}
+	// Valid peer behind the same address does not help guessing others
+	ls.Fail(&other, "192.0.2.1", HandshakeErrBadDecode, now)
+	ls.Reset(&peer, now)
+	if !ls.Locked(&PeerId{3}, "192.0.2.1", now) {
+		t.Fatal("Source is not locked out")
+	}
+	ls.Fail(&other, "192.0.2.1", HandshakeErrBadDecode, now)
+	if ls.Reset(&other, now) || !ls.Locked(&other, "192.0.2.2", now) {
+		t.Fatal("Active lockout is reset")
+	}
+	later := now.Add(time.Minute)
+	if !ls.Reset(&other, later) || ls.Locked(&other, "192.0.2.2", later) {
+		t.Fatal("Expired lockout is not reset")
+	}
+}
+
+func TestLockoutsExpire(t *testing.T) {
+	now := time.Now()
+	peer := PeerId{1}
+	ls, _ := NewLockouts(1, time.Minute, time.Hour)
+	ls.Fail(&peer, "192.0.2.1", HandshakeErrBadDecode, now)
+	for _, c := range []struct {
+		after time.Duration
+		stale bool
+	}{
+		{0, false},
+		{time.Minute, false},
+		{time.Hour, false},
+		{time.Hour + time.Second, true},
+	} {
+		if ls.stale(ls.peers[peer], now.Add(c.after)) != c.stale {
+			t.Error(c.after, "unexpected staleness")
+		}
+	}
+	if ls.Expire(now.Add(time.Hour)) {
+		t.Fatal("Recent lockouts expired")
+	}
+	if !ls.Expire(now.Add(2*time.Hour)) || len(ls.peers) != 0 || len(ls.sources) != 0 {
+		t.Fatal("Old lockouts are not expired")
+	}
+}
+
+func TestLockoutsState(t *testing.T) {
+	now := time.Now().Round(time.Second)
+	peer := PeerId{1}
+	ls, _ := NewLockouts(1, time.Minute, time.Hour)
+	ls.Fail(&peer, "192.0.2.1", HandshakeErrBadDecode, now)
+	data, err := yaml.Marshal(ls.State())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state LockoutsState
+	if err = yaml.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := NewLockouts(1, time.Minute, time.Hour)
+	if err = restored.Restore(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Locked(&peer, "192.0.2.2", now) || !restored.Locked(&PeerId{2}, "192.0.2.1", now) {
+		t.Fatal("Lockouts are not restored")
+	}
+	if l := restored.peers[peer]; l.Level != 1 || !l.Until.Equal(now.Add(time.Minute)) || !l.Last.Equal(now) {
+		t.Fatal("Lockout mismatch", l)
+	}
+	state.Peers["invalid"] = &Lockout{}
+	if err = restored.Restore(&state); err == nil {
+		t.Fatal("Invalid lockout is restored")
+	}
+	peers, sources := restored.Active(now)
+	if len(peers) != 1 || peers[peer] != time.Minute || sources != 1 {
+		t.Fatal("Unexpected active lockouts", peers, sources)
+	}
+}
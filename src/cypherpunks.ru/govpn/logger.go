@@ -0,0 +1,311 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	// Logging targets, optionally followed by ":" and socket path
+	LogTargetSyslog   = "syslog"
+	LogTargetJournald = "journald"
+
+	JournaldSocket = "/run/systemd/journal/socket"
+
+	// Fields describing the event
+	LogFieldEvent  = "event"
+	LogFieldPeer   = "peer"
+	LogFieldPeerId = "peer_id"
+	LogFieldAddr   = "addr"
+	LogFieldError  = "error"
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// Parse level name: debug, info, warn or error.
+func LogLevelParse(name string) (LogLevel, error) {
+	for l, n := range logLevelNames {
+		if n == name {
+			return LogLevel(l), nil
+		}
+	}
+	return LogInfo, errors.New("Unknown log level: " + name)
+}
+
+type logOutput struct {
+	sync.Mutex
+	level   LogLevel
+	format  string
+	w       io.Writer
+	syslog  *syslog.Writer
+	journal net.Conn
+	tag     string
+}
+
+var logOut = &logOutput{
+	level:  LogInfo,
+	format: LogFormatText,
+	w:      os.Stderr,
+	tag:    filepath.Base(os.Args[0]),
+}
+
+// Configure the logging: minimal level, format (text or json) and the
+// target. Empty target means stderr, syslog[:path] and journald[:path]
+// send records to the local socket.
+func LogSetup(level, format, target string) error {
+	l, err := LogLevelParse(level)
+	if err != nil {
+		return err
+	}
+	if format != LogFormatText && format != LogFormatJSON {
+		return errors.New("Unknown log format: " + format)
+	}
+	kind, path := target, ""
+	if i := strings.Index(target, ":"); i != -1 {
+		kind, path = target[:i], target[i+1:]
+	}
+	var sl *syslog.Writer
+	var journal net.Conn
+	switch kind {
+	case "":
+	case LogTargetSyslog:
+		if path == "" {
+			sl, err = syslog.New(syslog.LOG_DAEMON, logOut.tag)
+		} else {
+			sl, err = syslog.Dial("unixgram", path, syslog.LOG_DAEMON, logOut.tag)
+		}
+	case LogTargetJournald:
+		if path == "" {
+			path = JournaldSocket
+		}
+		journal, err = net.Dial("unixgram", path)
+	default:
+		return errors.New("Unknown log target: " + target)
+	}
+	if err != nil {
+		return err
+	}
+	logOut.Lock()
+	slPrev, journalPrev := logOut.syslog, logOut.journal
+	logOut.level, logOut.format, logOut.syslog, logOut.journal = l, format, sl, journal
+	logOut.Unlock()
+	if slPrev != nil {
+		slPrev.Close()
+	}
+	if journalPrev != nil {
+		journalPrev.Close()
+	}
+	return nil
+}
+
+// Single log record being prepared.
+type LogEntry struct {
+	fields map[string]interface{}
+}
+
+// Start the record of the event of specified type, like
+// "peer_created" or "handshake_failed".
+func LogEvent(event string) *LogEntry {
+	return &LogEntry{fields: map[string]interface{}{LogFieldEvent: event}}
+}
+
+// Add arbitrary field.
+func (e *LogEntry) Field(key string, value interface{}) *LogEntry {
+	if s, ok := value.(fmt.Stringer); ok {
+		value = s.String()
+	}
+	e.fields[key] = value
+	return e
+}
+
+// Add the peer's name, identity and remote address.
+func (e *LogEntry) Peer(p *Peer) *LogEntry {
+	e.fields[LogFieldAddr] = p.Addr
+	return e.PeerName(p.Name).PeerId(p.Id)
+}
+
+// Add the peer's name, if it is known.
+func (e *LogEntry) PeerName(name string) *LogEntry {
+	if name != "" {
+		e.fields[LogFieldPeer] = name
+	}
+	return e
+}
+
+// Add the peer's identity, if it is known.
+func (e *LogEntry) PeerId(id *PeerId) *LogEntry {
+	if id != nil {
+		e.fields[LogFieldPeerId] = id.String()
+	}
+	return e
+}
+
+func (e *LogEntry) Addr(addr string) *LogEntry {
+	e.fields[LogFieldAddr] = addr
+	return e
+}
+
+func (e *LogEntry) Err(err error) *LogEntry {
+	if err != nil {
+		e.fields[LogFieldError] = err.Error()
+	}
+	return e
+}
+
+func (e *LogEntry) Debug(msg string) { e.write(LogDebug, msg) }
+func (e *LogEntry) Info(msg string)  { e.write(LogInfo, msg) }
+func (e *LogEntry) Warn(msg string)  { e.write(LogWarn, msg) }
+func (e *LogEntry) Error(msg string) { e.write(LogError, msg) }
+
+// Write the record with error level and terminate the program.
+func (e *LogEntry) Fatal(msg string) {
+	e.write(LogError, msg)
+	os.Exit(1)
+}
+
+// Fields as sorted key=value pairs, event first.
+func (e *LogEntry) text() string {
+	keys := make([]string, 0, len(e.fields))
+	for k := range e.fields {
+		if k != LogFieldEvent {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{LogFieldEvent}, keys...)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := fmt.Sprint(e.fields[k])
+		if v == "" || strings.ContainsAny(v, " \"=\n") {
+			v = strconv.Quote(v)
+		}
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (e *LogEntry) write(level LogLevel, msg string) {
+	logOut.Lock()
+	defer logOut.Unlock()
+	if level < logOut.level {
+		return
+	}
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(2); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	if logOut.journal != nil {
+		logOut.journal.Write(e.journald(level, msg, caller))
+		return
+	}
+	var record string
+	if logOut.format == LogFormatJSON {
+		fields := make(map[string]interface{}, len(e.fields)+4)
+		for k, v := range e.fields {
+			fields[k] = v
+		}
+		if logOut.syslog == nil {
+			fields["time"] = time.Now().Format(time.RFC3339Nano)
+		}
+		fields["level"] = level.String()
+		fields["caller"] = caller
+		fields["msg"] = msg
+		data, err := json.Marshal(fields)
+		if err != nil {
+			data = []byte(strconv.Quote(err.Error()))
+		}
+		record = string(data)
+	} else {
+		record = caller + ": " + strings.ToUpper(level.String()) + " " + msg + " " + e.text()
+		if logOut.syslog == nil {
+			record = time.Now().Format("2006/01/02 15:04:05.000000") + " " + record
+		}
+	}
+	if logOut.syslog != nil {
+		switch level {
+		case LogDebug:
+			logOut.syslog.Debug(record)
+		case LogInfo:
+			logOut.syslog.Info(record)
+		case LogWarn:
+			logOut.syslog.Warning(record)
+		default:
+			logOut.syslog.Err(record)
+		}
+		return
+	}
+	io.WriteString(logOut.w, record+"\n")
+}
+
+// Serialize the record using journald's native protocol. Field names
+// are uppercased and prefixed with GOVPN_.
+func (e *LogEntry) journald(level LogLevel, msg, caller string) []byte {
+	priority := map[LogLevel]string{LogDebug: "7", LogInfo: "6", LogWarn: "4", LogError: "3"}
+	var buf bytes.Buffer
+	add := func(k, v string) {
+		if !strings.Contains(v, "\n") {
+			buf.WriteString(k + "=" + v + "\n")
+			return
+		}
+		size := make([]byte, 8)
+		binary.LittleEndian.PutUint64(size, uint64(len(v)))
+		buf.WriteString(k + "\n")
+		buf.Write(size)
+		buf.WriteString(v + "\n")
+	}
+	add("MESSAGE", msg)
+	add("PRIORITY", priority[level])
+	add("SYSLOG_IDENTIFIER", logOut.tag)
+	add("CODE_FILE", caller[:strings.LastIndex(caller, ":")])
+	add("CODE_LINE", caller[strings.LastIndex(caller, ":")+1:])
+	for k, v := range e.fields {
+		add("GOVPN_"+strings.ToUpper(k), fmt.Sprint(v))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,147 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func logCapture(t *testing.T, level, format string) *bytes.Buffer {
+	if err := LogSetup(level, format, ""); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	logOut.w = buf
+	return buf
+}
+
+func logRestore() {
+	LogSetup("info", LogFormatText, "")
+	logOut.w = os.Stderr
+}
+
+func TestLogText(t *testing.T) {
+	defer logRestore()
+	buf := logCapture(t, "warn", LogFormatText)
+	peer := newPeer(true, "127.0.0.1:1194", Dummy{nil}, testConf, new([SSize]byte))
+	peer.Name = "alice smith"
+	LogEvent("peer_created").Peer(peer).Info("Peer created")
+	if buf.Len() != 0 {
+		t.Fatal("level is not respected")
+	}
+	LogEvent("peer_kicked").Peer(peer).Warn("Kicking peer")
+	line := buf.String()
+	for _, s := range []string{
+		"logger_test.go:",
+		" WARN Kicking peer event=peer_kicked ",
+		"addr=127.0.0.1:1194",
+		`peer="alice smith"`,
+		"peer_id=" + peer.Id.String(),
+	} {
+		if !strings.Contains(line, s) {
+			t.Fatal("no", s, "in", line)
+		}
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	defer logRestore()
+	buf := logCapture(t, "debug", LogFormatJSON)
+	LogEvent("handshake_failed").PeerId(testConf.Id).Addr("[::1]:1").Field("size", 10).Debug("Invalid")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"level":   "debug",
+		"msg":     "Invalid",
+		"event":   "handshake_failed",
+		"peer_id": testConf.Id.String(),
+		"addr":    "[::1]:1",
+		"size":    float64(10),
+	} {
+		if record[k] != v {
+			t.Fatal("invalid", k, record[k])
+		}
+	}
+	if _, exists := record["time"]; !exists {
+		t.Fatal("no time")
+	}
+}
+
+func TestLogSetup(t *testing.T) {
+	defer logRestore()
+	if LogSetup("verbose", LogFormatText, "") == nil {
+		t.Fatal("unknown level accepted")
+	}
+	if LogSetup("info", "xml", "") == nil {
+		t.Fatal("unknown format accepted")
+	}
+	if LogSetup("info", LogFormatText, "file:/tmp/log") == nil {
+		t.Fatal("unknown target accepted")
+	}
+}
+
+func TestLogSetupCloses(t *testing.T) {
+	defer logRestore()
+	dir, err := ioutil.TempDir("", "govpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "journal")
+	sock, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	if err = LogSetup("info", LogFormatText, LogTargetJournald+":"+path); err != nil {
+		t.Fatal(err)
+	}
+	journal := logOut.journal
+	if err = LogSetup("info", LogFormatText, LogTargetSyslog+":"+path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = journal.Write([]byte("MESSAGE=test\n")); err == nil {
+		t.Fatal("previous journald connection is not closed")
+	}
+}
+
+func TestLogJournald(t *testing.T) {
+	data := LogEvent("peer_created").Field("env", "A=1\nB=2").journald(LogInfo, "Peer created", "tcp.go:10")
+	for _, s := range []string{
+		"MESSAGE=Peer created\n",
+		"PRIORITY=6\n",
+		"CODE_FILE=tcp.go\n",
+		"CODE_LINE=10\n",
+		"GOVPN_EVENT=peer_created\n",
+		"GOVPN_ENV\n\x07\x00\x00\x00\x00\x00\x00\x00A=1\nB=2\n",
+	} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Fatalf("no %q in %q", s, data)
+		}
+	}
+}
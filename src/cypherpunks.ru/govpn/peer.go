@@ -22,7 +22,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,6 +45,8 @@ const (
 	MinPktLength = 1 + 16 + 8
 	// Padding byte
 	PadByte = byte(0x80)
+	// Padding byte of control (not destined to TAP) messages
+	CtrlPadByte = byte(0x81)
 )
 
 func newNonceCipher(key *[32]byte) *xtea.Cipher {
@@ -73,12 +74,19 @@ type Peer struct {
 	FramesOut       uint64
 	FramesUnauth    uint64
 	FramesDup       uint64
+	FramesACLIn     uint64
+	FramesACLOut    uint64
+	FramesRateIn    uint64
+	FramesRateOut   uint64
 	HeartbeatRecv   uint64
 	HeartbeatSent   uint64
+	Rekeys          uint64
+	bytesKey        uint64
 
 	// Basic
 	Addr string
 	Id   *PeerId
+	Name string
 	Conn io.Writer `json:"-"`
 
 	// Traffic behaviour
@@ -87,10 +95,20 @@ type Peer struct {
 	CPRCycle    time.Duration `json:"-"`
 	Encless     bool
 	MTU         int
+	Mode        string
+	ACL         *ACL `json:"-"`
+	rateIn      *TokenBucket
+	rateOut     *TokenBucket
 
-	// Cryptography related
+	// Cryptography related. Key and NonceCipher are used for
+	// transmission, receiving ones can differ during rekeying.
 	Key          *[SSize]byte `json:"-"`
 	NonceCipher  *xtea.Cipher `json:"-"`
+	keyR         *sessionKey
+	keyPrev      *sessionKey
+	keyPrevUntil time.Time
+	keyNext      *sessionKey
+	isClient     bool
 	nonceRecv    uint64
 	nonceLatest  uint64
 	nonceOur     uint64
@@ -101,6 +119,16 @@ type Peer struct {
 	nonceFound1  bool
 	nonceBucketN int32
 
+	// Rekeying
+	RekeyInterval time.Duration `json:"-"`
+	rekeyed       time.Time
+	rekeyStarted  time.Time
+	rekeyPriv     *[32]byte
+	rekeyPub      *[32]byte
+
+	// Handler of received control messages, called synchronously
+	CtrlHandler func(typ byte, data []byte) `json:"-"`
+
 	// Timers
 	Timeout       time.Duration `json:"-"`
 	Established   time.Time
@@ -130,9 +158,17 @@ func (p *Peer) String() string {
 
 // Zero peer's memory state.
 func (p *Peer) Zero() {
-	p.BusyT.Lock()
 	p.BusyR.Lock()
+	p.BusyT.Lock()
 	SliceZero(p.Key[:])
+	SliceZero(p.keyR.key[:])
+	if p.keyPrev != nil {
+		SliceZero(p.keyPrev.key[:])
+	}
+	if p.keyNext != nil {
+		SliceZero(p.keyNext.key[:])
+	}
+	p.rekeyAbort()
 	SliceZero(p.bufR)
 	SliceZero(p.bufT)
 	SliceZero(p.keyAuthR[:])
@@ -143,7 +179,7 @@ func (p *Peer) Zero() {
 
 func (p *Peer) NonceExpectation(buf []byte) {
 	binary.BigEndian.PutUint64(buf, p.NonceExpect)
-	p.NonceCipher.Encrypt(buf, buf)
+	p.keyR.nonceCipher.Encrypt(buf, buf)
 }
 
 func cprCycleCalculate(conf *PeerConf) time.Duration {
@@ -180,6 +216,7 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 	peer := Peer{
 		Addr: addr,
 		Id:   conf.Id,
+		Name: conf.Name,
 		Conn: conn,
 
 		NoiseEnable: noiseEnable,
@@ -187,12 +224,20 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 		CPRCycle:    cprCycle,
 		Encless:     conf.Encless,
 		MTU:         conf.MTU,
+		Mode:        conf.Mode,
+		ACL:         conf.ACL,
+		rateIn:      NewTokenBucket(conf.Rate.In * 1024),
+		rateOut:     NewTokenBucket(conf.Rate.Out * 1024),
 
 		Key:          key,
-		NonceCipher:  newNonceCipher(key),
+		keyR:         newSessionKey(key),
+		isClient:     isClient,
 		nonceBucket0: make(map[uint64]struct{}, NonceBucketSize),
 		nonceBucket1: make(map[uint64]struct{}, NonceBucketSize),
 
+		RekeyInterval: conf.Rekey,
+		rekeyed:       now,
+
 		Timeout:     timeout,
 		Established: now,
 		LastPing:    now,
@@ -204,6 +249,13 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 		keyAuthR: new([SSize]byte),
 		keyAuthT: new([SSize]byte),
 	}
+	peer.NonceCipher = peer.keyR.nonceCipher
+	if peer.Mode == "" {
+		peer.Mode = ModeTAP
+	}
+	if peer.RekeyInterval == 0 {
+		peer.RekeyInterval = RekeyIntervalDefault
+	}
 	if isClient {
 		peer.nonceOur = 1
 		peer.NonceExpect = 0 + 2
@@ -215,24 +267,72 @@ func newPeer(isClient bool, addr string, conn io.Writer, conf *PeerConf, key *[S
 
 }
 
-// Process incoming Ethernet packet.
+// Check that TUN frame looks like IPv4/IPv6 packet. TAP frames are
+// passed as is.
+func (p *Peer) frameValid(data []byte) bool {
+	if p.Mode != ModeTUN {
+		return true
+	}
+	if len(data) < IPHeaderMinSize {
+		return false
+	}
+	version := data[0] >> 4
+	return version == 4 || version == 6
+}
+
+// Process incoming Ethernet packet (or IP packet in TUN mode).
 // ready channel is TAPListen's synchronization channel used to tell him
 // that he is free to receive new packets. Encrypted and authenticated
 // packets will be sent to remote Peer side immediately.
 func (p *Peer) EthProcess(data []byte) {
 	if len(data) > p.MTU-1 { // 1 is for padding byte
-		log.Println("Padded data packet size", len(data)+1, "is bigger than MTU", p.MTU, p)
+		LogEvent("frame_too_big").Peer(p).Field("size", len(data)+1).Field("mtu", p.MTU).Warn(
+			"Padded data packet is bigger than MTU",
+		)
 		return
 	}
-	p.now = time.Now()
+	if len(data) > 0 && !p.frameValid(data) {
+		LogEvent("frame_malformed").Peer(p).Field("mode", p.Mode).Field("size", len(data)).Warn("Malformed frame")
+		return
+	}
+	if len(data) > 0 && !p.ACL.Out(p.Mode, data) {
+		atomic.AddUint64(&p.FramesACLOut, 1)
+		return
+	}
+	if len(data) > 0 && !p.rateOut.Allow(len(data), time.Now()) {
+		atomic.AddUint64(&p.FramesRateOut, 1)
+		return
+	}
+	if len(data) == 0 {
+		p.rekeyCheck()
+	}
+	p.frameSend(data, PadByte)
+}
+
+// Send control message of specified type to the remote side. It is
+// delivered to remote's CtrlHandler instead of TAP interface.
+func (p *Peer) CtrlProcess(typ byte, data []byte) {
+	if len(data)+1 > p.MTU-1 {
+		LogEvent("frame_too_big").Peer(p).Field("size", len(data)+2).Field("mtu", p.MTU).Warn("Control message is bigger than MTU")
+		return
+	}
+	p.frameSend(append([]byte{typ}, data...), CtrlPadByte)
+}
+
+func (p *Peer) frameSend(data []byte, pad byte) {
 	p.BusyT.Lock()
+	p.frameSendLocked(data, pad)
+	p.BusyT.Unlock()
+}
+
+func (p *Peer) frameSendLocked(data []byte, pad byte) {
+	p.now = time.Now()
 
 	// Zero size is a heartbeat packet
 	SliceZero(p.bufT)
 	if len(data) == 0 {
 		// If this heartbeat is necessary
 		if !p.LastSent.Add(p.Timeout).Before(p.now) {
-			p.BusyT.Unlock()
 			return
 		}
 		p.bufT[S20BS+0] = PadByte
@@ -241,8 +341,10 @@ func (p *Peer) EthProcess(data []byte) {
 		// Copy payload to our internal buffer and we are ready to
 		// accept the next one
 		copy(p.bufT[S20BS:], data)
-		p.bufT[S20BS+len(data)] = PadByte
-		p.BytesPayloadOut += uint64(len(data))
+		p.bufT[S20BS+len(data)] = pad
+		if pad == PadByte {
+			p.BytesPayloadOut += uint64(len(data))
+		}
 	}
 
 	if p.NoiseEnable && !p.Encless {
@@ -270,6 +372,7 @@ func (p *Peer) EthProcess(data []byte) {
 			panic(err)
 		}
 		out = append(out, p.frameT[len(p.frameT)-NonceSize:]...)
+		atomic.AddUint64(&p.BytesOut, uint64(len(out)))
 	} else {
 		salsa20.XORKeyStream(
 			p.bufT[:S20BS+len(p.frameT)-NonceSize],
@@ -284,7 +387,9 @@ func (p *Peer) EthProcess(data []byte) {
 	}
 	p.FramesOut++
 
-	if p.CPRCycle != time.Duration(0) {
+	// Control messages are not delayed: they are sent from the
+	// receiving path too, that must not be blocked
+	if p.CPRCycle != time.Duration(0) && pad != CtrlPadByte {
 		p.willSentCycle = p.LastSent.Add(p.CPRCycle)
 		if p.willSentCycle.After(p.now) {
 			time.Sleep(p.willSentCycle.Sub(p.now))
@@ -294,49 +399,68 @@ func (p *Peer) EthProcess(data []byte) {
 
 	p.LastSent = p.now
 	p.Conn.Write(out)
-	p.BusyT.Unlock()
 }
 
-func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
-	if len(data) < MinPktLength {
-		return false
-	}
-	if !p.Encless && len(data) > len(p.bufR)-S20BS {
-		return false
-	}
-	var out []byte
-	p.BusyR.Lock()
+// Decrypt and authenticate packet with specified key. Returns nil if
+// it fails.
+func (p *Peer) pktDecrypt(data []byte, key *[SSize]byte) []byte {
 	if p.Encless {
-		var err error
-		out, err = EnclessDecode(
-			p.Key,
+		out, err := EnclessDecode(
+			key,
 			data[len(data)-NonceSize:],
 			data[:len(data)-NonceSize],
 		)
 		if err != nil {
-			p.FramesUnauth++
-			p.BusyR.Unlock()
-			return false
-		}
-	} else {
-		for i := 0; i < SSize; i++ {
-			p.bufR[i] = 0
+			return nil
 		}
-		copy(p.bufR[S20BS:], data[TagSize:])
-		salsa20.XORKeyStream(
-			p.bufR[:S20BS+len(data)-TagSize-NonceSize],
-			p.bufR[:S20BS+len(data)-TagSize-NonceSize],
-			data[len(data)-NonceSize:],
-			p.Key,
-		)
-		copy(p.keyAuthR[:], p.bufR[:SSize])
-		copy(p.tagR[:], data[:TagSize])
-		if !poly1305.Verify(p.tagR, data[TagSize:], p.keyAuthR) {
-			p.FramesUnauth++
-			p.BusyR.Unlock()
+		return out
+	}
+	for i := 0; i < SSize; i++ {
+		p.bufR[i] = 0
+	}
+	copy(p.bufR[S20BS:], data[TagSize:])
+	salsa20.XORKeyStream(
+		p.bufR[:S20BS+len(data)-TagSize-NonceSize],
+		p.bufR[:S20BS+len(data)-TagSize-NonceSize],
+		data[len(data)-NonceSize:],
+		key,
+	)
+	copy(p.keyAuthR[:], p.bufR[:SSize])
+	copy(p.tagR[:], data[:TagSize])
+	if !poly1305.Verify(p.tagR, data[TagSize:], p.keyAuthR) {
+		return nil
+	}
+	return p.bufR[S20BS : S20BS+len(data)-TagSize-NonceSize]
+}
+
+func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
+	if len(data) < MinPktLength {
+		return false
+	}
+	if p.Encless {
+		// Datagrams are not framed by us, so check size explicitly
+		if len(data) < EnclessEnlargeSize+NonceSize || len(data) > EnclessEnlargeSize+p.MTU {
 			return false
 		}
-		out = p.bufR[S20BS : S20BS+len(data)-TagSize-NonceSize]
+	} else if len(data) > len(p.bufR)-S20BS {
+		return false
+	}
+	p.BusyR.Lock()
+	// During rekeying either the new or previous key can be used
+	key := p.keyR
+	out := p.pktDecrypt(data, key.key)
+	if out == nil && p.keyNext != nil {
+		key = p.keyNext
+		out = p.pktDecrypt(data, key.key)
+	}
+	if out == nil && p.keyPrev != nil {
+		key = p.keyPrev
+		out = p.pktDecrypt(data, key.key)
+	}
+	if out == nil {
+		p.FramesUnauth++
+		p.BusyR.Unlock()
+		return false
 	}
 
 	// Check if received nonce is known to us in either of two buckets.
@@ -344,7 +468,7 @@ func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
 	// Check from the oldest bucket, as in most cases this will result
 	// in constant time check.
 	// If Bucket0 is filled, then it becomes Bucket1.
-	p.NonceCipher.Decrypt(
+	key.nonceCipher.Decrypt(
 		data[len(data)-NonceSize:],
 		data[len(data)-NonceSize:],
 	)
@@ -375,11 +499,20 @@ func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
 	if p.nonceRecv > p.nonceLatest {
 		p.nonceLatest = p.nonceRecv
 	}
+	if key == p.keyNext {
+		// Remote side has already switched to the new key
+		p.rekeyPromote()
+	}
 
 	p.FramesIn++
 	atomic.AddUint64(&p.BytesIn, uint64(len(data)))
 	p.LastPing = time.Now()
 	p.pktSizeR = bytes.LastIndexByte(out, PadByte)
+	ctrl := false
+	if i := bytes.LastIndexByte(out, CtrlPadByte); i > p.pktSizeR {
+		p.pktSizeR = i
+		ctrl = true
+	}
 	if p.pktSizeR == -1 {
 		p.BusyR.Unlock()
 		return false
@@ -392,12 +525,31 @@ func (p *Peer) PktProcess(data []byte, tap io.Writer, reorderable bool) bool {
 		}
 	}
 
+	if ctrl {
+		if p.pktSizeR > 0 && !p.rekeyCtrl(out[0], out[1:p.pktSizeR]) && p.CtrlHandler != nil {
+			msg := make([]byte, p.pktSizeR-1)
+			copy(msg, out[1:p.pktSizeR])
+			p.CtrlHandler(out[0], msg)
+		}
+		p.BusyR.Unlock()
+		return true
+	}
 	if p.pktSizeR == 0 {
 		p.HeartbeatRecv++
 		p.BusyR.Unlock()
 		return true
 	}
 	p.BytesPayloadIn += uint64(p.pktSizeR)
+	if !p.ACL.In(p.Mode, out[:p.pktSizeR]) {
+		p.FramesACLIn++
+		p.BusyR.Unlock()
+		return true
+	}
+	if !p.rateIn.Allow(p.pktSizeR, p.LastPing) {
+		p.FramesRateIn++
+		p.BusyR.Unlock()
+		return true
+	}
 	tap.Write(out[:p.pktSizeR])
 	p.BusyR.Unlock()
 	return true
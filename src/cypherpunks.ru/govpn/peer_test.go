@@ -19,6 +19,7 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"bytes"
 	"testing"
 	"testing/quick"
 	"time"
@@ -135,3 +136,179 @@ func TestTransportBigger(t *testing.T) {
 	Rand.Read(tmp)
 	testPeer.PktProcess(tmp, Dummy{nil}, true)
 }
+
+func TestTransportTUN(t *testing.T) {
+	conf := *testConf
+	conf.Mode = ModeTUN
+	var ct []byte
+	peerTx := newPeer(true, "foo", Dummy{&ct}, &conf, new([SSize]byte))
+	peerRx := newPeer(true, "foo", Dummy{nil}, &conf, new([SSize]byte))
+	pkt := make([]byte, 60)
+	pkt[0] = 0x45
+	peerTx.EthProcess(pkt)
+	if !peerRx.PktProcess(ct, Dummy{nil}, true) {
+		t.Fail()
+	}
+	ct = nil
+	pkt[0] = 0x00
+	peerTx.EthProcess(pkt)
+	peerTx.EthProcess(pkt[:IPHeaderMinSize-1])
+	if ct != nil {
+		t.Fail()
+	}
+}
+
+func TestTransportCtrl(t *testing.T) {
+	var ct []byte
+	peerTx := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerRx := newPeer(true, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	var gotTyp byte
+	var got []byte
+	peerRx.CtrlHandler = func(typ byte, data []byte) {
+		gotTyp = typ
+		got = data
+	}
+	peerTx.CtrlProcess(CtrlEnv, []byte("FOO=bar\x80"))
+	var tapped []byte
+	if !peerRx.PktProcess(ct, Dummy{&tapped}, true) {
+		t.Fatal("Control message is not authenticated")
+	}
+	if tapped != nil || gotTyp != CtrlEnv || string(got) != "FOO=bar\x80" {
+		t.Fatal("Control message is not delivered")
+	}
+	peerTx.EthProcess([]byte("payload\x81"))
+	if !peerRx.PktProcess(ct, Dummy{&tapped}, true) || string(tapped) != "payload\x81" {
+		t.Fatal("Data message is not delivered")
+	}
+}
+
+func TestTransportCtrlNotPaced(t *testing.T) {
+	conf := *testConf
+	conf.CPR = 16
+	peer := newPeer(true, "foo", Dummy{nil}, &conf, new([SSize]byte))
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		peer.CtrlProcess(CtrlEnv, []byte("FOO=bar"))
+	}
+	if time.Since(started) >= peer.CPRCycle {
+		t.Fatal("Control messages are delayed by CPR")
+	}
+}
+
+func TestTransportEnclessReordered(t *testing.T) {
+	conf := *testConf
+	conf.Encless = true
+	var q [][]byte
+	peerTx := newPeer(true, "foo", dummyQueue{&q}, &conf, new([SSize]byte))
+	peerRx := newPeer(true, "foo", Dummy{nil}, &conf, new([SSize]byte))
+	for i := 0; i < 3; i++ {
+		peerTx.EthProcess(testPt[:100+i])
+	}
+	// Serial is decrypted in place
+	dup := make([]byte, len(q[0]))
+	copy(dup, q[0])
+	for _, i := range []int{2, 0, 1} {
+		if !peerRx.PktProcess(q[i], Dummy{nil}, true) {
+			t.Fatal("Reordered packet is not accepted", i)
+		}
+	}
+	if peerRx.PktProcess(dup, Dummy{nil}, true) || peerRx.FramesDup != 1 {
+		t.Fatal("Duplicate packet is accepted")
+	}
+	if peerRx.PktProcess(q[1][:MinPktLength], Dummy{nil}, true) {
+		t.Fatal("Truncated packet is accepted")
+	}
+}
+
+type dummyQueue struct {
+	pkts *[][]byte
+}
+
+func (d dummyQueue) Write(b []byte) (int, error) {
+	pkt := make([]byte, len(b))
+	copy(pkt, b)
+	*d.pkts = append(*d.pkts, pkt)
+	return len(b), nil
+}
+
+func TestTransportRekey(t *testing.T) {
+	var qC, qS [][]byte
+	client := newPeer(true, "foo", dummyQueue{&qC}, testConf, new([SSize]byte))
+	server := newPeer(false, "foo", dummyQueue{&qS}, testConf, new([SSize]byte))
+	client.Rekey()
+	if !server.PktProcess(qC[0], Dummy{nil}, true) || len(qS) != 1 {
+		t.Fatal("Rekey request is not answered")
+	}
+	// Old key is still in use
+	client.EthProcess(testPt)
+	server.EthProcess(testPt)
+	server.EthProcess(testPt)
+	oldS, oldSLate := qS[1], qS[2]
+	if !server.PktProcess(qC[1], Dummy{nil}, true) {
+		t.Fatal("Old key is not accepted")
+	}
+	if !client.PktProcess(qS[0], Dummy{nil}, true) || len(qC) != 3 {
+		t.Fatal("Rekey reply is not processed")
+	}
+	// Switch notification is delayed after newly encrypted packet
+	client.EthProcess(testPt)
+	if !server.PktProcess(qC[3], Dummy{nil}, true) {
+		t.Fatal("New key is not accepted")
+	}
+	if !server.PktProcess(qC[2], Dummy{nil}, true) {
+		t.Fatal("Switch notification is not accepted")
+	}
+	server.EthProcess(testPt)
+	if !client.PktProcess(qS[3], Dummy{nil}, true) ||
+		!client.PktProcess(qS[4], Dummy{nil}, true) {
+		t.Fatal("Server's new key is not accepted")
+	}
+	if client.Rekeys != 1 || server.Rekeys != 1 || *client.Key != *server.Key ||
+		*client.Key == [SSize]byte{} {
+		t.Fatal("Keys are not renegotiated")
+	}
+	// Reordered packet encrypted with the old key
+	if !client.PktProcess(oldS, Dummy{nil}, true) {
+		t.Fatal("Old key is not accepted during grace period")
+	}
+	client.keyPrevUntil = time.Now().Add(-time.Second)
+	client.rekeyCheck()
+	if client.keyPrev != nil || client.PktProcess(oldSLate, Dummy{nil}, true) {
+		t.Fatal("Old key is accepted after grace period")
+	}
+}
+
+func TestTransportRekeyOrdered(t *testing.T) {
+	var qC, qS [][]byte
+	client := newPeer(true, "foo", dummyQueue{&qC}, testConf, new([SSize]byte))
+	server := newPeer(false, "foo", dummyQueue{&qS}, testConf, new([SSize]byte))
+	expectation := make([]byte, NonceSize)
+	deliver := func(dst *Peer, q *[][]byte) {
+		for len(*q) > 0 {
+			pkt := (*q)[0]
+			*q = (*q)[1:]
+			dst.NonceExpectation(expectation)
+			if !bytes.Equal(pkt[len(pkt)-NonceSize:], expectation) {
+				t.Fatal("Unexpected nonce")
+			}
+			if !dst.PktProcess(pkt, Dummy{nil}, false) {
+				t.Fatal("Packet is not accepted")
+			}
+		}
+	}
+	server.Rekey()
+	client.EthProcess(testPt)
+	deliver(client, &qS)
+	client.EthProcess(testPt)
+	deliver(server, &qC)
+	server.EthProcess(testPt)
+	deliver(client, &qS)
+	deliver(server, &qC)
+	client.EthProcess(testPt)
+	server.EthProcess(testPt)
+	deliver(client, &qS)
+	deliver(server, &qC)
+	if client.Rekeys != 1 || server.Rekeys != 1 || *client.Key != *server.Key {
+		t.Fatal("Keys are not renegotiated")
+	}
+}
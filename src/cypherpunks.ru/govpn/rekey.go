@@ -0,0 +1,210 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/subtle"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/xtea"
+)
+
+const (
+	// Rekeying request control message, carrying initiator's DH public key
+	CtrlRekey = byte(0x02)
+	// Rekeying reply, carrying initiator's and responder's public keys
+	CtrlRekeyAck = byte(0x03)
+	// All following messages from that side are encrypted with new key
+	CtrlRekeySwitch = byte(0x04)
+
+	// Rekey after that amount of bytes transfered with single key
+	RekeyBytes = MaxBytesPerKey / 2
+	// Default rekeying interval
+	RekeyIntervalDefault = time.Hour
+	// Retry rekeying request if there is no reply during that time
+	RekeyTimeout = 10 * time.Second
+	// How long previous key is still accepted after rekeying
+	RekeyGrace = time.Minute
+)
+
+// Session key with corresponding serial obfuscation cipher.
+type sessionKey struct {
+	key         *[SSize]byte
+	nonceCipher *xtea.Cipher
+}
+
+func newSessionKey(key *[SSize]byte) *sessionKey {
+	return &sessionKey{key, newNonceCipher(key)}
+}
+
+func rekeyKeypairGen() (*[32]byte, *[32]byte) {
+	priv := new([32]byte)
+	pub := new([32]byte)
+	if _, err := Rand.Read(priv[:]); err != nil {
+		LogEvent("random_failed").Err(err).Fatal("Error reading random for DH private key")
+	}
+	curve25519.ScalarBaseMult(pub, priv)
+	return priv, pub
+}
+
+// New session key depends both on fresh DH result and previous key.
+func rekeyKeyDerive(priv, pub, keyOld *[SSize]byte) *[SSize]byte {
+	shared := new([32]byte)
+	curve25519.ScalarMult(shared, priv, pub)
+	hashed := blake2b.Sum256(append(shared[:], keyOld[:]...))
+	SliceZero(shared[:])
+	return &hashed
+}
+
+// Amount of bytes transfered with current session key.
+func (p *Peer) KeyBytes() uint64 {
+	return atomic.LoadUint64(&p.BytesIn) + atomic.LoadUint64(&p.BytesOut) -
+		atomic.LoadUint64(&p.bytesKey)
+}
+
+// Initiate session key renegotiation. Current key is used until the
+// new one is agreed on, so no traffic is interrupted.
+func (p *Peer) Rekey() {
+	p.BusyR.Lock()
+	p.rekeyStart()
+	p.BusyR.Unlock()
+}
+
+func (p *Peer) rekeyStart() {
+	if p.keyNext != nil {
+		// Previous renegotiation is not finished yet
+		return
+	}
+	p.rekeyAbort()
+	p.rekeyPriv, p.rekeyPub = rekeyKeypairGen()
+	p.rekeyStarted = time.Now()
+	p.CtrlProcess(CtrlRekey, p.rekeyPub[:])
+}
+
+func (p *Peer) rekeyAbort() {
+	if p.rekeyPriv != nil {
+		SliceZero(p.rekeyPriv[:])
+	}
+	p.rekeyPriv = nil
+	p.rekeyPub = nil
+}
+
+// Called with each heartbeat: forget expired previous key and start
+// rekeying if either enough traffic passed or key is too old.
+func (p *Peer) rekeyCheck() {
+	now := time.Now()
+	p.BusyR.Lock()
+	if p.keyPrev != nil && now.After(p.keyPrevUntil) {
+		SliceZero(p.keyPrev.key[:])
+		p.keyPrev = nil
+	}
+	if p.rekeyPriv != nil {
+		if now.Sub(p.rekeyStarted) > RekeyTimeout {
+			p.rekeyStart()
+		}
+	} else if p.KeyBytes() > RekeyBytes ||
+		(p.RekeyInterval > 0 && now.Sub(p.rekeyed) > p.RekeyInterval) {
+		p.rekeyStart()
+	}
+	p.BusyR.Unlock()
+}
+
+// Send switch notification with the current key and use new one for
+// all following messages. TCP receiver relies on the exact position
+// of the switch in the stream.
+func (p *Peer) rekeySwitch(k *sessionKey) {
+	p.BusyT.Lock()
+	p.frameSendLocked([]byte{CtrlRekeySwitch}, CtrlPadByte)
+	p.Key = k.key
+	p.NonceCipher = k.nonceCipher
+	p.BusyT.Unlock()
+}
+
+// Remote side uses the new key: make it the receiving one, keeping
+// the previous for the grace period (UDP packets can be reordered).
+// Switch our transmitting key too, if not done yet.
+func (p *Peer) rekeyPromote() {
+	if p.keyPrev != nil {
+		SliceZero(p.keyPrev.key[:])
+	}
+	p.keyPrev = p.keyR
+	p.keyR = p.keyNext
+	p.keyNext = nil
+	if p.Key != p.keyR.key {
+		p.rekeySwitch(p.keyR)
+	}
+	p.rekeyed = time.Now()
+	p.keyPrevUntil = p.rekeyed.Add(RekeyGrace)
+	atomic.StoreUint64(&p.bytesKey, atomic.LoadUint64(&p.BytesIn)+atomic.LoadUint64(&p.BytesOut))
+	atomic.AddUint64(&p.Rekeys, 1)
+	LogEvent("rekeyed").Peer(p).Info("Session key renegotiated")
+}
+
+// Process rekeying related control message. Returns false if message
+// is of another type. Must be called with BusyR held.
+func (p *Peer) rekeyCtrl(typ byte, data []byte) bool {
+	switch typ {
+	case CtrlRekey:
+		if len(data) != 32 {
+			return true
+		}
+		if p.keyNext != nil && p.Key == p.keyNext.key {
+			// We already transmit with the new key, waiting for the
+			// remote side to switch
+			return true
+		}
+		if p.rekeyPriv != nil {
+			if p.isClient {
+				// Simultaneous renegotiation: client's request wins
+				return true
+			}
+			p.rekeyAbort()
+		}
+		pubRemote := new([32]byte)
+		copy(pubRemote[:], data)
+		priv, pub := rekeyKeypairGen()
+		if p.keyNext != nil {
+			// Initiator has not received our previous reply
+			SliceZero(p.keyNext.key[:])
+		}
+		p.keyNext = newSessionKey(rekeyKeyDerive(priv, pubRemote, p.keyR.key))
+		SliceZero(priv[:])
+		p.CtrlProcess(CtrlRekeyAck, append(pubRemote[:], pub[:]...))
+	case CtrlRekeyAck:
+		if len(data) != 64 || p.rekeyPriv == nil ||
+			subtle.ConstantTimeCompare(data[:32], p.rekeyPub[:]) != 1 {
+			return true
+		}
+		pubRemote := new([32]byte)
+		copy(pubRemote[:], data[32:])
+		p.keyNext = newSessionKey(rekeyKeyDerive(p.rekeyPriv, pubRemote, p.keyR.key))
+		p.rekeyAbort()
+		p.rekeySwitch(p.keyNext)
+	case CtrlRekeySwitch:
+		if p.keyNext != nil {
+			p.rekeyPromote()
+		}
+	default:
+		return false
+	}
+	return true
+}
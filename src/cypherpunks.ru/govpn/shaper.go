@@ -0,0 +1,116 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Actions taken when traffic quota is exceeded
+	QuotaDisconnect = "disconnect"
+	QuotaThrottle   = "throttle"
+	// Rate of throttled peer, KiB/sec
+	QuotaRateDefault = 64
+)
+
+// Rate limits of the peer, KiB/sec. Zero means unlimited.
+type RateConf struct {
+	In  int `yaml:"in"`
+	Out int `yaml:"out"`
+}
+
+// Traffic quotas of the peer, MiB of both directions. Zero means
+// unlimited.
+type QuotaConf struct {
+	Daily   int    `yaml:"daily"`
+	Monthly int    `yaml:"monthly"`
+	Action  string `yaml:"action"`
+	// Rate limit of throttled peer, KiB/sec
+	Rate int `yaml:"rate"`
+}
+
+// Token bucket rate limiter. Frames exceeding the rate (after the
+// burst is spent) are not allowed: they are dropped, not delayed,
+// as receiving goroutine can be shared between peers.
+type TokenBucket struct {
+	l      sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Create token bucket with specified rate in bytes per second. Zero
+// rate means unlimited.
+func NewTokenBucket(rate int) *TokenBucket {
+	tb := TokenBucket{}
+	tb.SetRate(rate)
+	return &tb
+}
+
+// Change the rate, bytes per second. Burst is one second worth of
+// traffic, but not less than maximal frame.
+func (tb *TokenBucket) SetRate(rate int) {
+	tb.l.Lock()
+	if float64(rate) != tb.rate {
+		tb.rate = float64(rate)
+		tb.burst = tb.rate
+		if tb.burst < MTUMax {
+			tb.burst = MTUMax
+		}
+		tb.tokens = tb.burst
+		tb.last = time.Now()
+	}
+	tb.l.Unlock()
+}
+
+// Current rate, bytes per second.
+func (tb *TokenBucket) Rate() int {
+	tb.l.Lock()
+	rate := int(tb.rate)
+	tb.l.Unlock()
+	return rate
+}
+
+// Take n bytes from the bucket if there are enough of them.
+func (tb *TokenBucket) Allow(n int, now time.Time) bool {
+	tb.l.Lock()
+	defer tb.l.Unlock()
+	if tb.rate == 0 {
+		return true
+	}
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	tb.last = now
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// Change peer's rate limits, KiB/sec. Zero means unlimited.
+func (p *Peer) RateLimit(in, out int) {
+	p.rateIn.SetRate(in * 1024)
+	p.rateOut.SetRate(out * 1024)
+}
@@ -0,0 +1,85 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(0)
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		if !tb.Allow(MTUMax, now) {
+			t.Fatal("unlimited bucket denies")
+		}
+	}
+	tb.SetRate(100 * MTUMax)
+	now = tb.last
+	for i := 0; i < 100; i++ {
+		if !tb.Allow(MTUMax, now) {
+			t.Fatal("burst is denied", i)
+		}
+	}
+	if tb.Allow(MTUMax, now) {
+		t.Fatal("exceeding burst is allowed")
+	}
+	now = now.Add(100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if !tb.Allow(MTUMax, now) {
+			t.Fatal("refilled tokens are denied", i)
+		}
+	}
+	if tb.Allow(MTUMax, now) {
+		t.Fatal("exceeding rate is allowed")
+	}
+	now = now.Add(time.Hour)
+	tb.Allow(0, now)
+	if tb.tokens != tb.burst {
+		t.Fatal("bucket overflows burst")
+	}
+	tb.SetRate(1)
+	if !tb.Allow(MTUMax, now) || tb.Allow(1, now) {
+		t.Fatal("burst is smaller than maximal frame")
+	}
+}
+
+func TestPeerRateLimit(t *testing.T) {
+	var ct, written []byte
+	peerS := newPeer(false, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerC := newPeer(true, "foo", Dummy{&ct}, testConf, new([SSize]byte))
+	peerS.RateLimit(1, 1)
+	payload := make([]byte, 1000)
+	for i := 0; i < MTUMax/len(payload)+1; i++ {
+		written = nil
+		peerC.EthProcess(payload)
+		peerS.PktProcess(ct, Dummy{&written}, true)
+	}
+	if written != nil || peerS.FramesRateIn != 1 {
+		t.Fatal("incoming rate is not limited")
+	}
+	for i := 0; i < MTUMax/len(payload)+1; i++ {
+		ct = nil
+		peerS.EthProcess(payload)
+	}
+	if ct != nil || peerS.FramesRateOut != 1 {
+		t.Fatal("outgoing rate is not limited")
+	}
+}
@@ -20,8 +20,15 @@ package govpn
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,35 +38,153 @@ const (
 
 type KnownPeers map[string]**Peer
 
-// StatsProcessor is assumed to be run in background. It accepts
-// connection on statsPort, reads anything one send to them and show
-// information about known peers in serialized JSON format. peers
-// argument is a reference to the map with references to the peers as
-// values. Map is used here because of ease of adding and removing
-// elements in it.
-func StatsProcessor(statsPort net.Listener, peers *KnownPeers) {
-	var conn net.Conn
-	var err error
-	var data []byte
-	buf := make([]byte, 2<<8)
-	for {
-		conn, err = statsPort.Accept()
-		if err != nil {
-			log.Println("Error during accepting connection", err.Error())
-			continue
-		}
-		conn.SetDeadline(time.Now().Add(RWTimeout))
-		conn.Read(buf)
-		conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: application/json\r\n\r\n"))
-		var peersList []*Peer
-		for _, peer := range *peers {
+// Single Prometheus metric sample.
+type StatsMetric struct {
+	Name   string
+	Help   string
+	Type   string // either "counter" or "gauge"
+	Labels map[string]string
+	Value  float64
+}
+
+// Data sources for the stats HTTP server. peers argument is a
+// reference to the map with references to the peers as values. Map is
+// used here because of ease of adding and removing elements in it.
+// PeersLock and Metrics are optional: the latter returns additional
+// (for example server-wide) metrics.
+type Stats struct {
+	Peers     *KnownPeers
+	PeersLock *sync.RWMutex
+	Metrics   func() []StatsMetric
+}
+
+var peerMetrics = []struct {
+	name  string
+	help  string
+	value func(p *Peer) uint64
+}{
+	{"bytes_in", "Received bytes", func(p *Peer) uint64 { return atomic.LoadUint64(&p.BytesIn) }},
+	{"bytes_out", "Sent bytes", func(p *Peer) uint64 { return atomic.LoadUint64(&p.BytesOut) }},
+	{"bytes_payload_in", "Received payload bytes", func(p *Peer) uint64 { return atomic.LoadUint64(&p.BytesPayloadIn) }},
+	{"bytes_payload_out", "Sent payload bytes", func(p *Peer) uint64 { return atomic.LoadUint64(&p.BytesPayloadOut) }},
+	{"frames_in", "Received frames", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesIn) }},
+	{"frames_out", "Sent frames", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesOut) }},
+	{"frames_unauth", "Unauthenticated frames", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesUnauth) }},
+	{"frames_dup", "Duplicate frames", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesDup) }},
+	{"frames_acl_in", "Frames from the peer dropped by ACL", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesACLIn) }},
+	{"frames_acl_out", "Frames to the peer dropped by ACL", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesACLOut) }},
+	{"frames_rate_in", "Frames from the peer dropped by rate limit", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesRateIn) }},
+	{"frames_rate_out", "Frames to the peer dropped by rate limit", func(p *Peer) uint64 { return atomic.LoadUint64(&p.FramesRateOut) }},
+	{"heartbeat_recv", "Received heartbeats", func(p *Peer) uint64 { return atomic.LoadUint64(&p.HeartbeatRecv) }},
+	{"heartbeat_sent", "Sent heartbeats", func(p *Peer) uint64 { return atomic.LoadUint64(&p.HeartbeatSent) }},
+	{"rekeys", "Session key renegotiations", func(p *Peer) uint64 { return atomic.LoadUint64(&p.Rekeys) }},
+}
+
+func (s *Stats) peers() []*Peer {
+	if s.PeersLock != nil {
+		s.PeersLock.RLock()
+		defer s.PeersLock.RUnlock()
+	}
+	var peersList []*Peer
+	for _, peer := range *s.Peers {
+		if *peer != nil {
 			peersList = append(peersList, *peer)
 		}
-		data, err = json.Marshal(peersList)
-		if err != nil {
-			panic(err)
+	}
+	return peersList
+}
+
+// Serve known peers in serialized JSON format.
+func (s *Stats) servePeers(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(s.peers())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Serve peers counters and additional metrics in Prometheus text
+// exposition format.
+func (s *Stats) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	peers := s.peers()
+	metrics := []StatsMetric{{
+		Name:  "govpn_peers",
+		Help:  "Number of established peers",
+		Type:  "gauge",
+		Value: float64(len(peers)),
+	}}
+	for _, pm := range peerMetrics {
+		for _, peer := range peers {
+			metrics = append(metrics, StatsMetric{
+				Name: "govpn_peer_" + pm.name + "_total",
+				Help: pm.help,
+				Type: "counter",
+				Labels: map[string]string{
+					"name":    peer.Name,
+					"peer_id": peer.Id.String(),
+				},
+				Value: float64(pm.value(peer)),
+			})
+		}
+	}
+	if s.Metrics != nil {
+		metrics = append(metrics, s.Metrics()...)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	StatsMetricsWrite(w, metrics)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write metrics in Prometheus text exposition format. Samples of the
+// same metric must be adjacent.
+func StatsMetricsWrite(w io.Writer, metrics []StatsMetric) {
+	var prev string
+	for _, m := range metrics {
+		if m.Name != prev {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+			prev = m.Name
+		}
+		labels := make([]string, 0, len(m.Labels))
+		for k, v := range m.Labels {
+			labels = append(labels, k+`="`+labelEscaper.Replace(v)+`"`)
+		}
+		sort.Strings(labels)
+		var labelsStr string
+		if len(labels) > 0 {
+			labelsStr = "{" + strings.Join(labels, ",") + "}"
+		}
+		fmt.Fprintf(
+			w, "%s%s %s\n",
+			m.Name, labelsStr, strconv.FormatFloat(m.Value, 'f', -1, 64),
+		)
+	}
+}
+
+// StatsProcessor is assumed to be run in background. It serves HTTP
+// requests on statsPort: known peers in JSON format on /peers (and /
+// for compatibility) and Prometheus metrics on /metrics.
+func StatsProcessor(statsPort net.Listener, peers *KnownPeers) {
+	StatsServe(statsPort, &Stats{Peers: peers})
+}
+
+// Same as StatsProcessor, but with all data sources specified.
+func StatsServe(statsPort net.Listener, stats *Stats) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", stats.servePeers)
+	mux.HandleFunc("/metrics", stats.serveMetrics)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
 		}
-		conn.Write(data)
-		conn.Close()
+		stats.servePeers(w, r)
+	})
+	s := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  RWTimeout,
+		WriteTimeout: RWTimeout,
 	}
+	LogEvent("stats_stopped").Err(s.Serve(statsPort)).Error("Stats serving stopped")
 }
@@ -0,0 +1,60 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatsServe(t *testing.T) {
+	peer := newPeer(false, "foo", Dummy{nil}, testConf, new([SSize]byte))
+	peer.Name = `Ali"ce`
+	peer.BytesIn = 123
+	peers := KnownPeers{"foo": &peer}
+	stats := &Stats{
+		Peers: &peers,
+		Metrics: func() []StatsMetric {
+			return []StatsMetric{{Name: "govpn_handshakes", Type: "gauge", Value: 2}}
+		},
+	}
+
+	w := httptest.NewRecorder()
+	stats.servePeers(w, httptest.NewRequest("GET", "/peers", nil))
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &decoded); err != nil || len(decoded) != 1 {
+		t.Fatal("Invalid JSON", err)
+	}
+
+	w = httptest.NewRecorder()
+	stats.serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE govpn_peer_bytes_in_total counter",
+		`govpn_peer_bytes_in_total{name="Ali\"ce",peer_id="` + testPeerId.String() + `"} 123`,
+		"govpn_peers 1",
+		"govpn_handshakes 2",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("Missing metric line:", line)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// How long learnt address is kept in the switch table
+	SwitchAgeing = 5 * time.Minute
+	// Length of each port's outgoing frames queue
+	SwitchQueueSize = 1 << 7
+)
+
+type switchEntry struct {
+	port *SwitchPort
+	seen time.Time
+}
+
+// In-process learning switch, connecting single TAP interface with many
+// peers. Remote side's addresses (MAC in TAP mode, IP in TUN mode) are
+// learnt from the frames they send, so frames from the interface are
+// sent only to corresponding peer. Broadcast, multicast and frames to
+// unknown destinations are flooded. If P2P is enabled, then frames
+// between peers are forwarded directly, without touching the kernel.
+type Switch struct {
+	TAP   *TAP
+	P2P   bool
+	ports map[*SwitchPort]struct{}
+	table map[string]switchEntry
+	l     sync.RWMutex
+}
+
+// Switch port, that is attached to the single peer.
+type SwitchPort struct {
+	// Frames destined to the peer
+	Sink chan []byte
+	sw   *Switch
+}
+
+// Create switch over the TAP interface and start processing frames
+// from it.
+func NewSwitch(tap *TAP, p2p bool) *Switch {
+	sw := Switch{
+		TAP:   tap,
+		P2P:   p2p,
+		ports: make(map[*SwitchPort]struct{}),
+		table: make(map[string]switchEntry),
+	}
+	go func() {
+		for data := range tap.Sink {
+			sw.forward(nil, data)
+		}
+	}()
+	return &sw
+}
+
+func (sw *Switch) PortAdd() *SwitchPort {
+	port := SwitchPort{Sink: make(chan []byte, SwitchQueueSize), sw: sw}
+	sw.l.Lock()
+	sw.ports[&port] = struct{}{}
+	sw.l.Unlock()
+	return &port
+}
+
+// Detach port from the switch and forget all addresses learnt on it.
+func (sw *Switch) PortDel(port *SwitchPort) {
+	sw.l.Lock()
+	delete(sw.ports, port)
+	for addr, entry := range sw.table {
+		if entry.port == port {
+			delete(sw.table, addr)
+		}
+	}
+	sw.l.Unlock()
+}
+
+// Number of attached ports.
+func (sw *Switch) PortsCount() int {
+	sw.l.RLock()
+	n := len(sw.ports)
+	sw.l.RUnlock()
+	return n
+}
+
+// Frame received from the peer.
+func (port *SwitchPort) Write(data []byte) (int, error) {
+	return port.sw.forward(port, data)
+}
+
+// Enqueue frame's copy for sending to the peer. It is dropped if
+// port's queue is full.
+func (port *SwitchPort) send(data []byte) {
+	frame := make([]byte, len(data))
+	copy(frame, data)
+	select {
+	case port.Sink <- frame:
+	default:
+	}
+}
+
+// Remember that address is reachable through the port.
+func (sw *Switch) learn(port *SwitchPort, addr string, now time.Time) {
+	sw.l.RLock()
+	entry, exists := sw.table[addr]
+	sw.l.RUnlock()
+	// Refresh entry no more often than once per second
+	if exists && entry.port == port && entry.seen.Add(time.Second).After(now) {
+		return
+	}
+	sw.l.Lock()
+	if _, attached := sw.ports[port]; attached {
+		sw.table[addr] = switchEntry{port, now}
+	}
+	sw.l.Unlock()
+}
+
+// Forward the frame came from the src port (nil means TAP interface).
+func (sw *Switch) forward(src *SwitchPort, data []byte) (int, error) {
+	srcAddr, dstAddr, group := frameAddrs(sw.TAP.Mode, data)
+	now := time.Now()
+	if src != nil && srcAddr != "" {
+		sw.learn(src, srcAddr, now)
+	}
+	var dst *SwitchPort
+	sw.l.RLock()
+	if !group && dstAddr != "" {
+		entry, exists := sw.table[dstAddr]
+		if exists && entry.seen.Add(SwitchAgeing).After(now) {
+			dst = entry.port
+		}
+	}
+	if dst == nil && (src == nil || sw.P2P) {
+		// Flood to all peers, except the source one
+		for port := range sw.ports {
+			if port != src {
+				port.send(data)
+			}
+		}
+	}
+	sw.l.RUnlock()
+	switch {
+	case src == nil:
+		if dst != nil {
+			dst.send(data)
+		}
+		return len(data), nil
+	case dst == src:
+		// Destination is behind the same peer
+		return len(data), nil
+	case dst != nil && sw.P2P:
+		dst.send(data)
+		return len(data), nil
+	}
+	return sw.TAP.Write(data)
+}
+
+// Extract source and destination addresses from the frame. group tells
+// if it is broadcast or multicast one. Empty address means that frame
+// is too short or malformed.
+func frameAddrs(mode string, data []byte) (src, dst string, group bool) {
+	if mode != ModeTUN {
+		if len(data) < EtherSize {
+			return
+		}
+		return string(data[6:12]), string(data[0:6]), data[0]&1 == 1
+	}
+	if len(data) < IPHeaderMinSize {
+		return
+	}
+	switch data[0] >> 4 {
+	case 4:
+		group = data[16]&0xF0 == 0xE0 || string(data[16:20]) == "\xFF\xFF\xFF\xFF"
+		return string(data[12:16]), string(data[16:20]), group
+	case 6:
+		if len(data) < 40 {
+			return
+		}
+		return string(data[8:24]), string(data[24:40]), data[24] == 0xFF
+	}
+	return
+}
@@ -0,0 +1,125 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"testing"
+)
+
+type testTAPDev struct {
+	written [][]byte
+}
+
+func (d *testTAPDev) Read(b []byte) (int, error) {
+	select {}
+}
+
+func (d *testTAPDev) Write(b []byte) (int, error) {
+	d.written = append(d.written, b)
+	return len(b), nil
+}
+
+func testSwitch(p2p bool) (*Switch, *testTAPDev) {
+	dev := &testTAPDev{}
+	tap := &TAP{Name: "test", Mode: ModeTAP, Sink: make(chan []byte), dev: dev}
+	return NewSwitch(tap, p2p), dev
+}
+
+func testFrame(dst, src byte) []byte {
+	frame := make([]byte, 64)
+	for i := 0; i < 6; i++ {
+		frame[i] = dst
+		frame[6+i] = src
+	}
+	return frame
+}
+
+func TestSwitchLearning(t *testing.T) {
+	sw, dev := testSwitch(false)
+	port0 := sw.PortAdd()
+	port1 := sw.PortAdd()
+
+	// Broadcast from the interface is flooded
+	sw.forward(nil, testFrame(0xFF, 0x10))
+	if len(port0.Sink) != 1 || len(port1.Sink) != 1 {
+		t.Fatal("Broadcast is not flooded")
+	}
+	<-port0.Sink
+	<-port1.Sink
+
+	// Peers' frames go to the interface and addresses are learnt
+	port0.Write(testFrame(0x10, 0x02))
+	port1.Write(testFrame(0x02, 0x04))
+	if len(dev.written) != 2 {
+		t.Fatal("Frames are not written to the interface")
+	}
+	if len(port0.Sink) != 0 {
+		t.Fatal("Frame is forwarded between peers without P2P")
+	}
+
+	// Unicast from the interface goes to the single peer
+	sw.forward(nil, testFrame(0x04, 0x10))
+	if len(port0.Sink) != 0 || len(port1.Sink) != 1 {
+		t.Fatal("Unicast is not switched")
+	}
+	<-port1.Sink
+
+	// Forgotten port's addresses are flooded again
+	sw.PortDel(port1)
+	sw.forward(nil, testFrame(0x04, 0x10))
+	if len(port0.Sink) != 1 {
+		t.Fatal("Unknown unicast is not flooded")
+	}
+}
+
+func TestSwitchP2P(t *testing.T) {
+	sw, dev := testSwitch(true)
+	port0 := sw.PortAdd()
+	port1 := sw.PortAdd()
+	port2 := sw.PortAdd()
+	port1.Write(testFrame(0xFF, 0x04))
+	if len(port0.Sink) != 1 || len(port1.Sink) != 0 ||
+		len(port2.Sink) != 1 || len(dev.written) != 1 {
+		t.Fatal("Broadcast is not flooded")
+	}
+	<-port0.Sink
+	<-port2.Sink
+	port0.Write(testFrame(0x04, 0x02))
+	if len(port1.Sink) != 1 || len(port2.Sink) != 0 || len(dev.written) != 1 {
+		t.Fatal("Unicast is not switched between peers")
+	}
+}
+
+func TestSwitchTUN(t *testing.T) {
+	sw, _ := testSwitch(false)
+	sw.TAP.Mode = ModeTUN
+	port0 := sw.PortAdd()
+	port1 := sw.PortAdd()
+	pkt := make([]byte, IPHeaderMinSize)
+	pkt[0] = 0x45
+	copy(pkt[12:16], []byte{10, 0, 0, 2})
+	copy(pkt[16:20], []byte{10, 0, 0, 1})
+	port0.Write(pkt)
+	copy(pkt[12:16], []byte{10, 0, 0, 1})
+	copy(pkt[16:20], []byte{10, 0, 0, 2})
+	sw.forward(nil, pkt)
+	if len(port0.Sink) != 1 || len(port1.Sink) != 0 {
+		t.Fatal("IP packet is not switched")
+	}
+}
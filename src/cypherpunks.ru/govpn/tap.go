@@ -19,11 +19,14 @@ along with this program.  If not, see <http://www.gnu.org/licenses/>.
 package govpn
 
 import (
+	"errors"
 	"io"
 )
 
+// TAP wraps either TAP or TUN (depending on Mode) network interface.
 type TAP struct {
 	Name string
+	Mode string
 	Sink chan []byte
 	dev  io.ReadWriter
 }
@@ -32,13 +35,20 @@ var (
 	taps = make(map[string]*TAP)
 )
 
-func NewTAP(ifaceName string, mtu int) (*TAP, error) {
-	tapRaw, err := newTAPer(ifaceName)
+func NewTAP(ifaceName, mode string, mtu int) (*TAP, error) {
+	if mode == "" {
+		mode = ModeTAP
+	}
+	if !ModeValid(mode) {
+		return nil, errors.New("Unknown interface mode: " + mode)
+	}
+	tapRaw, err := newTAPer(ifaceName, mode)
 	if err != nil {
 		return nil, err
 	}
 	tap := TAP{
 		Name: ifaceName,
+		Mode: mode,
 		dev:  tapRaw,
 		Sink: make(chan []byte),
 	}
@@ -70,12 +80,18 @@ func (t *TAP) Write(data []byte) (n int, err error) {
 	return t.dev.Write(data)
 }
 
-func TAPListen(ifaceName string, mtu int) (*TAP, error) {
+func TAPListen(ifaceName, mode string, mtu int) (*TAP, error) {
+	if mode == "" {
+		mode = ModeTAP
+	}
 	tap, exists := taps[ifaceName]
 	if exists {
+		if tap.Mode != mode {
+			return nil, errors.New("Interface " + ifaceName + " is already opened in " + tap.Mode + " mode")
+		}
 		return tap, nil
 	}
-	tap, err := NewTAP(ifaceName, mtu)
+	tap, err := NewTAP(ifaceName, mode, mtu)
 	if err != nil {
 		return nil, err
 	}
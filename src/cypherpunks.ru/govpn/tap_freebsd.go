@@ -13,6 +13,8 @@ import (
 	"path"
 )
 
-func newTAPer(ifaceName string) (io.ReadWriter, error) {
+// Both tap(4) and tun(4) devices are opened the same way, mode is
+// determined by the device name itself.
+func newTAPer(ifaceName, mode string) (io.ReadWriter, error) {
 	return os.OpenFile(path.Join("/dev/", ifaceName), os.O_RDWR, os.ModePerm)
 }
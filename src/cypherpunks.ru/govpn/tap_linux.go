@@ -13,6 +13,9 @@ import (
 	"github.com/bigeagle/water"
 )
 
-func newTAPer(ifaceName string) (io.ReadWriter, error) {
+func newTAPer(ifaceName, mode string) (io.ReadWriter, error) {
+	if mode == ModeTUN {
+		return water.NewTUN(ifaceName)
+	}
 	return water.NewTAP(ifaceName)
 }
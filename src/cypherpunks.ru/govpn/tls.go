@@ -0,0 +1,64 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// SHA256 hash of certificate's SubjectPublicKeyInfo, base64 encoded.
+// It is used for TLS certificates pinning.
+func SPKIHash(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// TLS configuration for the client. GoVPN does not rely on TLS for
+// security, so certificate is verified only if comma-separated list of
+// SPKI hashes is specified: server's certificate must match one of
+// them.
+func TLSClientConfig(serverName, pins string) *tls.Config {
+	cfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: true}
+	if pins == "" {
+		return cfg
+	}
+	allowed := make(map[string]struct{})
+	for _, pin := range strings.Split(pins, ",") {
+		allowed[strings.TrimSpace(pin)] = struct{}{}
+	}
+	cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+		if len(raw) == 0 {
+			return errors.New("No TLS certificate")
+		}
+		cert, err := x509.ParseCertificate(raw[0])
+		if err != nil {
+			return err
+		}
+		if _, exists := allowed[SPKIHash(cert)]; !exists {
+			return errors.New("TLS certificate does not match pin: " + SPKIHash(cert))
+		}
+		return nil
+	}
+	return cfg
+}
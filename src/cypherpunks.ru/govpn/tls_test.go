@@ -0,0 +1,95 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func tlsSelfSigned(t *testing.T) tls.Certificate {
+	prv, err := ecdsa.GenerateKey(elliptic.P256(), Rand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(Rand, &tmpl, &tmpl, &prv.PublicKey, prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  prv,
+		Leaf:        cert,
+	}
+}
+
+func tlsTry(t *testing.T, cert tls.Certificate, pins string) error {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return tls.Client(conn, TLSClientConfig("example.com", pins)).Handshake()
+}
+
+func TestTLSPinning(t *testing.T) {
+	cert := tlsSelfSigned(t)
+	other := tlsSelfSigned(t)
+	if err := tlsTry(t, cert, ""); err != nil {
+		t.Fatal("unpinned self-signed certificate is rejected:", err)
+	}
+	if err := tlsTry(t, cert, SPKIHash(other.Leaf)+","+SPKIHash(cert.Leaf)); err != nil {
+		t.Fatal("pinned certificate is rejected:", err)
+	}
+	if err := tlsTry(t, cert, SPKIHash(other.Leaf)); err == nil {
+		t.Fatal("certificate with unknown SPKI is accepted")
+	}
+}
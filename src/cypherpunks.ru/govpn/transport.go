@@ -0,0 +1,328 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sort"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/crypto/salsa20"
+)
+
+const (
+	TransportPlain = "plain"
+	TransportXOR   = "xor"
+	TransportWS    = "ws"
+
+	// Maximal size of single transport message
+	TransportMsgMax = 1 << 16
+	// Maximal growth of the packet after encoding by any of built-in
+	// transports: xor's seed, header and padding are the largest
+	TransportOverheadMax = xorSeedSize + xorHeaderSize + 255
+)
+
+// Transport changes the look of packets on the wire: it is placed
+// between Peer/Handshake and the socket. Each packet is encoded to
+// single message, so it works over both stream and datagram
+// connections. It is not intended for security: only for hiding
+// traffic from DPI.
+type Transport interface {
+	// Encode packet to the wire message. server tells if it is sent
+	// by the server.
+	Encode(pkt []byte, server bool) ([]byte, error)
+	// Read and decode single wire message.
+	Decode(r io.Reader) ([]byte, error)
+}
+
+var transports = map[string]Transport{
+	TransportPlain: transportPlain{},
+	TransportXOR:   transportXOR{},
+	TransportWS:    transportWS{},
+}
+
+// Register transport under the given name.
+func TransportRegister(name string, t Transport) {
+	transports[name] = t
+}
+
+// Get registered transport. Empty name means plain one.
+func TransportGet(name string) (Transport, error) {
+	if name == "" {
+		name = TransportPlain
+	}
+	t, exists := transports[name]
+	if !exists {
+		return nil, errors.New("Unknown transport: " + name)
+	}
+	if xor, ok := t.(transportXOR); ok && xor.key == nil {
+		return nil, errors.New("No key is set for xor transport")
+	}
+	return t, nil
+}
+
+// Set the shared secret of xor transport: it is unusable without it.
+// Both sides must use the same one.
+func TransportXORKey(secret string) {
+	key := blake2b.Sum256([]byte(secret))
+	transports[TransportXOR] = transportXOR{&key}
+}
+
+// Names of all registered transports, plain one is the first.
+func TransportNames() []string {
+	names := make([]string, 0, len(transports))
+	for name := range transports {
+		if name != TransportPlain {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{TransportPlain}, names...)
+}
+
+// Connection with transport applied: each Write sends single message
+// and each Read returns data of single message.
+type transportConn struct {
+	net.Conn
+	t        Transport
+	server   bool
+	r        io.Reader
+	datagram bool
+	buf      []byte
+	pending  []byte
+}
+
+// Wrap connection with the transport. server tells on which side
+// we are. Plain transport returns connection as is.
+func TransportWrap(t Transport, conn net.Conn, server bool) net.Conn {
+	if _, plain := t.(transportPlain); plain {
+		return conn
+	}
+	c := transportConn{Conn: conn, t: t, server: server}
+	if _, c.datagram = conn.(net.PacketConn); c.datagram {
+		c.buf = make([]byte, TransportMsgMax)
+	} else {
+		c.r = bufio.NewReader(conn)
+	}
+	return &c
+}
+
+func (c *transportConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var msg []byte
+		var err error
+		if c.datagram {
+			var n int
+			if n, err = c.Conn.Read(c.buf); err != nil {
+				return 0, err
+			}
+			msg, err = c.t.Decode(bytes.NewReader(c.buf[:n]))
+		} else {
+			msg, err = c.t.Decode(c.r)
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.pending = msg
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *transportConn) Write(b []byte) (int, error) {
+	msg, err := c.t.Encode(b, c.server)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.Conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Pass-through transport.
+type transportPlain struct{}
+
+func (transportPlain) Encode(pkt []byte, server bool) ([]byte, error) {
+	return pkt, nil
+}
+
+func (transportPlain) Decode(r io.Reader) ([]byte, error) {
+	buf := make([]byte, TransportMsgMax)
+	n, err := r.Read(buf)
+	return buf[:n], err
+}
+
+// Stream scrambler with random padding: every message is XORed with
+// Salsa20 keystream produced from the key, derived from shared secret,
+// and random seed: SEED || XOR(LEN || PADLEN || CHECK || DATA || PAD).
+// So there are neither constant bytes on the wire, nor exact packet
+// sizes. CHECK consists of zeros: it lets to tell scrambled messages
+// apart without trying to identify the peer.
+type transportXOR struct {
+	key *[32]byte
+}
+
+const (
+	xorSeedSize   = 8
+	xorCheckSize  = 4
+	xorHeaderSize = 3 + xorCheckSize
+)
+
+func (t transportXOR) Encode(pkt []byte, server bool) ([]byte, error) {
+	if t.key == nil {
+		return nil, errors.New("No key is set for xor transport")
+	}
+	if len(pkt) > TransportMsgMax-xorSeedSize-xorHeaderSize-255 {
+		return nil, errors.New("Too big packet")
+	}
+	msg := make([]byte, xorSeedSize+xorHeaderSize+len(pkt)+256)
+	if _, err := io.ReadFull(Rand, msg[:xorSeedSize+1]); err != nil {
+		return nil, err
+	}
+	padLen := int(msg[xorSeedSize])
+	msg = msg[:xorSeedSize+xorHeaderSize+len(pkt)+padLen]
+	binary.BigEndian.PutUint16(msg[xorSeedSize:], uint16(len(pkt)))
+	msg[xorSeedSize+2] = byte(padLen)
+	copy(msg[xorSeedSize+xorHeaderSize:], pkt)
+	salsa20.XORKeyStream(msg[xorSeedSize:], msg[xorSeedSize:], msg[:xorSeedSize], t.key)
+	return msg, nil
+}
+
+func (t transportXOR) Decode(r io.Reader) ([]byte, error) {
+	if t.key == nil {
+		return nil, errors.New("No key is set for xor transport")
+	}
+	head := make([]byte, xorSeedSize+xorHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	seed := head[:xorSeedSize]
+	hdr := make([]byte, xorHeaderSize)
+	salsa20.XORKeyStream(hdr, head[xorSeedSize:], seed, t.key)
+	for _, b := range hdr[3:] {
+		if b != 0 {
+			return nil, errors.New("Invalid xor message")
+		}
+	}
+	size := int(binary.BigEndian.Uint16(hdr)) + int(hdr[2])
+	msg := make([]byte, xorHeaderSize+size)
+	copy(msg, head[xorSeedSize:])
+	if _, err := io.ReadFull(r, msg[xorHeaderSize:]); err != nil {
+		return nil, err
+	}
+	salsa20.XORKeyStream(msg, msg, seed, t.key)
+	return msg[xorHeaderSize : xorHeaderSize+int(binary.BigEndian.Uint16(hdr))], nil
+}
+
+// WebSocket binary messages framing (RFC 6455). Client's messages are
+// masked, as required. Fragmented messages are not supported.
+type transportWS struct{}
+
+const (
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+)
+
+func (transportWS) Encode(pkt []byte, server bool) ([]byte, error) {
+	msg := make([]byte, 2, 14+len(pkt))
+	msg[0] = 0x80 | wsOpBinary
+	switch {
+	case len(pkt) < 126:
+		msg[1] = byte(len(pkt))
+	case len(pkt) < 1<<16:
+		msg[1] = 126
+		msg = msg[:4]
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(pkt)))
+	default:
+		msg[1] = 127
+		msg = msg[:10]
+		binary.BigEndian.PutUint64(msg[2:], uint64(len(pkt)))
+	}
+	if server {
+		return append(msg, pkt...), nil
+	}
+	msg[1] |= 0x80
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(Rand, mask); err != nil {
+		return nil, err
+	}
+	msg = append(msg, mask...)
+	for i, b := range pkt {
+		msg = append(msg, b^mask[i%4])
+	}
+	return msg, nil
+}
+
+func (transportWS) Decode(r io.Reader) ([]byte, error) {
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head[:2]); err != nil {
+			return nil, err
+		}
+		op := head[0] & 0x0f
+		masked := head[1]&0x80 != 0
+		size := uint64(head[1] & 0x7f)
+		switch size {
+		case 126:
+			if _, err := io.ReadFull(r, head[:2]); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(head))
+		case 127:
+			if _, err := io.ReadFull(r, head); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(head)
+		}
+		if size > TransportMsgMax {
+			return nil, errors.New("Too big WebSocket message")
+		}
+		var mask []byte
+		if masked {
+			mask = make([]byte, 4)
+			if _, err := io.ReadFull(r, mask); err != nil {
+				return nil, err
+			}
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		if op == wsOpClose {
+			return nil, io.EOF
+		}
+		if op != wsOpBinary {
+			// Skip control and non-binary messages
+			continue
+		}
+		if masked {
+			for i := range msg {
+				msg[i] ^= mask[i%4]
+			}
+		}
+		return msg, nil
+	}
+}
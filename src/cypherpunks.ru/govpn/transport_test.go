@@ -0,0 +1,155 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"testing/quick"
+)
+
+func init() {
+	TransportXORKey("test")
+}
+
+func testTransportPipe(t *testing.T, name string) {
+	tr, err := TransportGet(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connC, connS := net.Pipe()
+	client := TransportWrap(tr, connC, false)
+	server := TransportWrap(tr, connS, true)
+	defer client.Close()
+	defer server.Close()
+	buf := make([]byte, TransportMsgMax)
+	f := func(pkt []byte, fromServer bool) bool {
+		if len(pkt) == 0 {
+			return true
+		}
+		src, dst := client, server
+		if fromServer {
+			src, dst = server, client
+		}
+		go src.Write(pkt)
+		n, err := io.ReadFull(dst, buf[:len(pkt)])
+		return err == nil && bytes.Equal(buf[:n], pkt)
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(name, err)
+	}
+}
+
+func TestTransportPipe(t *testing.T) {
+	for _, name := range TransportNames() {
+		testTransportPipe(t, name)
+	}
+}
+
+func TestTransportDatagram(t *testing.T) {
+	for _, name := range TransportNames() {
+		tr, _ := TransportGet(name)
+		connS, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		connC, err := net.DialUDP("udp", nil, connS.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := TransportWrap(tr, connC, false)
+		pkts := [][]byte{[]byte("first"), bytes.Repeat([]byte{0x80}, 1000)}
+		for _, pkt := range pkts {
+			if _, err = client.Write(pkt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buf := make([]byte, TransportMsgMax)
+		for _, pkt := range pkts {
+			n, err := connS.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Each datagram is decoded separately
+			got, err := tr.Decode(bytes.NewReader(buf[:n]))
+			if err != nil || !bytes.Equal(got, pkt) {
+				t.Fatal(name, "datagram mismatch", err)
+			}
+		}
+		client.Close()
+		connS.Close()
+	}
+}
+
+func TestTransportOverhead(t *testing.T) {
+	pkt := make([]byte, EnclessEnlargeSize+MTUMax+CookieSize)
+	for _, name := range TransportNames() {
+		tr, _ := TransportGet(name)
+		for i := 0; i < 64; i++ {
+			msg, err := tr.Encode(pkt, i%2 == 0)
+			if err != nil || len(msg) > len(pkt)+TransportOverheadMax {
+				t.Fatal(name, "overhead is too big", len(msg)-len(pkt), err)
+			}
+		}
+	}
+}
+
+func TestTransportWSMasking(t *testing.T) {
+	tr, _ := TransportGet(TransportWS)
+	pkt := bytes.Repeat([]byte{0x80}, 200)
+	fromClient, _ := tr.Encode(pkt, false)
+	fromServer, _ := tr.Encode(pkt, true)
+	if fromClient[1]&0x80 == 0 || fromServer[1]&0x80 != 0 {
+		t.Fatal("Invalid masking")
+	}
+	if fromServer[0] != 0x82 || fromServer[1] != 126 || bytes.Contains(fromClient, pkt[:8]) {
+		t.Fatal("Invalid framing")
+	}
+	closeMsg := append([]byte{0x88, 0}, fromServer...)
+	if _, err := tr.Decode(bytes.NewReader(closeMsg)); err != io.EOF {
+		t.Fatal("Close message is not handled")
+	}
+}
+
+func TestTransportXORLook(t *testing.T) {
+	tr, _ := TransportGet(TransportXOR)
+	pkt := make([]byte, 100)
+	msg1, _ := tr.Encode(pkt, false)
+	msg2, _ := tr.Encode(pkt, false)
+	if bytes.Contains(msg1, pkt[:16]) || bytes.Equal(msg1[:16], msg2[:16]) {
+		t.Fatal("Scrambled messages are not random looking")
+	}
+}
+
+func TestTransportXORKey(t *testing.T) {
+	tr, _ := TransportGet(TransportXOR)
+	defer func() { transports[TransportXOR] = tr }()
+	msg, _ := tr.Encode([]byte("data"), false)
+	TransportXORKey("another")
+	other, _ := TransportGet(TransportXOR)
+	if _, err := other.Decode(bytes.NewReader(msg)); err == nil {
+		t.Fatal("Message with another key is decoded")
+	}
+	transports[TransportXOR] = transportXOR{}
+	if _, err := TransportGet(TransportXOR); err == nil {
+		t.Fatal("Keyless transport is usable")
+	}
+}
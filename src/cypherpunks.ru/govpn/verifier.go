@@ -24,22 +24,51 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/agl/ed25519"
 	"github.com/magical/argon2"
 	"golang.org/x/crypto/ssh/terminal"
+
+	"cypherpunks.ru/govpn/argon2id"
 )
 
 const (
 	DefaultM = 1 << 12
 	DefaultT = 1 << 7
 	DefaultP = 1
+
+	// Keypair is derived from the password
+	VerifierArgon2d  = "argon2d"
+	VerifierArgon2id = "argon2id"
+	// Keypair is random one, kept in the key file
+	VerifierEd25519 = "ed25519"
+
+	// Algorithm of newly generated password based verifiers
+	VerifierAlgDefault = VerifierArgon2id
 )
 
+// Password hashing functions of password based verifiers, indexed by
+// algorithm. Each produces 32-byte seed of Ed25519 keypair.
+var verifierKDFs = map[string]func(password, salt []byte, m, t, p int) ([]byte, error){
+	VerifierArgon2d: func(password, salt []byte, m, t, p int) ([]byte, error) {
+		return argon2.Key(password, salt, t, p, int64(m), 32)
+	},
+	VerifierArgon2id: func(password, salt []byte, m, t, p int) ([]byte, error) {
+		return argon2id.Key(password, salt, t, p, int64(m), 32)
+	},
+}
+
+// Is the verifier algorithm known and password based.
+func VerifierPasswordBased(alg string) bool {
+	_, exists := verifierKDFs[alg]
+	return exists
+}
+
 type Verifier struct {
+	Alg string
 	M   int
 	T   int
 	P   int
@@ -48,53 +77,156 @@ type Verifier struct {
 }
 
 // Generate new verifier for given peer, with specified password and
-// hashing parameters.
+// hashing parameters, using the default algorithm.
 func VerifierNew(m, t, p int, id *PeerId) *Verifier {
-	return &Verifier{M: m, T: t, P: p, Id: id}
+	return VerifierNewAlg(VerifierAlgDefault, m, t, p, id)
+}
+
+// Generate new verifier for given peer with specified password hashing
+// algorithm and its parameters.
+func VerifierNewAlg(alg string, m, t, p int, id *PeerId) *Verifier {
+	return &Verifier{Alg: alg, M: m, T: t, P: p, Id: id}
+}
+
+// Generate new verifier for given peer with random Ed25519 keypair.
+// Private key is returned for storing in the key file.
+func VerifierNewEd25519(id *PeerId) (*Verifier, *[ed25519.PrivateKeySize]byte, error) {
+	pub, prv, err := ed25519.GenerateKey(Rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Verifier{Alg: VerifierEd25519, Id: id, Pub: pub}, prv, nil
+}
+
+// Apply the private key read from the key file: save its public key in
+// verifier.
+func (v *Verifier) KeyApply(prv *[ed25519.PrivateKeySize]byte) {
+	v.Pub = new([ed25519.PublicKeySize]byte)
+	copy(v.Pub[:], prv[32:])
 }
 
 // Apply the password: create Ed25519 keypair based on it, save public
 // key in verifier.
 func (v *Verifier) PasswordApply(password string) *[ed25519.PrivateKeySize]byte {
-	r, err := argon2.Key([]byte(password), v.Id[:], v.T, v.P, int64(v.M), 32)
+	kdf, exists := verifierKDFs[v.Alg]
+	if !exists {
+		LogEvent("verifier_failed").Field("alg", v.Alg).Fatal("Verifier is not password based")
+	}
+	r, err := kdf([]byte(password), v.Id[:], v.M, v.T, v.P)
 	if err != nil {
-		log.Fatalln("Unable to apply Argon2d", err)
+		LogEvent("verifier_failed").Field("alg", v.Alg).Err(err).Fatal("Unable to apply password hashing")
 	}
 	defer SliceZero(r)
 	src := bytes.NewBuffer(r)
 	pub, prv, err := ed25519.GenerateKey(src)
 	if err != nil {
-		log.Fatalln("Unable to generate Ed25519 keypair", err)
+		LogEvent("verifier_failed").Err(err).Fatal("Unable to generate Ed25519 keypair")
 	}
 	v.Pub = pub
 	return prv
 }
 
+// Measure how long the password hashing with verifier's parameters
+// takes.
+func (v *Verifier) Bench() (time.Duration, error) {
+	kdf, exists := verifierKDFs[v.Alg]
+	if !exists {
+		return 0, errors.New("Verifier is not password based: " + v.Alg)
+	}
+	started := time.Now()
+	r, err := kdf([]byte("calibration"), v.Id[:], v.M, v.T, v.P)
+	if err != nil {
+		return 0, err
+	}
+	SliceZero(r)
+	return time.Since(started), nil
+}
+
+// Find password hashing parameters taking about target time on the
+// current machine: the biggest power of two memory size not exceeding
+// mMax KiBs, for which the single iteration fits, and the number of
+// iterations filling the target. Returns verifier (without
+// identity) and the time its password hashing actually takes.
+func VerifierCalibrate(alg string, target time.Duration, mMax, p int) (*Verifier, time.Duration, error) {
+	if !VerifierPasswordBased(alg) {
+		return nil, 0, errors.New("Verifier is not password based: " + alg)
+	}
+	mMin := 8 * p
+	if mMax < mMin {
+		return nil, 0, errors.New("Too little memory for the parallelizm")
+	}
+	v := VerifierNewAlg(alg, mMin, 1, p, new(PeerId))
+	for v.M*2 <= mMax {
+		v.M *= 2
+	}
+	var took time.Duration
+	var err error
+	for {
+		if took, err = v.Bench(); err != nil {
+			return nil, 0, err
+		}
+		if took <= target || v.M/2 < mMin {
+			break
+		}
+		v.M /= 2
+	}
+	// The first iteration includes the memory initialization, so
+	// refine the estimation once more after measuring several ones
+	for i := 0; i < 2 && took > 0; i++ {
+		t := int(float64(v.T) * float64(target) / float64(took))
+		if t < 1 || t == v.T {
+			break
+		}
+		v.T = t
+		if took, err = v.Bench(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return v, took, nil
+}
+
 // Parse either short or long verifier form.
 func VerifierFromString(input string) (*Verifier, error) {
 	s := strings.Split(input, "$")
-	if len(s) < 4 || s[1] != "argon2d" {
+	if len(s) < 3 || s[0] != "" {
 		return nil, errors.New("Invalid verifier structure")
 	}
-	var m, t, p int
-	n, err := fmt.Sscanf(s[2], "m=%d,t=%d,p=%d", &m, &t, &p)
-	if n != 3 || err != nil {
-		return nil, errors.New("Invalid verifier parameters")
+	v := Verifier{Alg: s[1]}
+	var rest []string
+	switch {
+	case VerifierPasswordBased(v.Alg):
+		if len(s) < 4 || len(s) > 5 {
+			return nil, errors.New("Invalid verifier structure")
+		}
+		n, err := fmt.Sscanf(s[2], "m=%d,t=%d,p=%d", &v.M, &v.T, &v.P)
+		if n != 3 || err != nil {
+			return nil, errors.New("Invalid verifier parameters")
+		}
+		rest = s[3:]
+	case v.Alg == VerifierEd25519:
+		if len(s) > 4 {
+			return nil, errors.New("Invalid verifier structure")
+		}
+		rest = s[2:]
+	default:
+		return nil, errors.New("Unknown verifier algorithm: " + v.Alg)
 	}
-	salt, err := base64.RawStdEncoding.DecodeString(s[3])
+	salt, err := base64.RawStdEncoding.DecodeString(rest[0])
 	if err != nil {
 		return nil, err
 	}
-	v := Verifier{M: m, T: t, P: p}
 	id := new([IDSize]byte)
 	copy(id[:], salt)
 	pid := PeerId(*id)
 	v.Id = &pid
-	if len(s) == 5 {
-		pub, err := base64.RawStdEncoding.DecodeString(s[4])
+	if len(rest) == 2 {
+		pub, err := base64.RawStdEncoding.DecodeString(rest[1])
 		if err != nil {
 			return nil, err
 		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid verifier public key")
+		}
 		v.Pub = new([ed25519.PublicKeySize]byte)
 		copy(v.Pub[:], pub)
 	}
@@ -104,9 +236,12 @@ func VerifierFromString(input string) (*Verifier, error) {
 // Short verifier string form -- it is useful for the client.
 // Does not include public key.
 func (v *Verifier) ShortForm() string {
+	if v.Alg == VerifierEd25519 {
+		return "$ed25519$" + base64.RawStdEncoding.EncodeToString(v.Id[:])
+	}
 	return fmt.Sprintf(
-		"$argon2d$m=%d,t=%d,p=%d$%s",
-		v.M, v.T, v.P, base64.RawStdEncoding.EncodeToString(v.Id[:]),
+		"$%s$m=%d,t=%d,p=%d$%s",
+		v.Alg, v.M, v.T, v.P, base64.RawStdEncoding.EncodeToString(v.Id[:]),
 	)
 }
 
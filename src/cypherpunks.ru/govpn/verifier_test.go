@@ -0,0 +1,89 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVerifierArgon2d(t *testing.T) {
+	long := "$argon2d$m=64,t=1,p=1$/gr2e1n4TedRcGU4EAIlzw$8RghAmnXcBCLVPO3/P56HqA6moM4BXOB7FEMPkyIJ6Q"
+	v, err := VerifierFromString(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := *v.Pub
+	v.PasswordApply("secret")
+	if !bytes.Equal(v.Pub[:], pub[:]) {
+		t.Fatal("Argon2d verifier does not match")
+	}
+	if v.LongForm() != long {
+		t.Fatal("long form differs", v.LongForm())
+	}
+}
+
+func TestVerifierArgon2id(t *testing.T) {
+	v := VerifierNew(64, 1, 1, &testPeerId)
+	if v.Alg != VerifierArgon2id {
+		t.Fatal("unexpected default algorithm", v.Alg)
+	}
+	v.PasswordApply("secret")
+	parsed, err := VerifierFromString(v.LongForm())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Alg != VerifierArgon2id || parsed.M != 64 || *parsed.Pub != *v.Pub {
+		t.Fatal("long form is not parsed back")
+	}
+	if parsed.ShortForm() != "$argon2id$m=64,t=1,p=1$AAAAAAAAAAAAAAAAAAAAAA" {
+		t.Fatal("unexpected short form", parsed.ShortForm())
+	}
+	d := VerifierNewAlg(VerifierArgon2d, 64, 1, 1, &testPeerId)
+	d.PasswordApply("secret")
+	if *d.Pub == *v.Pub {
+		t.Fatal("algorithms give the same key")
+	}
+}
+
+func TestVerifierUnknownAlg(t *testing.T) {
+	if _, err := VerifierFromString("$scrypt$m=64,t=1,p=1$AAAAAAAAAAAAAAAAAAAAAA"); err == nil {
+		t.Fatal("unknown algorithm is accepted")
+	}
+	if VerifierPasswordBased(VerifierEd25519) {
+		t.Fatal("Ed25519 is password based")
+	}
+}
+
+func TestVerifierCalibrate(t *testing.T) {
+	v, took, err := VerifierCalibrate(VerifierArgon2id, 50*time.Millisecond, 1000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.M > 512 || v.M < 8 || v.T < 1 || v.P != 1 || took <= 0 {
+		t.Fatal("unexpected parameters", v.M, v.T, v.P, took)
+	}
+	if _, _, err = VerifierCalibrate(VerifierArgon2id, time.Second, 4, 1); err == nil {
+		t.Fatal("too little memory is accepted")
+	}
+	if _, _, err = VerifierCalibrate(VerifierEd25519, time.Second, 1000, 1); err == nil {
+		t.Fatal("Ed25519 is calibrated")
+	}
+}
@@ -0,0 +1,129 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GUID appended to the key during WebSocket opening handshake
+// (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Connection, that reads through the specified reader, probably
+// holding already buffered data.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is that HTTP request WebSocket opening handshake.
+func WSIsUpgrade(r *http.Request) bool {
+	return r.Method == "GET" &&
+		headerHas(r.Header, "Connection", "upgrade") &&
+		headerHas(r.Header, "Upgrade", "websocket") &&
+		r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// Perform client's WebSocket opening handshake over already
+// established connection to host with the HTTP request to path.
+// Returned connection sends and receives WebSocket binary messages.
+func WSDial(conn net.Conn, host, path string) (net.Conn, error) {
+	if path == "" {
+		path = "/"
+	}
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(Rand, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := "GET " + path + " HTTP/1.1\r\n"
+	req += "Host: " + host + "\r\n"
+	req += "Upgrade: websocket\r\n"
+	req += "Connection: Upgrade\r\n"
+	req += "Sec-WebSocket-Key: " + key + "\r\n"
+	req += "Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "GET"})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("Unexpected WebSocket response: " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errors.New("Invalid WebSocket accept key")
+	}
+	return TransportWrap(transportWS{}, &readerConn{conn, br}, false), nil
+}
+
+// Perform server's side of WebSocket opening handshake: hijack the
+// connection from HTTP server and reply to the request. Returned
+// connection sends and receives WebSocket binary messages.
+func WSUpgrade(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if !WSIsUpgrade(r) {
+		return nil, errors.New("Not WebSocket request")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("Hijacking is not supported")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n"
+	resp += "Upgrade: websocket\r\n"
+	resp += "Connection: Upgrade\r\n"
+	resp += "Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"
+	if _, err = conn.Write([]byte(resp)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return TransportWrap(transportWS{}, &readerConn{conn, brw.Reader}, true), nil
+}
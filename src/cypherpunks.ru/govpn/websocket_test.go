@@ -0,0 +1,96 @@
+/*
+GoVPN -- simple secure free software virtual private network daemon
+Copyright (C) 2014-2016 Sergey Matveev <stargrave@stargrave.org>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package govpn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWSUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" || !WSIsUpgrade(r) {
+			io.WriteString(w, "decoy")
+			return
+		}
+		conn, err := WSUpgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, TransportMsgMax)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "decoy" {
+		t.Fatal("decoy is not served")
+	}
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	raw, err := net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := WSDial(raw, host, "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, TransportMsgMax)
+	for _, size := range []int{1, 125, 126, 1500, 65535} {
+		pkt := make([]byte, size)
+		io.ReadFull(Rand, pkt)
+		if _, err = conn.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.ReadFull(conn, buf[:size])
+		if err != nil || !bytes.Equal(buf[:n], pkt) {
+			t.Fatal("echoed data differs", size, err)
+		}
+	}
+
+	raw, err = net.Dial("tcp", host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	if _, err = WSDial(raw, host, "/elsewhere"); err == nil {
+		t.Fatal("upgrade on wrong path succeeded")
+	}
+}